@@ -52,9 +52,9 @@ func DefaultBuild() (Build, error) {
 		return Build{}, err
 	}
 
-	logger := Logger{b.Logger}
+	logger := Logger{Logger: b.Logger}
 	buildpack := NewBuildpack(b.Buildpack)
-	cache := Cache{b.Cache, buildpack.CacheRoot, logger}
+	cache := Cache{Cache: b.Cache, BuildpackCacheRoot: buildpack.CacheRoot, Logger: logger}
 
 	return Build{
 		b,
@@ -18,8 +18,12 @@ package libjavabuildpack
 
 import (
 	"fmt"
+	"net/url"
+	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/Masterminds/semver"
 	"github.com/buildpack/libbuildpack"
@@ -31,28 +35,61 @@ type Buildpack struct {
 
 	// CacheRoot is the path to the root directory for the buildpack's dependency cache.
 	CacheRoot string
+
+	// Catalog is an optional remote index of dependencies that are merged with the inline dependencies.
+	Catalog Catalog `toml:"-"`
+
+	// DependencyFiles are the paths, relative to the buildpack root if not absolute, of additional TOML files whose
+	// dependencies arrays are merged with the inline dependencies.  A Packager writes the merged dependencies into the
+	// packaged buildpack.toml, so the files are not needed by the packaged buildpack.
+	DependencyFiles []string `toml:"-"`
+
+	// resolved, if set, is the resolution served by Dependencies and IncludeFiles instead of parsing the metadata.
+	resolved *resolution
+}
+
+// Composite returns whether the buildpack is a composite buildpack.  A composite buildpack has an order.toml and no bin
+// directory.
+func (b Buildpack) Composite() (bool, error) {
+	bin, err := FileExists(filepath.Join(b.Root, "bin"))
+	if err != nil {
+		return false, err
+	}
+
+	if bin {
+		return false, nil
+	}
+
+	return FileExists(b.orderPath())
 }
 
-// Dependencies returns the collection of dependencies extracted from the generic buildpack metadata.
+// Dependencies returns the collection of dependencies extracted from the generic buildpack metadata, merged with the
+// dependencies of any dependency files and any dependencies resolved from the catalog.  A dependency declared more than
+// once with the same id, version, and sha256 is included once, and with a different sha256 is an error.  Inline and
+// file dependencies take precedence over catalog entries with the same id and version.
 func (b Buildpack) Dependencies() (Dependencies, error) {
-	d, ok := b.Metadata["dependencies"]
-	if !ok {
-		return Dependencies{}, nil
+	if b.resolved != nil {
+		return b.resolved.dependencies.clone(), nil
 	}
 
-	deps, ok := d.([]map[string]interface{})
-	if !ok {
-		return Dependencies{}, fmt.Errorf("dependencies have invalid structure")
+	dependencies, err := b.inlineDependencies()
+	if err != nil {
+		return Dependencies{}, err
 	}
 
-	var dependencies Dependencies
-	for _, dep := range deps {
-		d, err := b.dependency(dep)
-		if err != nil {
-			return Dependencies{}, err
-		}
+	if dependencies, err = b.fileDependencies(dependencies); err != nil {
+		return Dependencies{}, err
+	}
 
-		dependencies = append(dependencies, d)
+	catalog, err := b.Catalog.Dependencies()
+	if err != nil {
+		return Dependencies{}, err
+	}
+
+	for _, c := range catalog {
+		if !dependencies.has(c.ID, c.Version) {
+			dependencies = append(dependencies, c)
+		}
 	}
 
 	b.Logger.Debug("Dependencies: %s", dependencies)
@@ -61,6 +98,10 @@ func (b Buildpack) Dependencies() (Dependencies, error) {
 
 // IncludeFiles returns the include_files buildpack metadata.
 func (b Buildpack) IncludeFiles() ([]string, error) {
+	if b.resolved != nil {
+		return append([]string{}, b.resolved.includeFiles...), nil
+	}
+
 	i, ok := b.Metadata["include_files"]
 	if !ok {
 		return []string{}, nil
@@ -84,6 +125,18 @@ func (b Buildpack) IncludeFiles() ([]string, error) {
 	return includes, nil
 }
 
+// Order returns the contents of the order.toml of a composite buildpack.
+func (b Buildpack) Order() (Order, error) {
+	var order Order
+
+	if err := FromTomlFile(b.orderPath(), &order); err != nil {
+		return Order{}, err
+	}
+
+	b.Logger.Debug("Order: %v", order)
+	return order, nil
+}
+
 // PrePackage returns the pre_package buildpack metadata.
 func (b Buildpack) PrePackage() (string, bool) {
 	p, ok := b.Metadata["pre_package"]
@@ -95,6 +148,150 @@ func (b Buildpack) PrePackage() (string, bool) {
 	return s, ok
 }
 
+// PrePackageOptional returns whether the pre_package_optional buildpack metadata marks the pre-package script as
+// optional, so that packaging proceeds if it is not present.
+func (b Buildpack) PrePackageOptional() bool {
+	o, _ := b.Metadata["pre_package_optional"].(bool)
+	return o
+}
+
+// Provides returns the names of the entries of the provides buildpack metadata.
+func (b Buildpack) Provides() ([]string, error) {
+	return b.planEntries("provides")
+}
+
+// Requires returns the names of the entries of the requires buildpack metadata.
+func (b Buildpack) Requires() ([]string, error) {
+	return b.planEntries("requires")
+}
+
+// dependencyFile returns the dependencies of a dependency file, reusing them from the catalog's resolver cache while
+// the file's size and modification time are unchanged.
+func (b Buildpack) dependencyFile(f string) (Dependencies, error) {
+	stat, err := os.Stat(f)
+	if err != nil {
+		return Dependencies{}, err
+	}
+
+	key := fmt.Sprintf("dependency-file\x00%s\x00%d\x00%d", f, stat.Size(), stat.ModTime().UnixNano())
+	if dependencies, ok := b.Catalog.Cache.get(key); ok {
+		return dependencies, nil
+	}
+
+	var raw struct {
+		Dependencies []map[string]interface{} `toml:"dependencies"`
+	}
+	if err := FromTomlFile(f, &raw); err != nil {
+		return Dependencies{}, err
+	}
+
+	var dependencies Dependencies
+	for _, dep := range raw.Dependencies {
+		d, err := b.dependency(dep)
+		if err != nil {
+			return Dependencies{}, fmt.Errorf("%s: %s", f, err)
+		}
+
+		dependencies = append(dependencies, d)
+	}
+
+	b.Catalog.Cache.put(key, dependencies)
+	return dependencies, nil
+}
+
+func (b Buildpack) fileDependencies(dependencies Dependencies) (Dependencies, error) {
+	for _, f := range b.DependencyFiles {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(b.Root, f)
+		}
+
+		deps, err := b.dependencyFile(f)
+		if err != nil {
+			return Dependencies{}, err
+		}
+
+		for _, d := range deps {
+			duplicate := false
+			for _, c := range dependencies {
+				if c.ID != d.ID || !c.Version.Equal(d.Version.Version) {
+					continue
+				}
+
+				if c.SHA256 != d.SHA256 {
+					return Dependencies{}, fmt.Errorf(
+						"dependency %s %s is declared more than once with different sha256", d.ID, d.Version.Original())
+				}
+
+				duplicate = true
+			}
+
+			if !duplicate {
+				dependencies = append(dependencies, d)
+			}
+		}
+	}
+
+	return dependencies, nil
+}
+
+func (b Buildpack) inlineDependencies() (Dependencies, error) {
+	d, ok := b.Metadata["dependencies"]
+	if !ok {
+		return Dependencies{}, nil
+	}
+
+	deps, ok := d.([]map[string]interface{})
+	if !ok {
+		return Dependencies{}, fmt.Errorf("dependencies have invalid structure")
+	}
+
+	var dependencies Dependencies
+	for _, dep := range deps {
+		d, err := b.dependency(dep)
+		if err != nil {
+			return Dependencies{}, err
+		}
+
+		dependencies = append(dependencies, d)
+	}
+
+	return dependencies, nil
+}
+
+func (b Buildpack) planEntries(key string) ([]string, error) {
+	e, ok := b.Metadata[key]
+	if !ok {
+		return []string{}, nil
+	}
+
+	entries, ok := e.([]map[string]interface{})
+	if !ok {
+		return []string{}, fmt.Errorf("%s have invalid structure", key)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name, ok := entry["name"].(string)
+		if !ok || name == "" {
+			return []string{}, fmt.Errorf("%s entry %v has no name", key, entry)
+		}
+
+		for _, n := range names {
+			if n == name {
+				return []string{}, fmt.Errorf("%s entry %s is declared more than once", key, name)
+			}
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+func (b Buildpack) orderPath() string {
+	return filepath.Join(b.Root, "order.toml")
+}
+
 func (b Buildpack) dependency(dep map[string]interface{}) (Dependency, error) {
 	id, ok := dep["id"].(string)
 	if !ok {
@@ -167,17 +364,183 @@ func (b Buildpack) dependency(dep map[string]interface{}) (Dependency, error) {
 		licenses = append(licenses, License{lt, lu})
 	}
 
+	var size int64
+	if z, ok := dep["size"]; ok {
+		size, ok = z.(int64)
+		if !ok {
+			return Dependency{}, fmt.Errorf("dependency size wrong format")
+		}
+	}
+
+	var arch string
+	if z, ok := dep["arch"]; ok {
+		arch, ok = z.(string)
+		if !ok {
+			return Dependency{}, fmt.Errorf("dependency arch wrong format")
+		}
+	}
+
+	var destination string
+	if z, ok := dep["destination"]; ok {
+		destination, ok = z.(string)
+		if !ok {
+			return Dependency{}, fmt.Errorf("dependency destination wrong format")
+		}
+
+		if destination, err = cleanDestination(destination); err != nil {
+			return Dependency{}, err
+		}
+	}
+
+	var eolDate string
+	if z, ok := dep["eol_date"]; ok {
+		switch t := z.(type) {
+		case string:
+			eolDate = t
+		case time.Time:
+			eolDate = t.Format("2006-01-02")
+		default:
+			return Dependency{}, fmt.Errorf("dependency eol_date wrong format")
+		}
+
+		if err := checkEOLDate(eolDate); err != nil {
+			return Dependency{}, err
+		}
+	}
+
+	var group string
+	if z, ok := dep["group"]; ok {
+		group, ok = z.(string)
+		if !ok {
+			return Dependency{}, fmt.Errorf("dependency group wrong format")
+		}
+	}
+
+	var purl string
+	if z, ok := dep["purl"]; ok {
+		purl, ok = z.(string)
+		if !ok {
+			return Dependency{}, fmt.Errorf("dependency purl wrong format")
+		}
+
+		if err := checkPURL(purl); err != nil {
+			return Dependency{}, err
+		}
+	}
+
+	var selected []string
+	if z, ok := dep["select"]; ok {
+		patterns, ok := z.([]interface{})
+		if !ok {
+			return Dependency{}, fmt.Errorf("dependency select wrong format")
+		}
+
+		for _, t := range patterns {
+			pattern, ok := t.(string)
+			if !ok {
+				return Dependency{}, fmt.Errorf("dependency select wrong format")
+			}
+
+			if err := checkSelect(pattern); err != nil {
+				return Dependency{}, err
+			}
+
+			selected = append(selected, pattern)
+		}
+	}
+
+	var skipChecksum bool
+	if z, ok := dep["skip_checksum"]; ok {
+		skipChecksum, ok = z.(bool)
+		if !ok {
+			return Dependency{}, fmt.Errorf("dependency skip_checksum wrong format")
+		}
+	}
+
+	var source string
+	if z, ok := dep["source"]; ok {
+		source, ok = z.(string)
+		if !ok {
+			return Dependency{}, fmt.Errorf("dependency source wrong format")
+		}
+
+		if err := checkSource(source); err != nil {
+			return Dependency{}, err
+		}
+	}
+
+	var verify string
+	if z, ok := dep["verify"]; ok {
+		verify, ok = z.(string)
+		if !ok {
+			return Dependency{}, fmt.Errorf("dependency verify wrong format")
+		}
+	}
+
 	return Dependency{
-		id,
-		name,
-		Version{version},
-		uri,
-		sha256,
-		stacks,
-		licenses,
+		ID:           id,
+		Name:         name,
+		Version:      Version{version},
+		URI:          uri,
+		SHA256:       sha256,
+		Size:         size,
+		Stacks:       stacks,
+		Licenses:     licenses,
+		Arch:         arch,
+		Destination:  destination,
+		EOLDate:      eolDate,
+		Group:        group,
+		PURL:         purl,
+		Select:       selected,
+		SkipChecksum: skipChecksum,
+		Source:       source,
+		Verify:       verify,
 	}, nil
 }
 
+func checkEOLDate(eolDate string) error {
+	if _, err := time.Parse("2006-01-02", eolDate); err != nil {
+		return fmt.Errorf("dependency eol_date %s is malformed: %s", eolDate, err)
+	}
+
+	return nil
+}
+
+func checkPURL(purl string) error {
+	if !strings.HasPrefix(purl, "pkg:") {
+		return fmt.Errorf("dependency purl wrong format")
+	}
+
+	return nil
+}
+
+func checkSelect(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("dependency select %s is malformed: %s", pattern, err)
+	}
+
+	return nil
+}
+
+func checkSource(source string) error {
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "") {
+		return fmt.Errorf("dependency source %s is not an absolute URI", source)
+	}
+
+	return nil
+}
+
+func cleanDestination(destination string) (string, error) {
+	d := filepath.Clean(destination)
+
+	if filepath.IsAbs(d) || d == ".." || strings.HasPrefix(d, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("dependency destination %s is outside of the buildpack", destination)
+	}
+
+	return d, nil
+}
+
 // Dependencies is a collection of Dependency instances.
 type Dependencies []Dependency
 
@@ -212,6 +575,39 @@ func (d Dependencies) Best(id string, versionConstraint string, stack string) (D
 	return candidates[len(candidates)-1], nil
 }
 
+// ForArch returns the dependencies within a collection of Dependencies that are compatible with an architecture.  It
+// can be combined with Best to select by both architecture and stack.
+func (d Dependencies) ForArch(arch string) Dependencies {
+	var candidates Dependencies
+
+	for _, c := range d {
+		if c.Arch == "" || c.Arch == arch {
+			candidates = append(candidates, c)
+		}
+	}
+
+	return candidates
+}
+
+// ForGroups returns the dependencies within a collection of Dependencies that belong to one of the groups, or to no
+// group.
+func (d Dependencies) ForGroups(groups []string) Dependencies {
+	var candidates Dependencies
+
+	for _, c := range d {
+		selected := c.Group == ""
+		for _, g := range groups {
+			selected = selected || c.Group == g
+		}
+
+		if selected {
+			candidates = append(candidates, c)
+		}
+	}
+
+	return candidates
+}
+
 // Len makes Dependencies satisfy the sort.Interface interface.
 func (d Dependencies) Len() int {
 	return len(d)
@@ -222,11 +618,66 @@ func (d Dependencies) Less(i int, j int) bool {
 	return d[i].Version.LessThan(d[j].Version.Version)
 }
 
+// clone returns a copy of the collection that shares no slices with it, so that neither can modify the other.
+func (d Dependencies) clone() Dependencies {
+	c := make(Dependencies, len(d))
+
+	for i, dep := range d {
+		dep.Stacks = append(Stacks(nil), dep.Stacks...)
+		dep.Licenses = append(Licenses(nil), dep.Licenses...)
+		dep.Select = append([]string(nil), dep.Select...)
+		c[i] = dep
+	}
+
+	return c
+}
+
+func (d Dependencies) has(id string, version Version) bool {
+	for _, c := range d {
+		if c.ID == id && c.Version.Equal(version.Version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortByID sorts the dependencies by id and then version, giving an order independent of how they were declared.
+func (d Dependencies) sortByID() {
+	sort.SliceStable(d, func(i, j int) bool {
+		if d[i].ID != d[j].ID {
+			return d[i].ID < d[j].ID
+		}
+		return d.Less(i, j)
+	})
+}
+
 // Swap makes Dependencies satisfy the sort.Interface interface.
 func (d Dependencies) Swap(i int, j int) {
 	d[i], d[j] = d[j], d[i]
 }
 
+// uniqueByDigest returns the dependencies with any entry that shares a sha256 with an earlier entry removed.
+func (d Dependencies) uniqueByDigest() Dependencies {
+	var unique Dependencies
+
+	for _, c := range d {
+		duplicate := false
+		for _, u := range unique {
+			if u.SHA256 == c.SHA256 {
+				duplicate = true
+				break
+			}
+		}
+
+		if !duplicate {
+			unique = append(unique, c)
+		}
+	}
+
+	return unique
+}
+
 // Dependency represents a buildpack dependency.
 type Dependency struct {
 	// ID is the dependency ID.
@@ -244,11 +695,96 @@ type Dependency struct {
 	// SHA256 is the hash of the dependency.
 	SHA256 string `toml:"sha256"`
 
+	// Size is the size of the dependency in bytes.  If zero, the size of a download is not verified.
+	Size int64 `toml:"size,omitzero"`
+
 	// Stacks are the stacks the dependency is compatible with.
 	Stacks Stacks `toml:"stacks"`
 
 	// Licenses are the stacks the dependency is distributed under.
 	Licenses Licenses `toml:"licenses"`
+
+	// Arch, if set, is the architecture the dependency's artifact is built for.  A dependency without an architecture
+	// is compatible with all architectures.
+	Arch string `toml:"arch,omitempty"`
+
+	// Destination, if set, is the directory within the buildpack that the artifact and its metadata are packaged in,
+	// rather than the cache layout.
+	Destination string `toml:"destination,omitempty"`
+
+	// EOLDate, if set, is the date, in the form 2006-01-02, after which the dependency is end of life and should no
+	// longer be packaged.
+	EOLDate string `toml:"eol_date,omitempty"`
+
+	// Group, if set, is the logical group the dependency belongs to, such as jdk or agents, so that product editions
+	// can package subsets of the dependencies.  A dependency without a group belongs to every edition.
+	Group string `toml:"group,omitempty"`
+
+	// PURL, if set, is the package URL that identifies the dependency in a software bill of materials, overriding the
+	// one derived by PackageURL.
+	PURL string `toml:"purl,omitempty"`
+
+	// Select, if set, are glob patterns of the files within the dependency's zip or tar.gz artifact that are packaged.
+	// The artifact is extracted and only the matching files are packaged, under Destination, rather than the artifact.
+	Select []string `toml:"select,omitempty"`
+
+	// SkipChecksum indicates whether the artifact is used without its sha256 being verified, for an upstream whose
+	// artifact changes without its version changing.  The sha256 still identifies the artifact's cache layer, and a
+	// warning is logged each time verification is skipped.
+	SkipChecksum bool `toml:"skip_checksum,omitempty"`
+
+	// Source, if set, is a reference to the upstream release that the artifact was built from, such as the URL of a
+	// source archive or tag, or a package URL.  It must be an absolute URI and is recorded for provenance rather than
+	// verified against the artifact.
+	Source string `toml:"source,omitempty"`
+
+	// Verify, if set, is a command, relative to the buildpack root if not absolute, that is run with the path of the
+	// artifact as its argument once it has been cached for packaging.  A nonzero exit fails packaging, which catches
+	// corruption that a checksum of a mirror's artifact cannot.
+	Verify string `toml:"verify,omitempty"`
+}
+
+// PackageURL returns the package URL of the dependency.  If PURL is not set, a best-effort package URL is derived: a
+// pkg:maven purl for a URI in the layout of a Maven repository below a maven2 directory, and otherwise a pkg:generic
+// purl for an HTTP or HTTPS URI.  It is empty if no package URL can be determined.
+func (d Dependency) PackageURL() string {
+	if d.PURL != "" {
+		return d.PURL
+	}
+
+	if d.Version.Version == nil {
+		return ""
+	}
+	version := d.Version.Original()
+
+	u, err := url.Parse(d.URI)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, s := range segments {
+		if s != "maven2" || len(segments)-i < 5 {
+			continue
+		}
+
+		group := segments[i+1 : len(segments)-3]
+		artifact, v, file := segments[len(segments)-3], segments[len(segments)-2], segments[len(segments)-1]
+
+		if !strings.HasPrefix(file, artifact+"-"+v) {
+			break
+		}
+
+		purl := fmt.Sprintf("pkg:maven/%s/%s@%s", strings.Join(group, "."), artifact, url.PathEscape(v))
+		if ext := strings.TrimPrefix(filepath.Ext(file), "."); ext != "" && ext != "jar" {
+			purl += "?type=" + url.QueryEscape(ext)
+		}
+
+		return purl
+	}
+
+	return fmt.Sprintf("pkg:generic/%s@%s?download_url=%s", url.PathEscape(d.ID), url.PathEscape(version),
+		url.QueryEscape(d.URI))
 }
 
 // String makes Dependency satisfy the Stringer interface.
@@ -304,10 +840,46 @@ type License struct {
 	URI string `toml:"uri"`
 }
 
+// ResolvedBuildpack is a Buildpack whose dependencies and include files are parsed once, at creation, and then served
+// from memory.  Its Buildpack serves them as well, so it can be given to a Packager.  Use Refresh to re-parse after the
+// underlying metadata has changed.
+type ResolvedBuildpack struct {
+	Buildpack
+}
+
+// Refresh returns a new ResolvedBuildpack, re-parsing the dependencies and include files from the buildpack metadata.
+func (r ResolvedBuildpack) Refresh() (ResolvedBuildpack, error) {
+	return NewResolvedBuildpack(r.Buildpack)
+}
+
+type resolution struct {
+	dependencies Dependencies
+	includeFiles []string
+}
+
 // NewBuildpack creates a new instance of Buildpack from a specified libbuildpack.Buildpack.
 func NewBuildpack(buildpack libbuildpack.Buildpack) Buildpack {
 	return Buildpack{
-		buildpack,
-		filepath.Join(buildpack.Root, "cache"),
+		Buildpack: buildpack,
+		CacheRoot: filepath.Join(buildpack.Root, "cache"),
 	}
 }
+
+// NewResolvedBuildpack creates a new instance of ResolvedBuildpack, parsing the dependencies and include files of a
+// specified Buildpack.
+func NewResolvedBuildpack(buildpack Buildpack) (ResolvedBuildpack, error) {
+	buildpack.resolved = nil
+
+	dependencies, err := buildpack.Dependencies()
+	if err != nil {
+		return ResolvedBuildpack{}, err
+	}
+
+	includeFiles, err := buildpack.IncludeFiles()
+	if err != nil {
+		return ResolvedBuildpack{}, err
+	}
+
+	buildpack.resolved = &resolution{dependencies.clone(), includeFiles}
+	return ResolvedBuildpack{buildpack}, nil
+}
@@ -17,13 +17,20 @@
 package libjavabuildpack_test
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Masterminds/semver"
 	"github.com/buildpack/libbuildpack"
 	"github.com/cloudfoundry/libjavabuildpack"
+	"github.com/cloudfoundry/libjavabuildpack/test"
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
 )
@@ -88,6 +95,7 @@ func testBuildpack(t *testing.T, when spec.G, it spec.S) {
 						"version": "2.0",
 						"uri":     "test-uri-2",
 						"sha256":  "test-sha256-2",
+						"size":    int64(1024),
 						"stacks":  []interface{}{"test-stack-2a", "test-stack-2b"},
 						"licenses": []map[string]interface{}{
 							{
@@ -123,6 +131,7 @@ func testBuildpack(t *testing.T, when spec.G, it spec.S) {
 				Version: newVersion(t, "2.0"),
 				URI:     "test-uri-2",
 				SHA256:  "test-sha256-2",
+				Size:    1024,
 				Stacks:  libjavabuildpack.Stacks{"test-stack-2a", "test-stack-2b"},
 				Licenses: libjavabuildpack.Licenses{
 					libjavabuildpack.License{Type: "test-type-1", URI: "test-uri-1"},
@@ -141,6 +150,451 @@ func testBuildpack(t *testing.T, when spec.G, it spec.S) {
 		}
 	})
 
+	it("merges dependencies resolved from a catalog", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "test-authorization" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			fmt.Fprint(w, `[
+  { "id": "test-id", "name": "test-name", "version": "2.0", "uri": "test-uri-2", "sha256": "test-sha256-2",
+    "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] },
+  { "id": "test-id", "name": "test-name", "version": "1.0", "uri": "test-uri-catalog", "sha256": "test-sha256-catalog",
+    "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] },
+  { "id": "test-id", "name": "test-name", "version": "3.0", "uri": "test-uri-3", "sha256": "test-sha256-3",
+    "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] },
+  { "id": "test-id-other", "name": "test-name", "version": "1.0", "uri": "test-uri", "sha256": "test-sha256",
+    "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] }
+]`)
+		}))
+		defer server.Close()
+
+		b := libjavabuildpack.Buildpack{
+			Buildpack: libbuildpack.Buildpack{
+				Metadata: libbuildpack.BuildpackMetadata{
+					"dependencies": []map[string]interface{}{
+						{
+							"id":       "test-id",
+							"name":     "test-name",
+							"version":  "1.0",
+							"uri":      "test-uri-1",
+							"sha256":   "test-sha256-1",
+							"stacks":   []interface{}{"test-stack"},
+							"licenses": []map[string]interface{}{{"type": "test-type"}},
+						},
+					},
+				},
+			},
+			Catalog: libjavabuildpack.Catalog{
+				URI:           server.URL,
+				Authorization: "test-authorization",
+				Constraints:   map[string]string{"test-id": "< 3.0"},
+			},
+		}
+
+		actual, err := b.Dependencies()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var uris []string
+		for _, d := range actual {
+			uris = append(uris, d.URI)
+		}
+
+		expected := []string{"test-uri-1", "test-uri-2"}
+		if !reflect.DeepEqual(uris, expected) {
+			t.Errorf("Buildpack.Dependencies URIs = %s, expected %s", uris, expected)
+		}
+	})
+
+	it("decodes catalog entries with the keys of inline dependencies", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `[
+  { "id": "test-id", "name": "test-name", "version": "1.0", "uri": "test-uri", "sha256": "test-sha256",
+    "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ], "eol_date": "2030-01-01",
+    "purl": "pkg:generic/test-name@1.0" }
+]`)
+		}))
+		defer server.Close()
+
+		c := libjavabuildpack.Catalog{URI: server.URL, Constraints: map[string]string{"test-id": "*"}}
+
+		actual, err := c.Dependencies()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(actual) != 1 || actual[0].Version.Original() != "1.0" || actual[0].EOLDate != "2030-01-01" ||
+			actual[0].PURL != "pkg:generic/test-name@1.0" {
+			t.Errorf("Catalog.Dependencies() = %s, expected version 1.0 with eol_date and purl", actual)
+		}
+	})
+
+	it("returns error for a catalog entry with a malformed version", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `[ { "id": "test-id", "name": "test-name", "version": "test-version" } ]`)
+		}))
+		defer server.Close()
+
+		c := libjavabuildpack.Catalog{URI: server.URL, Constraints: map[string]string{"test-id": "*"}}
+
+		_, err := c.Dependencies()
+		if err == nil || !strings.Contains(err.Error(), "version test-version is malformed") {
+			t.Errorf("Catalog.Dependencies() = %v, expected malformed version", err)
+		}
+	})
+
+	it("returns error for a catalog entry that fails the validation of inline dependencies", func() {
+		cases := []struct {
+			name     string
+			keys     string
+			expected string
+		}{
+			{"missing sha256", `"sha256": ""`, "sha256 missing"},
+			{"no stacks", `"stacks": []`, "at least one stack"},
+			{"no licenses", `"licenses": []`, "at least one license"},
+			{"malformed purl", `"purl": "test-purl"`, "purl wrong format"},
+			{"malformed select", `"select": [ "[" ]`, "select [ is malformed"},
+			{"malformed eol_date", `"eol_date": "test-date"`, "eol_date test-date is malformed"},
+			{"skip_checksum", `"skip_checksum": false`, "sets skip_checksum"},
+			{"verify", `"verify": "test-verify"`, "sets verify"},
+		}
+
+		for _, c := range cases {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `[
+  { "id": "test-id", "name": "test-name", "version": "1.0", "uri": "test-uri", "sha256": "test-sha256",
+    "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ], %s }
+]`, c.keys)
+			}))
+
+			_, err := libjavabuildpack.Catalog{URI: server.URL, Constraints: map[string]string{"test-id": "*"}}.
+				Dependencies()
+			server.Close()
+
+			if err == nil || !strings.Contains(err.Error(), c.expected) {
+				t.Errorf("%s: Catalog.Dependencies() = %v, expected %s", c.name, err, c.expected)
+			}
+		}
+	})
+
+	it("reuses a catalog from the resolver cache until it is flushed", func() {
+		var requests int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			fmt.Fprint(w, `[
+  { "id": "test-id", "name": "test-name", "version": "1.0", "uri": "test-uri", "sha256": "test-sha256",
+    "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] }
+]`)
+		}))
+		defer server.Close()
+
+		c := libjavabuildpack.Catalog{
+			URI:         server.URL,
+			Cache:       libjavabuildpack.NewResolverCache(time.Hour),
+			Constraints: map[string]string{"test-id": "*"},
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err := c.Dependencies(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if requests != 1 {
+			t.Errorf("catalog requests = %d, expected 1 within TTL", requests)
+		}
+
+		c.Cache.Flush()
+
+		if _, err := c.Dependencies(); err != nil {
+			t.Fatal(err)
+		}
+
+		if requests != 2 {
+			t.Errorf("catalog requests = %d, expected 2 after flush", requests)
+		}
+	})
+
+	it("resolves with a zero value resolver cache", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `[
+  { "id": "test-id", "name": "test-name", "version": "1.0", "uri": "test-uri", "sha256": "test-sha256",
+    "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] }
+]`)
+		}))
+		defer server.Close()
+
+		c := libjavabuildpack.Catalog{
+			URI:         server.URL,
+			Cache:       &libjavabuildpack.ResolverCache{},
+			Constraints: map[string]string{"test-id": "*"},
+		}
+
+		for i := 0; i < 2; i++ {
+			if d, err := c.Dependencies(); err != nil {
+				t.Fatal(err)
+			} else if len(d) != 1 {
+				t.Errorf("Catalog.Dependencies() = %s, expected one dependency", d)
+			}
+		}
+	})
+
+	it("reuses a parsed dependency file from the resolver cache until it changes", func() {
+		root := test.ScratchDir(t, "buildpack")
+		f := filepath.Join(root, "dependencies.toml")
+
+		write := func(content string, modTime time.Time) {
+			if err := libjavabuildpack.WriteToFile(strings.NewReader(content), f, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chtimes(f, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		content := `[[dependencies]]
+id = "test-id"
+name = "test-name"
+version = "1.0"
+uri = "test-uri"
+sha256 = "test-sha256"
+stacks = [ "test-stack" ]
+
+  [[dependencies.licenses]]
+  type = "test-type"
+`
+		modTime := time.Now().Add(-time.Hour)
+		write(content, modTime)
+
+		b := libjavabuildpack.Buildpack{
+			Buildpack:       libbuildpack.Buildpack{Root: root, Metadata: libbuildpack.BuildpackMetadata{}},
+			Catalog:         libjavabuildpack.Catalog{Cache: libjavabuildpack.NewResolverCache(time.Hour)},
+			DependencyFiles: []string{"dependencies.toml"},
+		}
+
+		if _, err := b.Dependencies(); err != nil {
+			t.Fatal(err)
+		}
+
+		write(strings.Repeat("#", len(content)), modTime)
+
+		if d, err := b.Dependencies(); err != nil {
+			t.Fatal(err)
+		} else if len(d) != 1 {
+			t.Errorf("Buildpack.Dependencies() = %s, expected the cached dependency", d)
+		}
+
+		write(strings.Repeat("#", len(content)), modTime.Add(time.Minute))
+
+		if d, err := b.Dependencies(); err != nil {
+			t.Fatal(err)
+		} else if len(d) != 0 {
+			t.Errorf("Buildpack.Dependencies() = %s, expected the changed file to be parsed again", d)
+		}
+	})
+
+	it("merges dependencies from dependency files", func() {
+		root := test.ScratchDir(t, "buildpack")
+
+		dependency := func(version string, sha256 string) string {
+			return fmt.Sprintf(`[[dependencies]]
+id = "test-id"
+name = "test-name"
+version = "%s"
+uri = "test-uri-%s"
+sha256 = "%s"
+stacks = [ "test-stack" ]
+
+  [[dependencies.licenses]]
+  type = "test-type"
+
+`, version, version, sha256)
+		}
+
+		first := strings.NewReader(dependency("1.0", "test-sha256-1") + dependency("2.0", "test-sha256-2"))
+		if err := libjavabuildpack.WriteToFile(first, filepath.Join(root, "dependencies", "a.toml"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		second := strings.NewReader(dependency("2.0", "test-sha256-2") + dependency("3.0", "test-sha256-3"))
+		if err := libjavabuildpack.WriteToFile(second, filepath.Join(root, "dependencies", "b.toml"),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+
+		b := libjavabuildpack.Buildpack{
+			Buildpack:       libbuildpack.Buildpack{Root: root, Metadata: libbuildpack.BuildpackMetadata{}},
+			DependencyFiles: []string{"dependencies/a.toml", filepath.Join(root, "dependencies", "b.toml")},
+		}
+
+		actual, err := b.Dependencies()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var uris []string
+		for _, d := range actual {
+			uris = append(uris, d.URI)
+		}
+
+		expected := []string{"test-uri-1.0", "test-uri-2.0", "test-uri-3.0"}
+		if !reflect.DeepEqual(uris, expected) {
+			t.Errorf("Buildpack.Dependencies URIs = %s, expected %s", uris, expected)
+		}
+
+		if err := libjavabuildpack.WriteToFile(strings.NewReader(dependency("3.0", "test-sha256-other")),
+			filepath.Join(root, "dependencies", "c.toml"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		b.DependencyFiles = append(b.DependencyFiles, "dependencies/c.toml")
+
+		if _, err := b.Dependencies(); err == nil {
+			t.Errorf("Buildpack.Dependencies should return error for a conflicting duplicate")
+		}
+	})
+
+	it("selects the best dependency by arch and stack", func() {
+		d := libjavabuildpack.Dependencies{
+			{ID: "test-id", Version: newVersion(t, "1.0"), URI: "test-uri-amd64", Arch: "amd64",
+				Stacks: libjavabuildpack.Stacks{"test-stack"}},
+			{ID: "test-id", Version: newVersion(t, "1.0"), URI: "test-uri-arm64", Arch: "arm64",
+				Stacks: libjavabuildpack.Stacks{"test-stack"}},
+			{ID: "test-id", Version: newVersion(t, "2.0"), URI: "test-uri-arm64-other", Arch: "arm64",
+				Stacks: libjavabuildpack.Stacks{"test-stack-other"}},
+		}
+
+		actual, err := d.ForArch("arm64").Best("test-id", "", "test-stack")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.URI != "test-uri-arm64" {
+			t.Errorf("Dependencies.ForArch().Best() = %s, expected test-uri-arm64", actual)
+		}
+	})
+
+	it("derives package urls of dependencies", func() {
+		for _, c := range []struct {
+			dependency libjavabuildpack.Dependency
+			expected   string
+		}{
+			{
+				libjavabuildpack.Dependency{ID: "test-id", Version: newVersion(t, "1.0"),
+					URI: "https://test-host/maven2/org/test/test-artifact/1.0/test-artifact-1.0.jar"},
+				"pkg:maven/org.test/test-artifact@1.0",
+			},
+			{
+				libjavabuildpack.Dependency{ID: "test-id", Version: newVersion(t, "1.0"),
+					URI: "https://test-host/test-archive.tgz"},
+				"pkg:generic/test-id@1.0?download_url=https%3A%2F%2Ftest-host%2Ftest-archive.tgz",
+			},
+			{
+				libjavabuildpack.Dependency{ID: "test-id", Version: newVersion(t, "1.0"), URI: "test-uri"},
+				"",
+			},
+			{
+				libjavabuildpack.Dependency{ID: "test-id", Version: newVersion(t, "1.0"), URI: "test-uri",
+					PURL: "pkg:test/test-id@1.0"},
+				"pkg:test/test-id@1.0",
+			},
+		} {
+			if actual := c.dependency.PackageURL(); actual != c.expected {
+				t.Errorf("Dependency.PackageURL() = %s, expected %s", actual, c.expected)
+			}
+		}
+	})
+
+	it("serves resolved dependencies until refreshed", func() {
+		b := libbuildpack.Buildpack{
+			Metadata: libbuildpack.BuildpackMetadata{
+				"dependencies": []map[string]interface{}{
+					{
+						"id":       "test-id",
+						"name":     "test-name",
+						"version":  "1.0",
+						"uri":      "test-uri",
+						"sha256":   "test-sha256",
+						"stacks":   []interface{}{"test-stack"},
+						"licenses": []map[string]interface{}{{"type": "test-type"}},
+					},
+				},
+			},
+		}
+
+		resolved, err := libjavabuildpack.NewResolvedBuildpack(libjavabuildpack.Buildpack{Buildpack: b})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		delete(b.Metadata, "dependencies")
+
+		actual, err := resolved.Dependencies()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(actual) != 1 {
+			t.Errorf("ResolvedBuildpack.Dependencies = %s, expected 1 dependency", actual)
+		}
+
+		resolved, err = resolved.Refresh()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err = resolved.Dependencies()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(actual) != 0 {
+			t.Errorf("ResolvedBuildpack.Dependencies = %s, expected no dependencies", actual)
+		}
+	})
+
+	it("serves copies of the resolved dependencies", func() {
+		b := libbuildpack.Buildpack{
+			Metadata: libbuildpack.BuildpackMetadata{
+				"dependencies": []map[string]interface{}{
+					{
+						"id":       "test-id",
+						"name":     "test-name",
+						"version":  "1.0",
+						"uri":      "test-uri",
+						"sha256":   "test-sha256",
+						"stacks":   []interface{}{"test-stack"},
+						"licenses": []map[string]interface{}{{"type": "test-type"}},
+					},
+				},
+			},
+		}
+
+		resolved, err := libjavabuildpack.NewResolvedBuildpack(libjavabuildpack.Buildpack{Buildpack: b})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first, err := resolved.Dependencies()
+		if err != nil {
+			t.Fatal(err)
+		}
+		first[0].Stacks[0] = "test-stack-modified"
+		first[0].Licenses[0].Type = "test-type-modified"
+
+		second, err := resolved.Dependencies()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if second[0].Stacks[0] != "test-stack" || second[0].Licenses[0].Type != "test-type" {
+			t.Errorf("ResolvedBuildpack.Dependencies = %s, expected the resolved stacks and licenses", second)
+		}
+	})
+
 	it("returns include_files if it exists", func() {
 		b := libbuildpack.Buildpack{
 			Metadata: libbuildpack.BuildpackMetadata{
@@ -422,6 +876,45 @@ func testBuildpack(t *testing.T, when spec.G, it spec.S) {
 	})
 }
 
+func BenchmarkDependencies(b *testing.B) {
+	metadata := libbuildpack.BuildpackMetadata{"dependencies": []map[string]interface{}{}}
+	for i := 0; i < 100; i++ {
+		metadata["dependencies"] = append(metadata["dependencies"].([]map[string]interface{}), map[string]interface{}{
+			"id":       fmt.Sprintf("test-id-%d", i),
+			"name":     "test-name",
+			"version":  "1.0",
+			"uri":      "test-uri",
+			"sha256":   "test-sha256",
+			"stacks":   []interface{}{"test-stack"},
+			"licenses": []map[string]interface{}{{"type": "test-type"}},
+		})
+	}
+
+	buildpack := libjavabuildpack.Buildpack{Buildpack: libbuildpack.Buildpack{Metadata: metadata}}
+
+	b.Run("Buildpack", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := buildpack.Dependencies(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("ResolvedBuildpack", func(b *testing.B) {
+		resolved, err := libjavabuildpack.NewResolvedBuildpack(buildpack)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := resolved.Dependencies(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
 func newVersion(t *testing.T, version string) libjavabuildpack.Version {
 	t.Helper()
 
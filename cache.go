@@ -21,17 +21,29 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/buildpack/libbuildpack"
 	"github.com/cloudfoundry/libjavabuildpack/internal"
 	"github.com/fatih/color"
 )
 
+const (
+	lockPollInterval    = 100 * time.Millisecond
+	lockRefreshInterval = lockStaleAfter / 4
+	lockStaleAfter      = 10 * time.Minute
+	retryBackoff        = 250 * time.Millisecond
+	retryBackoffLimit   = 8 * time.Second
+)
+
 // Cache is an extension to libbuildpack.Cache that allows additional functionality to be added.
 type Cache struct {
 	libbuildpack.Cache
@@ -39,8 +51,128 @@ type Cache struct {
 	// BuildpackCacheRoot is the path to the root directory for the buildpack's dependency cache.
 	BuildpackCacheRoot string
 
+	// InsecureRegistries are the hosts of OCI registries that oci:// dependency URIs are pulled from over plain HTTP
+	// rather than HTTPS.
+	InsecureRegistries []string
+
 	// Logger is used to write debug and info to the console.
 	Logger Logger
+
+	// MaxDownloadBytesPerSecond, if positive, is a best-effort limit on the rate at which each download is read.
+	MaxDownloadBytesPerSecond int64
+
+	// MaxSize, if positive, is the maximum size in bytes of the download layers in the cache.  When a download takes
+	// the cache past it, the least recently used layers are evicted until it fits.
+	MaxSize int64
+
+	// Namespace, if set, segments the transient state of the cache, such as partially staged downloads, into a
+	// directory for a logical run so that concurrent runs sharing the cache root do not collide.  Download layers are
+	// content-addressed and remain shared by all namespaces.
+	Namespace string
+
+	// PinToDigest indicates whether a download cached by a previous build is reused based only on its sha256, so that
+	// a dependency whose version or URI changes but whose sha256 does not is not downloaded again.  Downloads packaged
+	// in the buildpack cache are always reused based only on their sha256.
+	PinToDigest bool
+
+	// Progress, if set, aggregates the progress of the downloads of all of the caches that share it into a periodic
+	// summary line, and the per-download lines are logged only to debug, so that parallel downloads do not interleave.
+	Progress *Progress
+
+	// ReadOnly indicates that the cache root is not written to.  Cached downloads are reused without being verified or
+	// having their access recorded, and a dependency that is not cached is an error rather than downloaded.
+	ReadOnly bool
+
+	// RecoverCorrupt indicates whether a download reused from a previous build is verified against its checksum and,
+	// if it does not match, downloaded again once.  A fresh download that does not match is always an error.
+	RecoverCorrupt bool
+
+	// RegistryAuthorization, if set, is sent as the Authorization header when pulling a blob from an OCI registry.
+	RegistryAuthorization string
+
+	// Retries is the number of times a download that fails with a network error or server error response is retried.
+	Retries int
+
+	// RetryBudget, if set, limits the total number of retries of all of the downloads that share it.
+	RetryBudget *RetryBudget
+
+	// RunStart, if set, is when the run using the cache started.  Download layers accessed since then are needed by the
+	// run and are never evicted.
+	RunStart time.Time
+
+	// TempDir is the directory that partial downloads are staged in before being moved into the cache.  It defaults to
+	// the namespace directory if Namespace is set, and the cache root otherwise.
+	TempDir string
+
+	// TrustCache indicates whether the checksum of a cached artifact is recorded in its layer when it is computed and
+	// trusted while the artifact's size and modification time are unchanged, rather than recomputed.  Corruption and
+	// tampering need not change either, so the checksum is always recomputed when recovering corrupt downloads and by
+	// Verify.  It should not be set when the cache may be written by untrusted parties.
+	TrustCache bool
+}
+
+// CorruptLayer is a download layer whose artifact does not match its stored metadata.
+type CorruptLayer struct {
+	// Root is the path to the root directory of the layer.
+	Root string
+
+	// Dependency is the dependency described by the layer's metadata.
+	Dependency Dependency
+
+	// ActualSHA256 is the sha256 of the artifact in the layer, or empty if the artifact is missing.
+	ActualSHA256 string
+}
+
+// String makes CorruptLayer satisfy the Stringer interface.
+func (c CorruptLayer) String() string {
+	return fmt.Sprintf("CorruptLayer{ Root: %s, Dependency: %s, ActualSHA256: %s }", c.Root, c.Dependency,
+		c.ActualSHA256)
+}
+
+// RemoteVerification is the result of verifying a dependency's artifact at its URI against its declared checksum.
+type RemoteVerification struct {
+	// Dependency is the dependency that was verified.
+	Dependency Dependency
+
+	// ActualSHA256 is the sha256 of the artifact at the dependency's URI, or empty if it could not be downloaded.
+	ActualSHA256 string
+
+	// Error is the error encountered while downloading the artifact, if any.
+	Error error
+}
+
+// Passed returns whether the artifact was downloaded and matched its declared checksum, or was downloaded and the
+// dependency skips checksum verification.
+func (r RemoteVerification) Passed() bool {
+	return r.Error == nil && (r.Dependency.SkipChecksum || r.ActualSHA256 == r.Dependency.SHA256)
+}
+
+// String makes RemoteVerification satisfy the Stringer interface.
+func (r RemoteVerification) String() string {
+	return fmt.Sprintf("RemoteVerification{ Dependency: %s, ActualSHA256: %s, Error: %v }",
+		r.Dependency, r.ActualSHA256, r.Error)
+}
+
+// DependencyCache defines the interface of the cache that a Packager acquires dependency artifacts from.  Cache
+// satisfies this interface, and tests can substitute an implementation that does not download artifacts.
+type DependencyCache interface {
+	// ArtifactLayer returns an ArtifactLayer unique to a dependency.
+	ArtifactLayer(dependency Dependency) ArtifactLayer
+}
+
+// ArtifactLayer defines the interface of a layer that caches the artifact of a dependency.
+type ArtifactLayer interface {
+	// Artifact returns the path to the artifact cached in the layer.
+	Artifact() (string, error)
+
+	// MetadataPath returns the path to the metadata file for the artifact cached in the layer.
+	MetadataPath() string
+}
+
+// ArtifactLayer returns the DownloadCacheLayer unique to a dependency, making Cache satisfy the DependencyCache
+// interface.
+func (c Cache) ArtifactLayer(dependency Dependency) ArtifactLayer {
+	return c.DownloadLayer(dependency)
 }
 
 // DependencyLayer returns a DependencyCacheLayer unique to a dependency.
@@ -53,20 +185,184 @@ func (c Cache) DependencyLayer(dependency Dependency) DependencyCacheLayer {
 	}
 }
 
-// DownloadLayer returns a DownloadCacheLayer unique to a dependency.
+// DownloadLayer returns a DownloadCacheLayer unique to a dependency.  The layer is keyed by the dependency's sha256, so
+// versions whose URIs share a filename are cached separately.
 func (c Cache) DownloadLayer(dependency Dependency) DownloadCacheLayer {
 	return DownloadCacheLayer{
 		c.Layer(dependency.SHA256),
 		c.Logger,
 		filepath.Join(c.BuildpackCacheRoot, dependency.SHA256),
 		dependency,
+		new(int64),
+		c.InsecureRegistries,
+		c.MaxDownloadBytesPerSecond,
+		c.MaxSize,
+		c.PinToDigest,
+		c.Progress,
+		c.ReadOnly,
+		c.RecoverCorrupt,
+		c.RegistryAuthorization,
+		c.Retries,
+		c.RetryBudget,
+		c.RunStart,
+		c.tempDir(),
+		c.TrustCache,
+	}
+}
+
+// Verify walks the download layers in the cache, recomputing the checksum of each cached artifact and returning the
+// layers whose artifact does not match the stored metadata.  The network is not used.
+func (c Cache) Verify() ([]CorruptLayer, error) {
+	layers, err := downloadLayers(c.Root)
+	if err != nil {
+		return nil, err
 	}
+
+	var corrupt []CorruptLayer
+
+	for _, l := range layers {
+		c.Logger.SubsequentLine("Verifying %s", l.root)
+
+		artifact := filepath.Join(l.root, filepath.Base(l.dependency.URI))
+
+		exists, err := FileExists(artifact)
+		if err != nil {
+			return nil, err
+		}
+
+		var actual string
+		if exists {
+			if actual, err = sha256File(artifact); err != nil {
+				return nil, err
+			}
+		}
+
+		if l.dependency.SkipChecksum && exists {
+			c.Logger.SubsequentLine("%s: not verifying sha256 of %s, as skip_checksum is set",
+				color.YellowString("Warning"), l.dependency.ID)
+			continue
+		}
+
+		if actual != l.dependency.SHA256 {
+			c.Logger.Debug("Download layer %s is corrupt: sha256 %s", l.root, actual)
+			corrupt = append(corrupt, CorruptLayer{Root: l.root, Dependency: l.dependency, ActualSHA256: actual})
+		}
+	}
+
+	return corrupt, nil
+}
+
+// VerifyRemote downloads the artifact of each dependency, streaming it through a hasher and discarding it, and reports
+// whether each matches its declared checksum.  Nothing is written to the cache.
+func (c Cache) VerifyRemote(dependencies Dependencies) []RemoteVerification {
+	var results []RemoteVerification
+
+	for _, dep := range dependencies {
+		c.Logger.FirstLine("Verifying %s", dep.URI)
+
+		actual, err := remoteSHA256(dep, c.InsecureRegistries, c.RegistryAuthorization)
+		r := RemoteVerification{Dependency: dep, ActualSHA256: actual, Error: err}
+
+		if r.Passed() && dep.SkipChecksum {
+			c.Logger.SubsequentLine("%s: not verifying sha256 of %s, as skip_checksum is set",
+				color.YellowString("Warning"), dep.ID)
+		} else if r.Passed() {
+			c.Logger.SubsequentLine("%s", color.GreenString("Passed"))
+		} else {
+			c.Logger.SubsequentLine("%s: expected sha256 %s, actual sha256 %s, error %v",
+				color.RedString("Failed"), dep.SHA256, actual, err)
+		}
+
+		results = append(results, r)
+	}
+
+	return results
+}
+
+func remoteSHA256(dependency Dependency, insecure []string, authorization string) (string, error) {
+	req, err := dependencyRequest(dependency, insecure, authorization)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("could not download: %d", resp.StatusCode)
+	}
+
+	s := sha256.New()
+	if _, err := io.Copy(s, resp.Body); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(s.Sum(nil)), nil
 }
 
 // String makes Cache satisfy the Stringer interface.
 func (c Cache) String() string {
-	return fmt.Sprintf("Cache{ Cache: %s, BuildpackCacheRoot: %s, Logger: %s}",
-		c.Cache, c.BuildpackCacheRoot, c.Logger)
+	return fmt.Sprintf("Cache{ Cache: %s, BuildpackCacheRoot: %s, Logger: %s, Namespace: %s, TempDir: %s }",
+		c.Cache, c.BuildpackCacheRoot, c.Logger, c.Namespace, c.TempDir)
+}
+
+func (c Cache) tempDir() string {
+	if c.TempDir != "" || c.Namespace == "" {
+		return c.TempDir
+	}
+
+	return filepath.Join(c.Root, "namespaces", c.Namespace)
+}
+
+type downloadLayer struct {
+	root       string
+	dependency Dependency
+	accessed   time.Time
+}
+
+// downloadLayers returns the download layers in a cache root.  Dependency layers, which are named for the dependency
+// id and hold contributed content rather than an artifact, are ignored.
+func downloadLayers(root string) ([]downloadLayer, error) {
+	dirs, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var layers []downloadLayer
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		r := filepath.Join(root, dir.Name())
+		f := filepath.Join(r, "dependency.toml")
+
+		stat, err := os.Stat(f)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var dep Dependency
+		if err := FromTomlFile(f, &dep); err != nil {
+			return nil, err
+		}
+
+		if dep.SHA256 != dir.Name() {
+			continue
+		}
+
+		layers = append(layers, downloadLayer{r, dep, stat.ModTime()})
+	}
+
+	return layers, nil
 }
 
 // DependencyCacheLayer is an extension to CacheLayer that is unique to a dependency contribution.
@@ -195,19 +491,55 @@ type DownloadCacheLayer struct {
 	buildpackLayerRoot string
 
 	dependency Dependency
+
+	// downloaded is the number of bytes of the artifact downloaded by the last call to Artifact, which is zero if a
+	// cached download was reused.  It is shared by copies of the layer.
+	downloaded *int64
+
+	insecureRegistries []string
+
+	maxDownloadBytesPerSecond int64
+
+	maxSize int64
+
+	pinToDigest bool
+
+	progress *Progress
+
+	readOnly bool
+
+	recoverCorrupt bool
+
+	registryAuthorization string
+
+	retries int
+
+	retryBudget *RetryBudget
+
+	runStart time.Time
+
+	tempDir string
+
+	trustCache bool
 }
 
 // Artifact returns the path to an artifact cached in the layer.  If the artifact has already been downloaded, the cache
 // will be validated and used directly.
 func (d DownloadCacheLayer) Artifact() (string, error) {
+	if d.downloaded != nil {
+		*d.downloaded = 0
+	}
+
 	m, err := d.readMetadata(d.buildpackLayerRoot)
 	if err != nil {
 		return "", err
 	}
 
-	if reflect.DeepEqual(d.dependency, m) {
+	// A buildpack layer is packaged with the buildpack and keyed by sha256, so it satisfies any dependency with that
+	// sha256, whichever version of the dependency its metadata was packaged for.
+	if m.SHA256 != "" && m.SHA256 == d.dependency.SHA256 {
 		d.Logger.SubsequentLine("%s cached download from buildpack", color.GreenString("Reusing"))
-		return filepath.Join(d.buildpackLayerRoot, filepath.Base(d.dependency.URI)), nil
+		return filepath.Join(d.buildpackLayerRoot, filepath.Base(m.URI)), nil
 	}
 
 	m, err = d.readMetadata(d.Root)
@@ -215,33 +547,41 @@ func (d DownloadCacheLayer) Artifact() (string, error) {
 		return "", err
 	}
 
-	a := filepath.Join(d.Root, filepath.Base(d.dependency.URI))
+	if d.matches(m) && d.readOnly {
+		d.Logger.SubsequentLine("%s cached download from read-only cache", color.GreenString("Reusing"))
+		return filepath.Join(d.Root, filepath.Base(m.URI)), nil
+	}
 
-	if reflect.DeepEqual(d.dependency, m) {
-		d.Logger.SubsequentLine("%s cached download from previous build", color.GreenString("Reusing"))
-		return a, nil
+	if d.readOnly {
+		return "", fmt.Errorf("dependency %s %s is not in read-only cache %s", d.dependency.ID,
+			d.dependency.Version.Original(), d.Root)
 	}
 
-	d.Logger.Debug("Download metadata %s does not match expected %s", m, d.dependency)
+	if d.matches(m) {
+		a := filepath.Join(d.Root, filepath.Base(m.URI))
 
-	d.Logger.SubsequentLine("%s from %s", color.YellowString("Downloading"), d.dependency.URI)
+		corrupt, err := d.corrupt(a)
+		if err != nil {
+			return "", err
+		}
 
-	err = d.download(a)
-	if err != nil {
-		return "", err
+		if !corrupt {
+			d.Logger.SubsequentLine("%s cached download from previous build", color.GreenString("Reusing"))
+			return a, d.touch()
+		}
 	}
 
-	d.Logger.SubsequentLine("Verifying checksum")
-	err = d.verify(a)
+	unlock, err := d.lock()
 	if err != nil {
 		return "", err
 	}
 
-	if err := d.writeMetadata(d.Root); err != nil {
-		return "", err
+	a, err := d.acquire()
+	if e := unlock(); e != nil && err == nil {
+		return "", e
 	}
 
-	return a, nil
+	return a, err
 }
 
 // Metadata returns the path to the metadata file for an artifact cached in the later.
@@ -249,24 +589,409 @@ func (d DownloadCacheLayer) Metadata(root string) string {
 	return filepath.Join(root, "dependency.toml")
 }
 
+// Downloaded returns the number of bytes of the artifact downloaded by the last call to Artifact, which is zero if a
+// cached download was reused.
+func (d DownloadCacheLayer) Downloaded() int64 {
+	if d.downloaded == nil {
+		return 0
+	}
+
+	return *d.downloaded
+}
+
+// MetadataPath returns the path to the metadata file for an artifact cached in the layer, making DownloadCacheLayer
+// satisfy the ArtifactLayer interface.
+func (d DownloadCacheLayer) MetadataPath() string {
+	return d.Metadata(d.Root)
+}
+
 // String makes DownloadCacheLayer satisfy the Stringer interface.
 func (d DownloadCacheLayer) String() string {
-	return fmt.Sprintf("DownloadCacheLayer{ CacheLayer: %s, Logger: %s, buildpackLayerRoot: %s, dependency: %s }",
-		d.CacheLayer, d.Logger, d.buildpackLayerRoot, d.dependency)
+	return fmt.Sprintf("DownloadCacheLayer{ CacheLayer: %s, Logger: %s, buildpackLayerRoot: %s, dependency: %s, "+
+		"tempDir: %s }", d.CacheLayer, d.Logger, d.buildpackLayerRoot, d.dependency, d.tempDir)
+}
+
+// acquire downloads the artifact into the layer while the layer is locked, unless a concurrent download has already
+// done so or only its metadata is missing.
+func (d DownloadCacheLayer) acquire() (string, error) {
+	m, err := d.readMetadata(d.Root)
+	if err != nil {
+		return "", err
+	}
+
+	if d.matches(m) {
+		d.Logger.SubsequentLine("%s cached download from concurrent download", color.GreenString("Reusing"))
+		return filepath.Join(d.Root, filepath.Base(m.URI)), d.touch()
+	}
+
+	a := filepath.Join(d.Root, filepath.Base(d.dependency.URI))
+
+	recovered, err := d.recoverMetadata(a)
+	if err != nil {
+		return "", err
+	}
+
+	if recovered {
+		return a, d.touch()
+	}
+
+	d.Logger.Debug("Download metadata %s does not match expected %s", m, d.dependency)
+
+	if d.progress != nil {
+		d.Logger.Debug("Downloading from %s", d.dependency.URI)
+	} else {
+		d.Logger.SubsequentLine("%s from %s", color.YellowString("Downloading"), d.dependency.URI)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = d.download(a)
+		if _, ok := err.(retryableError); !ok || attempt > d.retries {
+			break
+		}
+
+		if !d.retryBudget.take() {
+			return "", fmt.Errorf("retry budget exhausted, not retrying download of %s: %s", d.dependency.URI, err)
+		}
+
+		delay := retryDelay(attempt)
+		d.Logger.SubsequentLine("%s download in %s after %s", color.YellowString("Retrying"), delay, err)
+		time.Sleep(delay)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if d.progress != nil {
+		d.Logger.Debug("Verifying checksum")
+	} else {
+		d.Logger.SubsequentLine("Verifying checksum")
+	}
+
+	err = d.verify(a, d.trustCache)
+	if err != nil {
+		return "", err
+	}
+
+	if err := d.writeMetadata(d.Root); err != nil {
+		return "", err
+	}
+
+	return a, d.evict()
+}
+
+// corrupt returns whether a reused artifact does not match its checksum, if recovery is enabled.  The metadata of a
+// corrupt artifact is removed so that it is downloaded again.
+func (d DownloadCacheLayer) corrupt(artifact string) (bool, error) {
+	if !d.recoverCorrupt {
+		return false, nil
+	}
+
+	err := d.verify(artifact, false)
+	if err == nil {
+		return false, nil
+	}
+
+	d.Logger.SubsequentLine("%s corrupt cached download: %s", color.YellowString("Recovering"), err)
+
+	// The validators are removed too, so that the artifact is not considered unmodified by a conditional request, and
+	// the recorded checksum, so that the artifact is not trusted when its metadata is recovered.
+	if err := os.RemoveAll(d.validatorsPath()); err != nil {
+		return false, err
+	}
+
+	if err := os.RemoveAll(trustPath(d.Root)); err != nil {
+		return false, err
+	}
+
+	return true, os.Remove(d.Metadata(d.Root))
 }
 
 func (d DownloadCacheLayer) download(file string) error {
-	resp, err := http.Get(d.dependency.URI)
+	req, err := dependencyRequest(d.dependency, d.insecureRegistries, d.registryAuthorization)
 	if err != nil {
 		return err
 	}
+
+	v, err := d.readValidators(file)
+	if err != nil {
+		return err
+	}
+
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		d.Logger.SubsequentLine("%s cached download not modified", color.GreenString("Reusing"))
+		return nil
+	}
+
+	if resp.StatusCode >= 500 {
+		return retryableError{fmt.Errorf("could not download: %d", resp.StatusCode)}
+	}
+
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("could not download: %bd", resp.StatusCode)
+		return fmt.Errorf("could not download: %d", resp.StatusCode)
+	}
+
+	if d.dependency.Size > 0 && resp.ContentLength >= 0 && resp.ContentLength != d.dependency.Size {
+		return d.sizeMismatch(resp.ContentLength)
+	}
+
+	staging, err := stagingFile(d.tempDir, filepath.Dir(d.Root), "download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staging.Name())
+
+	d.Logger.Debug("Staging download in %s", staging.Name())
+
+	var body io.Reader = resp.Body
+	if d.maxDownloadBytesPerSecond > 0 {
+		body = &throttledReader{reader: body, rate: d.maxDownloadBytesPerSecond, start: time.Now()}
+	}
+
+	size := resp.ContentLength
+	if size < 0 {
+		size = d.dependency.Size
+	}
+
+	body, done := d.progress.track(body, size)
+	defer done()
+
+	n, err := io.Copy(staging, body)
+	staging.Close()
+	if err != nil {
+		return retryableError{err}
+	}
+
+	if d.dependency.Size > 0 && n != d.dependency.Size {
+		return d.sizeMismatch(n)
+	}
+
+	if err := os.Chmod(staging.Name(), 0644); err != nil {
+		return err
+	}
+
+	if d.downloaded != nil {
+		*d.downloaded = n
+	}
+
+	if err := moveFile(staging.Name(), file); err != nil {
+		return err
+	}
+
+	return d.writeValidators(resp)
+}
+
+// dependencyRequest returns the request for the artifact of a dependency.  A URI of the form
+// oci://<registry>/<repository>@<digest> is requested as the blob with that digest from the registry, and the digest
+// must match the dependency's sha256.  Environment variables in the URI, in the form $VAR or ${VAR}, are expanded.
+func dependencyRequest(dependency Dependency, insecure []string, authorization string) (*http.Request, error) {
+	uri := os.ExpandEnv(dependency.URI)
+
+	if !strings.HasPrefix(uri, "oci://") {
+		return http.NewRequest("GET", uri, nil)
+	}
+
+	reference := strings.TrimPrefix(uri, "oci://")
+
+	i := strings.LastIndex(reference, "@")
+	j := strings.Index(reference, "/")
+	if i < 0 || j < 0 || j > i {
+		return nil, fmt.Errorf("oci reference %s must be of the form oci://<registry>/<repository>@<digest>",
+			dependency.URI)
+	}
+
+	registry, repository, digest := reference[:j], reference[j+1:i], reference[i+1:]
+
+	if digest != "sha256:"+dependency.SHA256 {
+		return nil, fmt.Errorf("oci reference %s does not match sha256 %s", dependency.URI, dependency.SHA256)
+	}
+
+	scheme := "https"
+	for _, r := range insecure {
+		if r == registry {
+			scheme = "http"
+		}
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/v2/%s/blobs/%s", scheme, registry, repository, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	return req, nil
+}
+
+// validators are the HTTP cache validators of a downloaded artifact, used to make conditional requests when the
+// download metadata no longer matches but the artifact may be unchanged.
+type validators struct {
+	ETag         string `toml:"etag"`
+	LastModified string `toml:"last_modified"`
+}
+
+func (d DownloadCacheLayer) validatorsPath() string {
+	return filepath.Join(d.Root, "validators.toml")
+}
+
+// readValidators returns the validators of a previously downloaded artifact.  Validators are ignored if the artifact
+// itself no longer exists.
+func (d DownloadCacheLayer) readValidators(file string) (validators, error) {
+	f := d.validatorsPath()
+
+	for _, path := range []string{file, f} {
+		exists, err := FileExists(path)
+		if err != nil || !exists {
+			return validators{}, err
+		}
+	}
+
+	var v validators
+
+	if err := FromTomlFile(f, &v); err != nil {
+		d.Logger.Debug("Download validators %s are not structured correctly", f)
+		return validators{}, nil
 	}
 
-	return WriteToFile(resp.Body, file, 0644)
+	d.Logger.Debug("Reading download validators: %s => %s", f, v)
+	return v, nil
+}
+
+func (d DownloadCacheLayer) writeValidators(resp *http.Response) error {
+	f := d.validatorsPath()
+	v := validators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+
+	if v.ETag == "" && v.LastModified == "" {
+		return os.RemoveAll(f)
+	}
+
+	d.Logger.Debug("Writing download validators: %s <= %s", f, v)
+
+	toml, err := internal.ToTomlString(v)
+	if err != nil {
+		return err
+	}
+
+	return WriteToFile(strings.NewReader(toml), f, 0644)
+}
+
+// evict removes the least recently used download layers until the cache is no larger than maxSize.  The layer itself,
+// and layers accessed since runStart, are never removed.
+func (d DownloadCacheLayer) evict() error {
+	if d.maxSize <= 0 {
+		return nil
+	}
+
+	layers, err := downloadLayers(filepath.Dir(d.Root))
+	if err != nil {
+		return err
+	}
+
+	sizes := make(map[string]int64, len(layers))
+	var total int64
+	for _, l := range layers {
+		size, err := directorySize(l.root)
+		if err != nil {
+			return err
+		}
+
+		sizes[l.root] = size
+		total += size
+	}
+
+	sort.Slice(layers, func(i, j int) bool {
+		return layers[i].accessed.Before(layers[j].accessed)
+	})
+
+	var reclaimed int64
+	for _, l := range layers {
+		if total <= d.maxSize {
+			break
+		}
+
+		if l.root == d.Root || (!d.runStart.IsZero() && !l.accessed.Before(d.runStart)) {
+			continue
+		}
+
+		d.Logger.SubsequentLine("%s %s, reclaiming %d bytes", color.YellowString("Evicting"), l.root, sizes[l.root])
+		if err := os.RemoveAll(l.root); err != nil {
+			return err
+		}
+
+		total -= sizes[l.root]
+		reclaimed += sizes[l.root]
+	}
+
+	if reclaimed > 0 {
+		d.Logger.SubsequentLine("Reclaimed %d bytes", reclaimed)
+	}
+
+	if total > d.maxSize {
+		d.Logger.Debug("Cache size %d still exceeds maximum size %d", total, d.maxSize)
+	}
+
+	return nil
+}
+
+// lock acquires an exclusive lock on the layer, shared between processes, so that only one download of an artifact
+// happens at a time, and returns the function that releases it.  Locks not refreshed for lockStaleAfter are assumed to
+// have been abandoned and are broken, so a held lock is refreshed every lockRefreshInterval until it is released.
+func (d DownloadCacheLayer) lock() (func() error, error) {
+	f := d.Root + ".lock"
+
+	if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+		return nil, err
+	}
+
+	for waiting := false; ; waiting = true {
+		lock, err := os.OpenFile(f, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			lock.Close()
+			return d.refreshLock(f), nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if stat, err := os.Stat(f); err == nil && time.Since(stat.ModTime()) > lockStaleAfter {
+			d.Logger.Debug("Breaking stale download lock %s", f)
+			if err := breakLock(f, stat); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !waiting {
+			d.Logger.SubsequentLine("Waiting for concurrent download")
+		}
+
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// matches returns whether the metadata of a cached download matches the dependency.  If pinToDigest is set, only the
+// sha256 is compared.
+func (d DownloadCacheLayer) matches(m Dependency) bool {
+	if d.pinToDigest {
+		return m.SHA256 != "" && m.SHA256 == d.dependency.SHA256
+	}
+
+	return reflect.DeepEqual(d.dependency, m)
 }
 
 func (d DownloadCacheLayer) readMetadata(root string) (Dependency, error) {
@@ -289,22 +1014,78 @@ func (d DownloadCacheLayer) readMetadata(root string) (Dependency, error) {
 	return dep, nil
 }
 
-func (d DownloadCacheLayer) verify(file string) error {
-	s := sha256.New()
+// recoverMetadata regenerates missing metadata from the dependency if the artifact is present and matches its checksum,
+// so that a partially populated layer is not downloaded again.
+func (d DownloadCacheLayer) recoverMetadata(artifact string) (bool, error) {
+	exists, err := FileExists(d.Metadata(d.Root))
+	if err != nil || exists {
+		return false, err
+	}
 
-	f, err := os.Open(file)
-	if err != nil {
-		return err
+	if exists, err = FileExists(artifact); err != nil || !exists {
+		return false, err
+	}
+
+	if err := d.verify(artifact, d.trustCache); err != nil {
+		d.Logger.Debug("Not regenerating download metadata: %s", err)
+		return false, nil
 	}
-	defer f.Close()
 
-	_, err = io.Copy(s, f)
+	d.Logger.SubsequentLine("%s missing download metadata", color.GreenString("Regenerating"))
+	return true, d.writeMetadata(d.Root)
+}
+
+// refreshLock updates the modification time of a held lock every lockRefreshInterval, so that a long download is not
+// taken to have abandoned it, and returns the function that stops refreshing and releases the lock.
+func (d DownloadCacheLayer) refreshLock(f string) func() error {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(lockRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if err := os.Chtimes(f, now, now); err != nil {
+					d.Logger.Debug("Unable to refresh download lock %s: %s", f, err)
+				}
+			}
+		}
+	}()
+
+	return func() error {
+		close(done)
+		return os.Remove(f)
+	}
+}
+
+func (d DownloadCacheLayer) sizeMismatch(actual int64) error {
+	return fmt.Errorf("dependency size mismatch: expected size %d, actual size %d", d.dependency.Size, actual)
+}
+
+// touch records an access of the layer, in the modification time of its metadata, for least recently used eviction.
+func (d DownloadCacheLayer) touch() error {
+	now := time.Now()
+	return os.Chtimes(d.Metadata(d.Root), now, now)
+}
+
+// verify returns an error if an artifact does not match the checksum of the dependency, trusting the checksum recorded
+// in the layer if trusted is set.
+func (d DownloadCacheLayer) verify(file string, trusted bool) error {
+	if d.dependency.SkipChecksum {
+		d.Logger.SubsequentLine("%s: not verifying sha256 of %s, as skip_checksum is set",
+			color.YellowString("Warning"), d.dependency.ID)
+		return nil
+	}
+
+	actualSha256, err := trustedSHA256(file, d.Root, trusted, d.Logger)
 	if err != nil {
 		return err
 	}
 
-	actualSha256 := hex.EncodeToString(s.Sum(nil))
-
 	if actualSha256 != d.dependency.SHA256 {
 		return fmt.Errorf("dependency sha256 mismatch: expected sha256 %s, actual sha256 %s",
 			d.dependency.SHA256, actualSha256)
@@ -323,3 +1104,289 @@ func (d DownloadCacheLayer) writeMetadata(root string) error {
 
 	return WriteToFile(strings.NewReader(toml), f, 0644)
 }
+
+// breakLock breaks a stale lock by renaming it aside, so that of the waiters that found it stale only one moves it.  If
+// what was moved is no longer the stale lock, another waiter broke it and created a new lock in the meantime, and that
+// lock is put back unless yet another has since been created.
+func breakLock(f string, stale os.FileInfo) error {
+	broken := fmt.Sprintf("%s.%d.%d.broken", f, os.Getpid(), time.Now().UnixNano())
+
+	if err := os.Rename(f, broken); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	moved, err := os.Stat(broken)
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(stale, moved) || !moved.ModTime().Equal(stale.ModTime()) {
+		if err := os.Link(broken, f); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	return os.Remove(broken)
+}
+
+// trust is the checksum of an artifact recorded in its layer, trusted while the artifact's size and modification time
+// are unchanged.
+type trust struct {
+	Size    int64  `toml:"size"`
+	ModTime int64  `toml:"mod_time"`
+	SHA256  string `toml:"sha256"`
+}
+
+// trustPath returns the path to the checksum of the artifact recorded in a layer.
+func trustPath(root string) string {
+	return filepath.Join(root, "trust.toml")
+}
+
+// trustedSHA256 returns the sha256 of an artifact in a layer.  If trusted is set, the checksum recorded in the layer is
+// reused if the artifact is unchanged, and is recorded otherwise.
+func trustedSHA256(artifact string, root string, trusted bool, logger Logger) (string, error) {
+	if !trusted {
+		return sha256File(artifact)
+	}
+
+	stat, err := os.Stat(artifact)
+	if err != nil {
+		return "", err
+	}
+
+	f := trustPath(root)
+
+	exists, err := FileExists(f)
+	if err != nil {
+		return "", err
+	}
+
+	var t trust
+	if exists {
+		if err := FromTomlFile(f, &t); err != nil {
+			logger.Debug("Trust %s is not structured correctly", f)
+		}
+	}
+
+	if t.SHA256 != "" && t.Size == stat.Size() && t.ModTime == stat.ModTime().UnixNano() {
+		logger.Debug("Trusting sha256 %s of unchanged %s", t.SHA256, artifact)
+		return t.SHA256, nil
+	}
+
+	sha256, err := sha256File(artifact)
+	if err != nil {
+		return "", err
+	}
+
+	toml, err := internal.ToTomlString(trust{Size: stat.Size(), ModTime: stat.ModTime().UnixNano(), SHA256: sha256})
+	if err != nil {
+		return "", err
+	}
+
+	return sha256, WriteToFile(strings.NewReader(toml), f, 0644)
+}
+
+// Progress aggregates the progress of in-flight downloads into a single summary line, logged once per interval while
+// any download is in flight and once more when the last of them finishes.  The bytes of downloads that have finished
+// count toward the summary until then.  It is safe for concurrent use.
+type Progress struct {
+	interval time.Duration
+	logger   Logger
+
+	mutex     sync.Mutex
+	completed int
+	downloads int
+	read      int64
+	stop      chan struct{}
+	total     int64
+}
+
+// NewProgress creates a new Progress that logs a summary to a logger once per interval, or only when the downloads
+// finish if the interval is not positive.
+func NewProgress(logger Logger, interval time.Duration) *Progress {
+	return &Progress{interval: interval, logger: logger}
+}
+
+// track returns a reader that records the progress of a download of size bytes, or zero if unknown, and a function to
+// call once the download has finished.  A nil Progress tracks nothing.
+func (p *Progress) track(reader io.Reader, size int64) (io.Reader, func()) {
+	if p == nil {
+		return reader, func() {}
+	}
+
+	if size < 0 {
+		size = 0
+	}
+
+	p.mutex.Lock()
+	if p.downloads == 0 && p.interval > 0 {
+		p.stop = make(chan struct{})
+		go p.report(p.stop)
+	}
+	p.downloads++
+	p.total += size
+	p.mutex.Unlock()
+
+	return &progressReader{progress: p, reader: reader}, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		p.downloads--
+		p.completed++
+		if p.downloads > 0 {
+			return
+		}
+
+		if p.stop != nil {
+			close(p.stop)
+			p.stop = nil
+		}
+
+		p.logger.SubsequentLine("%s %d %s: %.1f MB", color.GreenString("Downloaded"), p.completed,
+			dependencyNoun(p.completed), float64(p.read)/1e6)
+		p.completed, p.read, p.total = 0, 0, 0
+	}
+}
+
+func (p *Progress) add(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.read += int64(n)
+}
+
+// report logs a summary once per interval until stop is closed.
+func (p *Progress) report(stop chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mutex.Lock()
+		if p.stop == stop {
+			p.summary()
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// summary logs the progress of the downloads.  The mutex must be held.
+func (p *Progress) summary() {
+	if p.total <= 0 {
+		p.logger.SubsequentLine("%s %d %s: %.1f MB", color.YellowString("Downloading"), p.downloads,
+			dependencyNoun(p.downloads), float64(p.read)/1e6)
+		return
+	}
+
+	// Downloads of unknown size count toward the bytes read but not the total.
+	percent := p.read * 100 / p.total
+	if percent > 100 {
+		percent = 100
+	}
+
+	p.logger.SubsequentLine("%s %d %s: %d%% (%.1f/%.1f MB)", color.YellowString("Downloading"), p.downloads,
+		dependencyNoun(p.downloads), percent, float64(p.read)/1e6, float64(p.total)/1e6)
+}
+
+// dependencyNoun returns the noun for a number of dependencies.
+func dependencyNoun(n int) string {
+	if n == 1 {
+		return "dependency"
+	}
+
+	return "dependencies"
+}
+
+// progressReader records the bytes read from an underlying reader in a Progress.
+type progressReader struct {
+	progress *Progress
+	reader   io.Reader
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	if n > 0 {
+		p.progress.add(n)
+	}
+	return n, err
+}
+
+// RetryBudget is a number of download retries shared by all of the caches that use it.  It is safe for concurrent use.
+type RetryBudget struct {
+	mutex     sync.Mutex
+	remaining int
+}
+
+// NewRetryBudget creates a new RetryBudget of a number of retries.
+func NewRetryBudget(retries int) *RetryBudget {
+	return &RetryBudget{remaining: retries}
+}
+
+// take consumes a retry, returning false if the budget is exhausted.  A nil budget is unlimited.
+func (r *RetryBudget) take() bool {
+	if r == nil {
+		return true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.remaining <= 0 {
+		return false
+	}
+
+	r.remaining--
+	return true
+}
+
+// retryableError is a download error, such as a network error or server error response, that may succeed if retried.
+type retryableError struct {
+	error
+}
+
+// retryDelay returns how long to wait before retrying a download after a failed attempt, doubling from retryBackoff
+// with each attempt up to retryBackoffLimit.
+func retryDelay(attempt int) time.Duration {
+	delay := retryBackoff
+	for i := 1; i < attempt && delay < retryBackoffLimit; i++ {
+		delay *= 2
+	}
+
+	if delay > retryBackoffLimit {
+		return retryBackoffLimit
+	}
+
+	return delay
+}
+
+// throttledReader limits the average rate at which an underlying reader is read.
+type throttledReader struct {
+	reader io.Reader
+	rate   int64
+	start  time.Time
+	read   int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+
+	n, err := t.reader.Read(p)
+	t.read += int64(n)
+
+	due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	return n, err
+}
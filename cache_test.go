@@ -17,9 +17,19 @@
 package libjavabuildpack_test
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Masterminds/semver"
 	"github.com/buildpack/libbuildpack"
@@ -220,6 +230,984 @@ sha256 = "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273"
 `)
 		})
 
+		it("expands environment variables in the uri only when downloading", func() {
+			defer test.ReplaceEnv(t, "TEST_MIRROR", "test.com")()
+
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				URI:     "http://${TEST_MIRROR}/test-path",
+			}
+
+			defer gock.Off()
+
+			gock.New("http://test.com").
+				Get("/test-path").
+				Reply(200).
+				BodyString("test-payload")
+
+			if _, err := cache.DownloadLayer(dependency).Artifact(); err != nil {
+				t.Fatal(err)
+			}
+
+			internal.BeFileLike(t, filepath.Join(root, dependency.SHA256, "dependency.toml"), 0644, `id = ""
+name = ""
+version = "1.0"
+uri = "http://${TEST_MIRROR}/test-path"
+sha256 = "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273"
+`)
+		})
+
+		it("downloads once when raced", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				URI:     "http://test.com/test-path",
+			}
+
+			defer gock.Off()
+
+			gock.New("http://test.com").
+				Get("/test-path").
+				Reply(200).
+				BodyString("test-payload")
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 2)
+
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := cache.DownloadLayer(dependency).Artifact()
+					errs <- err
+				}()
+			}
+
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			internal.BeFileLike(t, filepath.Join(root, dependency.SHA256, "test-path"), 0644, "test-payload")
+		})
+
+		it("returns error if the download lock is lost while downloading", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+			}
+
+			lock := filepath.Join(root, dependency.SHA256+".lock")
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := os.Remove(lock); err != nil {
+					t.Error(err)
+				}
+				fmt.Fprint(w, "test-payload")
+			}))
+			defer server.Close()
+
+			dependency.URI = server.URL + "/test-path"
+
+			_, err = cache.DownloadLayer(dependency).Artifact()
+			if err == nil || !os.IsNotExist(err) {
+				t.Errorf("DownloadCacheLayer.Artifact() = %v, expected lock %s to no longer exist", err, lock)
+			}
+		})
+
+		it("breaks a stale download lock", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+			}
+
+			lock := filepath.Join(root, dependency.SHA256+".lock")
+			writeFile(t, lock, "", 0644)
+
+			stale := time.Now().Add(-time.Hour)
+			if err := os.Chtimes(lock, stale, stale); err != nil {
+				t.Fatal(err)
+			}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "test-payload")
+			}))
+			defer server.Close()
+
+			dependency.URI = server.URL + "/test-path"
+
+			if _, err := cache.DownloadLayer(dependency).Artifact(); err != nil {
+				t.Fatal(err)
+			}
+
+			internal.BeFileLike(t, filepath.Join(root, dependency.SHA256, "test-path"), 0644, "test-payload")
+
+			if matches, err := filepath.Glob(lock + "*"); err != nil {
+				t.Fatal(err)
+			} else if len(matches) != 0 {
+				t.Errorf("lock files = %s, expected none after download", matches)
+			}
+		})
+
+		it("reuses download when conditional request is not modified", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				URI:     "http://test.com/test-path",
+			}
+
+			defer gock.Off()
+
+			gock.New("http://test.com").
+				Get("/test-path").
+				Reply(200).
+				SetHeader("ETag", `"test-etag"`).
+				BodyString("test-payload")
+
+			if _, err := cache.DownloadLayer(dependency).Artifact(); err != nil {
+				t.Fatal(err)
+			}
+
+			gock.New("http://test.com").
+				Get("/test-path").
+				MatchHeader("If-None-Match", `"test-etag"`).
+				Reply(304)
+
+			dependency.Name = "test-name"
+
+			a, err := cache.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !gock.IsDone() {
+				t.Errorf("Expected conditional request to be made")
+			}
+
+			internal.BeFileLike(t, a, 0644, "test-payload")
+		})
+
+		it("downloads a dependency blob from an OCI registry", func() {
+			root := test.ScratchDir(t, "cache")
+
+			sha256 := "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273"
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v2/test-org/test-repository/blobs/sha256:"+sha256 {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				if r.Header.Get("Authorization") != "Bearer test-token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				fmt.Fprint(w, "test-payload")
+			}))
+			defer server.Close()
+
+			registry := strings.TrimPrefix(server.URL, "http://")
+			cache := libjavabuildpack.Cache{
+				Cache:                 libbuildpack.Cache{Root: root},
+				InsecureRegistries:    []string{registry},
+				RegistryAuthorization: "Bearer test-token",
+			}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  sha256,
+				URI:     fmt.Sprintf("oci://%s/test-org/test-repository@sha256:%s", registry, sha256),
+			}
+
+			a, err := cache.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			internal.BeFileLike(t, a, 0644, "test-payload")
+
+			dependency.URI = fmt.Sprintf("oci://%s/test-org/test-repository@sha256:%s", registry,
+				strings.Repeat("0", 64))
+			dependency.SHA256 = "test-sha256"
+
+			if _, err := cache.DownloadLayer(dependency).Artifact(); err == nil {
+				t.Errorf("DownloadCacheLayer.Artifact() = nil, expected error for digest not matching sha256")
+			}
+		})
+
+		it("aggregates the progress of parallel downloads into a summary line", func() {
+			root := test.ScratchDir(t, "cache")
+
+			var info bytes.Buffer
+			logger := libjavabuildpack.Logger{Logger: libbuildpack.NewLogger(nil, &info)}
+			cache := libjavabuildpack.Cache{
+				Cache:    libbuildpack.Cache{Root: root},
+				Logger:   logger,
+				Progress: libjavabuildpack.NewProgress(logger, 10*time.Millisecond),
+			}
+
+			var arrived sync.WaitGroup
+			arrived.Add(2)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				arrived.Done()
+				arrived.Wait()
+
+				fmt.Fprint(w, "test-")
+				w.(http.Flusher).Flush()
+				time.Sleep(100 * time.Millisecond)
+				fmt.Fprint(w, "payload")
+			}))
+			defer server.Close()
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			errs := make(chan error, 2)
+			for _, p := range []string{"/test-path-1", "/test-path-2"} {
+				dependency := libjavabuildpack.Dependency{
+					ID:      "test-id" + p,
+					Version: libjavabuildpack.Version{Version: v},
+					SHA256:  strings.Repeat("0", 63) + p[len(p)-1:],
+					Size:    int64(len("test-payload")),
+					URI:     server.URL + p,
+				}
+
+				go func() {
+					_, err := cache.DownloadLayer(dependency).Artifact()
+					errs <- err
+				}()
+			}
+
+			for i := 0; i < 2; i++ {
+				if err := <-errs; err == nil || !strings.HasPrefix(err.Error(), "dependency sha256 mismatch") {
+					t.Fatalf("DownloadCacheLayer.Artifact() = %v, expected dependency sha256 mismatch", err)
+				}
+			}
+
+			var lines []string
+			for _, line := range strings.Split(info.String(), "\n") {
+				if strings.Contains(line, "Download") {
+					lines = append(lines, line)
+				}
+			}
+
+			if len(lines) < 2 || !strings.Contains(lines[0], "Downloading") ||
+				!strings.Contains(lines[len(lines)-1], "Downloaded") {
+				t.Fatalf("download lines = %q, expected periodic summary lines and a final summary line", lines)
+			}
+
+			previous := -1
+			for _, line := range lines[:len(lines)-1] {
+				m := regexp.MustCompile(`Downloading\S* \d dependenc\S*: (\d+)%`).FindStringSubmatch(line)
+				if m == nil {
+					t.Fatalf("download line = %q, expected a summary line", line)
+				}
+
+				percent, err := strconv.Atoi(m[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if percent < previous {
+					t.Errorf("download lines = %q, expected percentage not to decrease", lines)
+				}
+				previous = percent
+			}
+
+			if !regexp.MustCompile(`Downloaded\S* 2 dependencies: 0\.0 MB`).MatchString(lines[len(lines)-1]) {
+				t.Errorf("final download line = %q, expected summary of 2 dependencies", lines[len(lines)-1])
+			}
+		})
+
+		it("stages download in temp dir", func() {
+			root := test.ScratchDir(t, "cache")
+			tempDir := filepath.Join(root, "temp")
+			cache := libjavabuildpack.Cache{
+				Cache:   libbuildpack.Cache{Root: filepath.Join(root, "cache")},
+				TempDir: tempDir,
+			}
+
+			staging := make(chan []os.FileInfo, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+
+				var staged []os.FileInfo
+				for i := 0; i < 100 && len(staged) == 0; i++ {
+					staged, _ = ioutil.ReadDir(tempDir)
+					time.Sleep(10 * time.Millisecond)
+				}
+				staging <- staged
+
+				fmt.Fprint(w, "test-payload")
+			}))
+			defer server.Close()
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				URI:     server.URL + "/test-path",
+			}
+
+			a, err := cache.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			staged := <-staging
+			if len(staged) != 1 || !strings.HasPrefix(staged[0].Name(), "download-") {
+				t.Errorf("staged files = %v, expected a single download staging file in %s", staged, tempDir)
+			}
+
+			internal.BeFileLike(t, a, 0644, "test-payload")
+		})
+
+		it("isolates staged downloads by namespace", func() {
+			root := test.ScratchDir(t, "cache")
+			a := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}, Namespace: "branch-a"}
+			b := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}, Namespace: "branch-b"}
+
+			staging := make(chan [][]os.FileInfo, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+
+				var stagedA, stagedB []os.FileInfo
+				for i := 0; i < 100 && len(stagedA) == 0; i++ {
+					stagedA, _ = ioutil.ReadDir(filepath.Join(root, "namespaces", "branch-a"))
+					time.Sleep(10 * time.Millisecond)
+				}
+				stagedB, _ = ioutil.ReadDir(filepath.Join(root, "namespaces", "branch-b"))
+				staging <- [][]os.FileInfo{stagedA, stagedB}
+
+				fmt.Fprint(w, "test-payload")
+			}))
+			defer server.Close()
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				URI:     server.URL + "/test-path",
+			}
+
+			artifactA, err := a.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			staged := <-staging
+			if len(staged[0]) != 1 || !strings.HasPrefix(staged[0][0].Name(), "download-") {
+				t.Errorf("staged files = %v, expected a single download staging file in branch-a", staged[0])
+			}
+			if len(staged[1]) != 0 {
+				t.Errorf("staged files = %v, expected no staging files in branch-b", staged[1])
+			}
+
+			artifactB, err := b.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if artifactA != artifactB {
+				t.Errorf("Artifact() = %s, expected shared artifact %s", artifactB, artifactA)
+			}
+		})
+
+		it("reports corrupt download layers", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				URI:     "http://test.com/test-path",
+			}
+
+			defer gock.Off()
+
+			gock.New("http://test.com").
+				Get("/test-path").
+				Reply(200).
+				BodyString("test-payload")
+
+			a, err := cache.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			corrupt, err := cache.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(corrupt) != 0 {
+				t.Errorf("Cache.Verify() = %s, expected no corrupt layers", corrupt)
+			}
+
+			if err := libjavabuildpack.WriteToFile(strings.NewReader("corrupt-payload"), a, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			corrupt, err = cache.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := filepath.Join(root, dependency.SHA256)
+			if len(corrupt) != 1 || corrupt[0].Root != expected {
+				t.Errorf("Cache.Verify() = %s, expected corrupt layer %s", corrupt, expected)
+			}
+		})
+
+		it("trusts the recorded checksum of an unchanged artifact only when recovering metadata", func() {
+			root := test.ScratchDir(t, "cache")
+
+			var debug bytes.Buffer
+			logger := libjavabuildpack.Logger{Logger: libbuildpack.NewLogger(&debug, nil)}
+			cache := libjavabuildpack.Cache{
+				Cache:          libbuildpack.Cache{Root: root},
+				Logger:         logger,
+				RecoverCorrupt: true,
+				TrustCache:     true,
+			}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				URI:     "http://test.com/test-path",
+			}
+
+			defer gock.Off()
+
+			for i := 0; i < 2; i++ {
+				gock.New("http://test.com").
+					Get("/test-path").
+					Reply(200).
+					BodyString("test-payload")
+			}
+
+			layer := cache.DownloadLayer(dependency)
+
+			a, err := layer.Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Remove(layer.Metadata(layer.Root)); err != nil {
+				t.Fatal(err)
+			}
+
+			debug.Reset()
+			if _, err := layer.Artifact(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(debug.String(), "Trusting sha256") {
+				t.Errorf("DownloadCacheLayer.Artifact() debug = %s, expected unchanged artifact to be trusted",
+					debug.String())
+			}
+
+			stat, err := os.Stat(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := libjavabuildpack.WriteToFile(strings.NewReader("test-paylod!"), a, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(a, stat.ModTime(), stat.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+
+			corrupt, err := cache.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(corrupt) != 1 {
+				t.Errorf("Cache.Verify() = %s, expected tampered layer to be corrupt", corrupt)
+			}
+
+			if _, err := layer.Artifact(); err != nil {
+				t.Fatal(err)
+			}
+
+			test.BeFileLike(t, a, 0644, "test-payload")
+		})
+
+		it("evicts least recently used download layers past maximum size", func() {
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range []struct {
+				name     string
+				maxSize  int64
+				runStart time.Time
+				evicted  []string
+				kept     []string
+			}{
+				{
+					name:    "until it fits",
+					maxSize: 2100,
+					evicted: []string{"test-sha256-oldest"},
+					kept:    []string{"test-sha256-older"},
+				},
+				{
+					name:     "except layers accessed since the run started",
+					maxSize:  100,
+					runStart: time.Now().Add(-90 * time.Minute),
+					evicted:  []string{"test-sha256-oldest"},
+					kept:     []string{"test-sha256-older"},
+				},
+			} {
+				root := test.ScratchDir(t, "cache")
+
+				for i, sha256 := range []string{"test-sha256-oldest", "test-sha256-older"} {
+					layer := filepath.Join(root, sha256)
+
+					toml, err := internal.ToTomlString(libjavabuildpack.Dependency{
+						Version: libjavabuildpack.Version{Version: v},
+						SHA256:  sha256,
+						URI:     "http://test.com/test-path",
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					metadata := filepath.Join(layer, "dependency.toml")
+					if err := libjavabuildpack.WriteToFile(strings.NewReader(toml), metadata, 0644); err != nil {
+						t.Fatal(err)
+					}
+
+					if err := libjavabuildpack.WriteToFile(strings.NewReader(strings.Repeat("x", 1000)),
+						filepath.Join(layer, "test-path"), 0644); err != nil {
+						t.Fatal(err)
+					}
+
+					accessed := time.Now().Add(-time.Duration(2-i) * time.Hour)
+					if err := os.Chtimes(filepath.Join(layer, "dependency.toml"), accessed, accessed); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}, MaxSize: c.maxSize,
+					RunStart: c.runStart}
+
+				dependency := libjavabuildpack.Dependency{
+					Version: libjavabuildpack.Version{Version: v},
+					SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+					URI:     "http://test.com/test-path",
+				}
+
+				gock.New("http://test.com").
+					Get("/test-path").
+					Reply(200).
+					BodyString("test-payload")
+
+				if _, err := cache.DownloadLayer(dependency).Artifact(); err != nil {
+					t.Fatal(err)
+				}
+				gock.Off()
+
+				for _, sha256 := range c.evicted {
+					if exists, err := libjavabuildpack.FileExists(filepath.Join(root, sha256)); err != nil {
+						t.Fatal(err)
+					} else if exists {
+						t.Errorf("%s: expected layer %s to be evicted", c.name, sha256)
+					}
+				}
+
+				for _, sha256 := range append(c.kept, dependency.SHA256) {
+					internal.FileExists(t, filepath.Join(root, sha256, "test-path"))
+				}
+			}
+		})
+
+		it("flags corrupt remote artifacts without writing to the cache", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependencies := libjavabuildpack.Dependencies{
+				{
+					Version: libjavabuildpack.Version{Version: v},
+					SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+					URI:     "http://test.com/test-path",
+				},
+				{
+					Version: libjavabuildpack.Version{Version: v},
+					SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+					URI:     "http://test.com/test-corrupt-path",
+				},
+			}
+
+			defer gock.Off()
+
+			gock.New("http://test.com").
+				Get("/test-path").
+				Reply(200).
+				BodyString("test-payload")
+
+			gock.New("http://test.com").
+				Get("/test-corrupt-path").
+				Reply(200).
+				BodyString("corrupt-payload")
+
+			results := cache.VerifyRemote(dependencies)
+
+			if len(results) != 2 || !results[0].Passed() || results[1].Passed() {
+				t.Errorf("Cache.VerifyRemote() = %s, expected second dependency to fail", results)
+			}
+
+			contents, err := ioutil.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(contents) != 0 {
+				t.Errorf("cache contents = %v, expected cache to be empty", contents)
+			}
+		})
+
+		it("caches versions sharing a URI filename separately", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}}
+
+			v1, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v2, err := semver.NewVersion("2.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependencies := []libjavabuildpack.Dependency{
+				{
+					Version: libjavabuildpack.Version{Version: v1},
+					SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+					URI:     "http://test.com/1.0/jre.tar.gz",
+				},
+				{
+					Version: libjavabuildpack.Version{Version: v2},
+					SHA256:  "6cff517c577d1d7569f5a2bf1912c87b73dca1f2780a5f3ff8818c187d88d69d",
+					URI:     "http://test.com/2.0/jre.tar.gz",
+				},
+			}
+
+			defer gock.Off()
+
+			gock.New("http://test.com").
+				Get("/1.0/jre.tar.gz").
+				Reply(200).
+				BodyString("test-payload")
+
+			gock.New("http://test.com").
+				Get("/2.0/jre.tar.gz").
+				Reply(200).
+				BodyString("test-payload-2")
+
+			var artifacts []string
+			for _, dependency := range dependencies {
+				a, err := cache.DownloadLayer(dependency).Artifact()
+				if err != nil {
+					t.Fatal(err)
+				}
+				artifacts = append(artifacts, a)
+			}
+
+			if artifacts[0] == artifacts[1] {
+				t.Errorf("artifacts = %s, expected separate cache entries", artifacts)
+			}
+
+			internal.BeFileLike(t, artifacts[0], 0644, "test-payload")
+			internal.BeFileLike(t, artifacts[1], 0644, "test-payload-2")
+		})
+
+		it("downloads again if a reused download is corrupt", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}, RecoverCorrupt: true}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				URI:     "http://test.com/test-path",
+			}
+
+			defer gock.Off()
+
+			for i := 0; i < 2; i++ {
+				gock.New("http://test.com").
+					Get("/test-path").
+					Reply(200).
+					BodyString("test-payload")
+			}
+
+			a, err := cache.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := libjavabuildpack.WriteToFile(strings.NewReader("corrupt-payload"), a, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			a, err = cache.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !gock.IsDone() {
+				t.Errorf("Expected corrupt download to be downloaded again")
+			}
+
+			internal.BeFileLike(t, a, 0644, "test-payload")
+		})
+
+		it("reuses a download with the same digest when pinned to digest", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}, PinToDigest: true}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				URI:     "http://test.com/test-path",
+			}
+
+			defer gock.Off()
+
+			gock.New("http://test.com").
+				Get("/test-path").
+				Reply(200).
+				BodyString("test-payload")
+
+			expected, err := cache.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v2, err := semver.NewVersion("1.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dependency.Version = libjavabuildpack.Version{Version: v2}
+			dependency.URI = "http://test.com/test-path-moved"
+
+			actual, err := cache.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != expected {
+				t.Errorf("Artifact() = %s, expected %s", actual, expected)
+			}
+
+			internal.BeFileLike(t, actual, 0644, "test-payload")
+		})
+
+		it("throttles a download to the maximum rate", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}, MaxDownloadBytesPerSecond: 24}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				URI:     "http://test.com/test-path",
+			}
+
+			defer gock.Off()
+
+			gock.New("http://test.com").
+				Get("/test-path").
+				Reply(200).
+				BodyString("test-payload")
+
+			start := time.Now()
+
+			a, err := cache.DownloadLayer(dependency).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+				t.Errorf("Artifact() took %s, expected at least 500ms at 24 bytes per second", elapsed)
+			}
+
+			internal.BeFileLike(t, a, 0644, "test-payload")
+		})
+
+		it("returns error if download size does not match declared size", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dependency := libjavabuildpack.Dependency{
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+				Size:    100,
+				URI:     "http://test.com/test-path",
+			}
+
+			defer gock.Off()
+
+			gock.New("http://test.com").
+				Get("/test-path").
+				Reply(200).
+				BodyString("test-payload")
+
+			_, err = cache.DownloadLayer(dependency).Artifact()
+			if err == nil || !strings.HasPrefix(err.Error(), "dependency size mismatch") {
+				t.Errorf("DownloadCacheLayer.Artifact() = %v, expected dependency size mismatch", err)
+			}
+		})
+
+		it("skips checksum verification only for a dependency that skips it", func() {
+			root := test.ScratchDir(t, "cache")
+			cache := libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: root}}
+
+			v, err := semver.NewVersion("1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			skipped := libjavabuildpack.Dependency{
+				ID:           "test-skipped",
+				Version:      libjavabuildpack.Version{Version: v},
+				SHA256:       "test-sha256-skipped",
+				URI:          "http://test.com/test-skipped",
+				SkipChecksum: true,
+			}
+
+			verified := libjavabuildpack.Dependency{
+				ID:      "test-verified",
+				Version: libjavabuildpack.Version{Version: v},
+				SHA256:  "test-sha256-verified",
+				URI:     "http://test.com/test-verified",
+			}
+
+			defer gock.Off()
+
+			gock.New("http://test.com").
+				Get("/test-skipped").
+				Reply(200).
+				BodyString("test-payload")
+
+			gock.New("http://test.com").
+				Get("/test-verified").
+				Reply(200).
+				BodyString("test-payload")
+
+			a, err := cache.DownloadLayer(skipped).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			internal.BeFileLike(t, a, 0644, "test-payload")
+
+			_, err = cache.DownloadLayer(verified).Artifact()
+			if err == nil || !strings.HasPrefix(err.Error(), "dependency sha256 mismatch") {
+				t.Errorf("DownloadCacheLayer.Artifact() = %v, expected dependency sha256 mismatch", err)
+			}
+		})
+
 		it("does not download a buildpack cached dependency", func() {
 			root := test.ScratchDir(t, "cache")
 			cache := libjavabuildpack.Cache{
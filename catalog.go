@@ -0,0 +1,337 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
+
+// Catalog is a remote JSON index of dependencies that can be resolved in addition to the dependencies declared inline
+// in buildpack.toml.  The index is an array of objects with the same keys as an inline dependency.
+type Catalog struct {
+	// URI is the location of the index.  The catalog is not used if it is empty.
+	URI string
+
+	// Authorization, if set, is sent as the Authorization header when fetching the index.
+	Authorization string
+
+	// Cache, if set, is used to reuse the fetched index, and the parsed dependency files of the buildpack, across
+	// resolutions, such as when packaging several variants of a buildpack within one process.
+	Cache *ResolverCache
+
+	// Constraints maps dependency ids to the version constraints that select entries from the index.  Entries whose id
+	// does not appear are ignored.
+	Constraints map[string]string
+}
+
+// Dependencies fetches the index and returns the entries that satisfy the constraints, sorted by id and version so that
+// resolution is deterministic regardless of index ordering.
+func (c Catalog) Dependencies() (Dependencies, error) {
+	if c.URI == "" {
+		return Dependencies{}, nil
+	}
+
+	constraints := make(map[string]*semver.Constraints, len(c.Constraints))
+	for id, constraint := range c.Constraints {
+		vc, err := semver.NewConstraint(constraint)
+		if err != nil {
+			return Dependencies{}, fmt.Errorf("catalog constraint %s for %s is malformed: %s", constraint, id, err)
+		}
+		constraints[id] = vc
+	}
+
+	entries, err := c.fetch()
+	if err != nil {
+		return Dependencies{}, err
+	}
+
+	var dependencies Dependencies
+	for _, entry := range entries {
+		vc, ok := constraints[entry.ID]
+		if !ok || entry.Version.Version == nil || !vc.Check(entry.Version.Version) {
+			continue
+		}
+
+		if entry.Destination != "" {
+			if entry.Destination, err = cleanDestination(entry.Destination); err != nil {
+				return Dependencies{}, err
+			}
+		}
+
+		if entry.Source != "" {
+			if err := checkSource(entry.Source); err != nil {
+				return Dependencies{}, err
+			}
+		}
+
+		dependencies = append(dependencies, entry)
+	}
+
+	dependencies.sortByID()
+
+	return dependencies, nil
+}
+
+func (c Catalog) fetch() (Dependencies, error) {
+	key := c.URI + "\x00" + c.Authorization
+
+	if entries, ok := c.Cache.get(key); ok {
+		return entries, nil
+	}
+
+	entries, err := c.fetchRemote()
+	if err != nil {
+		return Dependencies{}, err
+	}
+
+	c.Cache.put(key, entries)
+	return entries, nil
+}
+
+func (c Catalog) fetchRemote() (Dependencies, error) {
+	req, err := http.NewRequest("GET", c.URI, nil)
+	if err != nil {
+		return Dependencies{}, err
+	}
+
+	if c.Authorization != "" {
+		req.Header.Set("Authorization", c.Authorization)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Dependencies{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Dependencies{}, fmt.Errorf("could not fetch catalog %s: %d", c.URI, resp.StatusCode)
+	}
+
+	var raw []catalogEntry
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return Dependencies{}, fmt.Errorf("catalog %s has invalid structure: %s", c.URI, err)
+	}
+
+	entries := make(Dependencies, 0, len(raw))
+	for _, r := range raw {
+		entry, err := r.dependency()
+		if err != nil {
+			return Dependencies{}, fmt.Errorf("catalog %s has invalid structure: %s", c.URI, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// String makes Catalog satisfy the Stringer interface.  The authorization is not included.
+func (c Catalog) String() string {
+	return fmt.Sprintf("Catalog{ URI: %s, Constraints: %s }", c.URI, c.Constraints)
+}
+
+// ResolverCache is a cache of fetched catalog indexes and parsed dependency files that is shared across
+// resolutions.  It is safe for concurrent use, and its zero value is an empty cache whose entries do not expire.
+type ResolverCache struct {
+	mutex   sync.Mutex
+	entries map[string]resolverEntry
+	ttl     time.Duration
+}
+
+// NewResolverCache creates a new ResolverCache whose entries expire after a TTL.  If the TTL is not positive, entries
+// do not expire until the cache is flushed.
+func NewResolverCache(ttl time.Duration) *ResolverCache {
+	return &ResolverCache{entries: make(map[string]resolverEntry), ttl: ttl}
+}
+
+// Flush removes all entries from the cache, so that the next resolution of each catalog fetches it again and each
+// dependency file is parsed again.
+func (r *ResolverCache) Flush() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.entries = make(map[string]resolverEntry)
+}
+
+// get returns a copy of a cached entry that has not expired.  A nil cache never has an entry.
+func (r *ResolverCache) get(key string) (Dependencies, bool) {
+	if r == nil {
+		return nil, false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e, ok := r.entries[key]
+	if !ok || (r.ttl > 0 && time.Since(e.fetched) > r.ttl) {
+		return nil, false
+	}
+
+	return append(Dependencies{}, e.dependencies...), true
+}
+
+func (r *ResolverCache) put(key string, dependencies Dependencies) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.entries == nil {
+		r.entries = make(map[string]resolverEntry)
+	}
+
+	r.entries[key] = resolverEntry{append(Dependencies{}, dependencies...), time.Now()}
+}
+
+// catalogEntry is an entry of a catalog index.  Its version is decoded as a string and parsed with semver.NewVersion,
+// as for an inline dependency, because decoding it into the embedded *semver.Version of a Version would use the
+// UnmarshalJSON method of a nil pointer.  SkipChecksum and Verify are decoded only so that an entry setting them can be
+// rejected: a remote catalog must not disable checksum verification or run a local executable.
+type catalogEntry struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Version      string   `json:"version"`
+	URI          string   `json:"uri"`
+	SHA256       string   `json:"sha256"`
+	Size         int64    `json:"size"`
+	Stacks       Stacks   `json:"stacks"`
+	Licenses     Licenses `json:"licenses"`
+	Arch         string   `json:"arch"`
+	Destination  string   `json:"destination"`
+	EOLDate      string   `json:"eol_date"`
+	Group        string   `json:"group"`
+	PURL         string   `json:"purl"`
+	Select       []string `json:"select"`
+	SkipChecksum *bool    `json:"skip_checksum"`
+	Source       string   `json:"source"`
+	Verify       *string  `json:"verify"`
+}
+
+// dependency returns the Dependency described by the entry, validated as an inline dependency is.  An entry without a
+// version has a nil version, and is never selected by constraints.
+func (c catalogEntry) dependency() (Dependency, error) {
+	if c.ID == "" {
+		return Dependency{}, fmt.Errorf("dependency id missing or wrong format")
+	}
+
+	if c.Name == "" {
+		return Dependency{}, fmt.Errorf("dependency %s name missing or wrong format", c.ID)
+	}
+
+	var version Version
+	if c.Version != "" {
+		v, err := semver.NewVersion(c.Version)
+		if err != nil {
+			return Dependency{}, fmt.Errorf("dependency %s version %s is malformed: %s", c.ID, c.Version, err)
+		}
+		version = Version{v}
+	}
+
+	if c.URI == "" {
+		return Dependency{}, fmt.Errorf("dependency %s uri missing or wrong format", c.ID)
+	}
+
+	if c.SHA256 == "" {
+		return Dependency{}, fmt.Errorf("dependency %s sha256 missing or wrong format", c.ID)
+	}
+
+	if len(c.Stacks) == 0 {
+		return Dependency{}, fmt.Errorf("dependency %s requires at least one stack", c.ID)
+	}
+
+	if len(c.Licenses) == 0 {
+		return Dependency{}, fmt.Errorf("dependency %s requires at least one license", c.ID)
+	}
+
+	for _, l := range c.Licenses {
+		if l.Type == "" && l.URI == "" {
+			return Dependency{}, fmt.Errorf("dependency %s license must have at least one of type or uri", c.ID)
+		}
+	}
+
+	destination := c.Destination
+	if destination != "" {
+		var err error
+		if destination, err = cleanDestination(destination); err != nil {
+			return Dependency{}, err
+		}
+	}
+
+	if c.EOLDate != "" {
+		if err := checkEOLDate(c.EOLDate); err != nil {
+			return Dependency{}, err
+		}
+	}
+
+	if c.PURL != "" {
+		if err := checkPURL(c.PURL); err != nil {
+			return Dependency{}, err
+		}
+	}
+
+	for _, pattern := range c.Select {
+		if err := checkSelect(pattern); err != nil {
+			return Dependency{}, err
+		}
+	}
+
+	if c.SkipChecksum != nil {
+		return Dependency{}, fmt.Errorf("dependency %s sets skip_checksum, which a catalog may not set", c.ID)
+	}
+
+	if c.Source != "" {
+		if err := checkSource(c.Source); err != nil {
+			return Dependency{}, err
+		}
+	}
+
+	if c.Verify != nil {
+		return Dependency{}, fmt.Errorf("dependency %s sets verify, which a catalog may not set", c.ID)
+	}
+
+	return Dependency{
+		ID:          c.ID,
+		Name:        c.Name,
+		Version:     version,
+		URI:         c.URI,
+		SHA256:      c.SHA256,
+		Size:        c.Size,
+		Stacks:      c.Stacks,
+		Licenses:    c.Licenses,
+		Arch:        c.Arch,
+		Destination: destination,
+		EOLDate:     c.EOLDate,
+		Group:       c.Group,
+		PURL:        c.PURL,
+		Select:      c.Select,
+		Source:      c.Source,
+	}, nil
+}
+
+type resolverEntry struct {
+	dependencies Dependencies
+	fetched      time.Time
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/buildpack/libbuildpack"
+	"github.com/cloudfoundry/libjavabuildpack/internal"
+)
+
+// Descriptor is a typed representation of a buildpack.toml.  Keys that are not otherwise represented are kept in the
+// Custom maps of the descriptor and of its tables so that a descriptor can be read and written without losing data.
+type Descriptor struct {
+	// Info is the [buildpack] table.
+	Info DescriptorInfo
+
+	// Stacks are the [[stacks]] tables.
+	Stacks []DescriptorStack
+
+	// Metadata is the [metadata] table.
+	Metadata DescriptorMetadata
+
+	// Custom are the top-level keys other than buildpack, stacks, and metadata.
+	Custom map[string]interface{}
+}
+
+// DescriptorInfo is a typed representation of the [buildpack] table of a buildpack.toml.
+type DescriptorInfo struct {
+	libbuildpack.BuildpackInfo
+
+	// Custom are the keys other than those of BuildpackInfo.
+	Custom map[string]interface{}
+}
+
+// DescriptorStack is a typed representation of a [[stacks]] table of a buildpack.toml.
+type DescriptorStack struct {
+	libbuildpack.BuildpackStack
+
+	// Custom are the keys other than those of BuildpackStack.
+	Custom map[string]interface{}
+}
+
+// DescriptorMetadata is a typed representation of the [metadata] table of a buildpack.toml.
+type DescriptorMetadata struct {
+	// Dependencies are the [[metadata.dependencies]] tables.
+	Dependencies []DescriptorDependency
+
+	// IncludeFiles is the metadata.include_files array.
+	IncludeFiles []string
+
+	// PrePackage is the metadata.pre_package command.
+	PrePackage string
+
+	// Custom are the metadata keys other than dependencies, include_files, and pre_package.
+	Custom map[string]interface{}
+}
+
+// DescriptorDependency is a typed representation of a [[metadata.dependencies]] table of a buildpack.toml.
+type DescriptorDependency struct {
+	Dependency
+
+	// Custom are the keys other than those of Dependency.
+	Custom map[string]interface{}
+}
+
+// Descriptor reads and returns the buildpack's buildpack.toml.
+func (b Buildpack) Descriptor() (Descriptor, error) {
+	f := filepath.Join(b.Root, "buildpack.toml")
+
+	var typed struct {
+		Info   libbuildpack.BuildpackInfo    `toml:"buildpack"`
+		Stacks []libbuildpack.BuildpackStack `toml:"stacks"`
+	}
+	if err := FromTomlFile(f, &typed); err != nil {
+		return Descriptor{}, err
+	}
+
+	var raw map[string]interface{}
+	if err := FromTomlFile(f, &raw); err != nil {
+		return Descriptor{}, err
+	}
+
+	info, _ := raw["buildpack"].(map[string]interface{})
+	d := Descriptor{
+		Info:   DescriptorInfo{typed.Info, custom(info, tomlKeys(typed.Info)...)},
+		Custom: custom(raw, "buildpack", "stacks", "metadata"),
+	}
+
+	stacks, _ := raw["stacks"].([]map[string]interface{})
+	for i, s := range typed.Stacks {
+		var c map[string]interface{}
+		if i < len(stacks) {
+			c = custom(stacks[i], tomlKeys(s)...)
+		}
+
+		d.Stacks = append(d.Stacks, DescriptorStack{s, c})
+	}
+
+	m, _ := raw["metadata"].(map[string]interface{})
+	parsed := Buildpack{Buildpack: libbuildpack.Buildpack{Metadata: m, Logger: b.Logger}}
+
+	dependencies, err := parsed.inlineDependencies()
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	includeFiles, err := parsed.IncludeFiles()
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	prePackage, _ := parsed.PrePackage()
+
+	d.Metadata = DescriptorMetadata{
+		IncludeFiles: includeFiles,
+		PrePackage:   prePackage,
+		Custom:       custom(m, "dependencies", "include_files", "pre_package"),
+	}
+
+	deps, _ := m["dependencies"].([]map[string]interface{})
+	for i, dep := range dependencies {
+		d.Metadata.Dependencies = append(d.Metadata.Dependencies,
+			DescriptorDependency{dep, custom(deps[i], tomlKeys(dep)...)})
+	}
+
+	return d, nil
+}
+
+// Write writes the descriptor as TOML to a file.
+func (d Descriptor) Write(file string) error {
+	raw := copyMap(d.Custom)
+
+	info, err := merge(d.Info.Custom, d.Info.BuildpackInfo)
+	if err != nil {
+		return err
+	}
+	raw["buildpack"] = info
+
+	var stacks []map[string]interface{}
+	for _, s := range d.Stacks {
+		stack, err := merge(s.Custom, s.BuildpackStack)
+		if err != nil {
+			return err
+		}
+		stacks = append(stacks, stack)
+	}
+	if len(stacks) > 0 {
+		raw["stacks"] = stacks
+	}
+
+	var deps []map[string]interface{}
+	for _, dep := range d.Metadata.Dependencies {
+		m, err := merge(dep.Custom, dep.Dependency)
+		if err != nil {
+			return err
+		}
+		deps = append(deps, m)
+	}
+
+	m := copyMap(d.Metadata.Custom)
+	if len(deps) > 0 {
+		m["dependencies"] = deps
+	}
+	if len(d.Metadata.IncludeFiles) > 0 {
+		m["include_files"] = d.Metadata.IncludeFiles
+	}
+	if d.Metadata.PrePackage != "" {
+		m["pre_package"] = d.Metadata.PrePackage
+	}
+	if len(m) > 0 {
+		raw["metadata"] = m
+	}
+
+	toml, err := internal.ToTomlString(raw)
+	if err != nil {
+		return err
+	}
+
+	return WriteToFile(strings.NewReader(toml), file, 0644)
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func custom(m map[string]interface{}, known ...string) map[string]interface{} {
+	c := copyMap(m)
+	for _, k := range known {
+		delete(c, k)
+	}
+	return c
+}
+
+// merge returns the custom keys of a table overlaid with the keys of its typed representation.
+func merge(custom map[string]interface{}, v interface{}) (map[string]interface{}, error) {
+	s, err := internal.ToTomlString(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var typed map[string]interface{}
+	if _, err := toml.Decode(s, &typed); err != nil {
+		return nil, err
+	}
+
+	m := copyMap(custom)
+	for k, v := range typed {
+		m[k] = v
+	}
+	return m, nil
+}
+
+// tomlKeys returns the keys of the fields of a struct that are encoded in TOML.
+func tomlKeys(v interface{}) []string {
+	t := reflect.TypeOf(v)
+
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("toml"), ",")[0]
+		if name != "" && name != "-" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
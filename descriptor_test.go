@@ -0,0 +1,119 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/buildpack/libbuildpack"
+	"github.com/cloudfoundry/libjavabuildpack"
+	"github.com/cloudfoundry/libjavabuildpack/test"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestDescriptor(t *testing.T) {
+	spec.Run(t, "Descriptor", testDescriptor, spec.Report(report.Terminal{}))
+}
+
+func testDescriptor(t *testing.T, when spec.G, it spec.S) {
+
+	it("round-trips a descriptor with custom keys", func() {
+		root := test.ScratchDir(t, "descriptor")
+
+		if err := libjavabuildpack.WriteToFile(strings.NewReader(`test-key = "test-value"
+
+[buildpack]
+id = "test-id"
+name = "test-name"
+version = "1.0"
+homepage = "test-homepage"
+
+[[stacks]]
+id = "test-stack"
+mixins = ["test-mixin"]
+
+[metadata]
+include_files = ["bin/build", "bin/detect"]
+pre_package = "scripts/build.sh"
+test-metadata-key = "test-metadata-value"
+
+[[metadata.dependencies]]
+id = "test-id"
+name = "test-name"
+version = "1.0"
+uri = "test-uri"
+sha256 = "test-sha256"
+stacks = ["test-stack"]
+cpes = ["test-cpe"]
+
+  [[metadata.dependencies.licenses]]
+  type = "test-type"
+`), filepath.Join(root, "buildpack.toml"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		b := libjavabuildpack.Buildpack{Buildpack: libbuildpack.Buildpack{Root: root}}
+
+		expected, err := b.Descriptor()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected.Custom["test-key"] != "test-value" {
+			t.Errorf("Descriptor.Custom = %v, expected test-key", expected.Custom)
+		}
+
+		if expected.Metadata.Custom["test-metadata-key"] != "test-metadata-value" {
+			t.Errorf("Descriptor.Metadata.Custom = %v, expected test-metadata-key", expected.Metadata.Custom)
+		}
+
+		if expected.Info.Custom["homepage"] != "test-homepage" {
+			t.Errorf("Descriptor.Info.Custom = %v, expected homepage", expected.Info.Custom)
+		}
+
+		if len(expected.Stacks) != 1 ||
+			!reflect.DeepEqual(expected.Stacks[0].Custom["mixins"], []interface{}{"test-mixin"}) {
+			t.Errorf("Descriptor.Stacks = %v, expected mixins", expected.Stacks)
+		}
+
+		if len(expected.Metadata.Dependencies) != 1 || expected.Metadata.PrePackage != "scripts/build.sh" {
+			t.Errorf("Descriptor.Metadata = %v, expected dependency and pre_package", expected.Metadata)
+		}
+
+		if !reflect.DeepEqual(expected.Metadata.Dependencies[0].Custom["cpes"], []interface{}{"test-cpe"}) {
+			t.Errorf("Descriptor.Metadata.Dependencies = %v, expected cpes", expected.Metadata.Dependencies)
+		}
+
+		roundTrip := filepath.Join(root, "round-trip")
+		if err := expected.Write(filepath.Join(roundTrip, "buildpack.toml")); err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := libjavabuildpack.Buildpack{Buildpack: libbuildpack.Buildpack{Root: roundTrip}}.Descriptor()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Descriptor = %v, expected %v", actual, expected)
+		}
+	})
+}
@@ -48,6 +48,6 @@ func DefaultDetect() (Detect, error) {
 	return Detect{
 		d,
 		NewBuildpack(d.Buildpack),
-		Logger{d.Logger},
+		Logger{Logger: d.Logger},
 	}, nil
 }
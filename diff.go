@@ -0,0 +1,190 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cloudfoundry/libjavabuildpack/internal"
+)
+
+// Diff is the difference between two buildpack archives.
+type Diff struct {
+	// Added are the names of the entries in the new archive that are not in the old archive.
+	Added []string
+
+	// Removed are the names of the entries in the old archive that are not in the new archive.
+	Removed []string
+
+	// Changed are the names of the entries in both archives whose content, mode, or link target differs.
+	Changed []string
+
+	// Dependencies are the dependencies whose packaged versions differ between the archives, sorted by id.
+	Dependencies []DependencyDiff
+
+	// SizeDelta is the size in bytes of the new archive less the size of the old archive.
+	SizeDelta int64
+}
+
+// DependencyDiff is the difference between the versions of a dependency packaged in two buildpack archives.
+type DependencyDiff struct {
+	// ID is the id of the dependency.
+	ID string
+
+	// Old are the versions of the dependency in the old archive, sorted.  It is empty if the dependency was added.
+	Old []string
+
+	// New are the versions of the dependency in the new archive, sorted.  It is empty if the dependency was removed.
+	New []string
+}
+
+// DiffArchives compares two gzipped tar buildpack archives, using the sha256, mode, and link target of each entry and
+// the dependency metadata packaged alongside each dependency's artifact.
+func DiffArchives(old string, new string) (Diff, error) {
+	oldEntries, oldDependencies, oldSize, err := readArchive(old)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	newEntries, newDependencies, newSize, err := readArchive(new)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	d := Diff{SizeDelta: newSize - oldSize}
+
+	for name, entry := range newEntries {
+		if e, ok := oldEntries[name]; !ok {
+			d.Added = append(d.Added, name)
+		} else if e != entry {
+			d.Changed = append(d.Changed, name)
+		}
+	}
+
+	for name := range oldEntries {
+		if _, ok := newEntries[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+
+	ids := make(map[string]bool)
+	for id := range oldDependencies {
+		ids[id] = true
+	}
+	for id := range newDependencies {
+		ids[id] = true
+	}
+
+	for id := range ids {
+		o, n := oldDependencies[id], newDependencies[id]
+		sort.Strings(o)
+		sort.Strings(n)
+
+		if fmt.Sprint(o) != fmt.Sprint(n) {
+			d.Dependencies = append(d.Dependencies, DependencyDiff{ID: id, Old: o, New: n})
+		}
+	}
+
+	sort.Slice(d.Dependencies, func(i, j int) bool {
+		return d.Dependencies[i].ID < d.Dependencies[j].ID
+	})
+
+	return d, nil
+}
+
+// String makes Diff satisfy the Stringer interface.
+func (d Diff) String() string {
+	return fmt.Sprintf("Diff{ Added: %s, Removed: %s, Changed: %s, Dependencies: %v, SizeDelta: %d }",
+		d.Added, d.Removed, d.Changed, d.Dependencies, d.SizeDelta)
+}
+
+// archiveEntry is what is compared of an entry in two archives.
+type archiveEntry struct {
+	linkname string
+	mode     int64
+	sha256   string
+}
+
+// readArchive returns each entry of a gzipped tar archive, the versions of each dependency described by its dependency
+// metadata entries, and the size of the archive.
+func readArchive(archive string) (map[string]archiveEntry, map[string][]string, int64, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	entries := make(map[string]archiveEntry)
+	dependencies := make(map[string][]string)
+
+	err = internal.WalkTarGz(f, func(header *tar.Header, content io.Reader) error {
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			return nil
+		}
+
+		s := sha256.New()
+
+		if path.Base(header.Name) != "dependency.toml" {
+			if _, err := io.Copy(s, content); err != nil {
+				return err
+			}
+
+			entries[header.Name] = archiveEntry{header.Linkname, header.Mode, hex.EncodeToString(s.Sum(nil))}
+			return nil
+		}
+
+		b, err := ioutil.ReadAll(io.TeeReader(content, s))
+		if err != nil {
+			return err
+		}
+
+		entries[header.Name] = archiveEntry{header.Linkname, header.Mode, hex.EncodeToString(s.Sum(nil))}
+
+		var d Dependency
+		if _, err := toml.Decode(string(b), &d); err != nil {
+			return fmt.Errorf("dependency metadata %s in %s is malformed: %s", header.Name, archive, err)
+		}
+
+		if d.ID != "" && d.Version.Version != nil {
+			dependencies[d.ID] = append(dependencies[d.ID], d.Version.Version.Original())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return entries, dependencies, stat.Size(), nil
+}
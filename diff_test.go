@@ -0,0 +1,101 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/libjavabuildpack"
+	"github.com/cloudfoundry/libjavabuildpack/test"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestDiff(t *testing.T) {
+	spec.Run(t, "Diff", testDiff, spec.Report(report.Terminal{}))
+}
+
+func testDiff(t *testing.T, when spec.G, it spec.S) {
+
+	it("diffs archives with a dependency version bump and an added file", func() {
+		root := test.ScratchDir(t, "diff")
+
+		for _, f := range []string{"build", "detect"} {
+			err := libjavabuildpack.WriteToFile(strings.NewReader("test-"+f), filepath.Join(root, "bin", f), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cache := test.NewDependencyCache(t, filepath.Join(root, "cache"))
+		cache.AddFixture(t, "test-sha256-1", "test-archive.zip")
+		cache.AddFixture(t, "test-sha256-2", "test-archive.zip")
+
+		old := newPackager(root, nil, nil)
+		old.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		old.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256-1"),
+		}
+		old.Cache = cache
+		old.OutputDir = filepath.Join(root, "old")
+
+		if err := old.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		new := newPackager(root, nil, nil)
+		new.Buildpack.Metadata["include_files"] = []interface{}{"bin/build", "bin/detect"}
+		new.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "2.0", "http://localhost/test-archive.zip", "test-sha256-2"),
+		}
+		new.Cache = cache
+		new.OutputDir = filepath.Join(root, "new")
+
+		if err := new.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := libjavabuildpack.DiffArchives(
+			filepath.Join(root, "old", "test-id", "test-id", "1.0", "test-id-1.0.tgz"),
+			filepath.Join(root, "new", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := libjavabuildpack.Diff{
+			Added: []string{
+				"bin/build", "cache/test-sha256-2/dependency.toml", "cache/test-sha256-2/test-archive.zip",
+			},
+			Removed: []string{"cache/test-sha256-1/dependency.toml", "cache/test-sha256-1/test-archive.zip"},
+			Dependencies: []libjavabuildpack.DependencyDiff{
+				{ID: "test-id", Old: []string{"1.0"}, New: []string{"2.0"}},
+			},
+			SizeDelta: d.SizeDelta,
+		}
+
+		if !reflect.DeepEqual(d, expected) {
+			t.Errorf("DiffArchives() = %s, expected %s", d, expected)
+		}
+
+		if d.SizeDelta <= 0 {
+			t.Errorf("Diff.SizeDelta = %d, expected archive to grow", d.SizeDelta)
+		}
+	})
+}
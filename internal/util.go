@@ -17,7 +17,11 @@
 package internal
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
 
 	"github.com/BurntSushi/toml"
 )
@@ -31,3 +35,31 @@ func ToTomlString(v interface{}) (string, error) {
 
 	return b.String(), nil
 }
+
+// WalkTarGz calls a function with the header and content of each entry of a gzipped tar archive, in order, and then
+// reads the rest of the gzip stream so that a corrupt trailer is an error.
+func WalkTarGz(in io.Reader, f func(header *tar.Header, content io.Reader) error) error {
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := f(header, tr); err != nil {
+			return err
+		}
+	}
+
+	_, err = io.Copy(ioutil.Discard, gz)
+	return err
+}
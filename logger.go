@@ -17,7 +17,12 @@
 package libjavabuildpack
 
 import (
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/buildpack/libbuildpack"
 	"github.com/fatih/color"
@@ -25,7 +30,10 @@ import (
 
 const indent = "      "
 
-var eyeCatcher string
+var (
+	colors     = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	eyeCatcher string
+)
 
 func init() {
 	color.NoColor = false
@@ -35,6 +43,31 @@ func init() {
 // Logger is an extension to libbuildpack.Logger to add additional functionality.
 type Logger struct {
 	libbuildpack.Logger
+
+	// JSON indicates whether each line is written as a JSON object, with the level, the message without colors, and
+	// the prefix and fields as keys, rather than as text.
+	JSON bool
+
+	// Prefix, if set, is written at the start of each line, such as the id of the buildpack being packaged, so that the
+	// output of several interleaved runs can be told apart.
+	Prefix string
+
+	// fields are the key-value pairs appended to each line, added with WithFields.
+	fields map[string]interface{}
+}
+
+// Debug prints a debug log message, with the prefix and fields.
+func (l Logger) Debug(format string, args ...interface{}) {
+	if !l.IsDebugEnabled() {
+		return
+	}
+
+	if l.JSON {
+		l.Logger.Debug("%s", l.json("debug", fmt.Sprintf(format, args...)))
+		return
+	}
+
+	l.Logger.Debug("%s%s%s", l.prefix(), fmt.Sprintf(format, args...), l.suffix())
 }
 
 // FirstLine prints the log messages with the first line eye catcher.
@@ -43,7 +76,12 @@ func (l Logger) FirstLine(format string, args ...interface{}) {
 		return
 	}
 
-	l.Info("%s %s", eyeCatcher, fmt.Sprintf(format, args...))
+	if l.JSON {
+		l.Info("%s", l.json("info", fmt.Sprintf(format, args...)))
+		return
+	}
+
+	l.Info("%s%s %s%s", l.prefix(), eyeCatcher, fmt.Sprintf(format, args...), l.suffix())
 }
 
 // SubsequentLine prints log message with the subsequent line indent.
@@ -52,7 +90,12 @@ func (l Logger) SubsequentLine(format string, args ...interface{}) {
 		return
 	}
 
-	l.Info("%s %s", indent, fmt.Sprintf(format, args...))
+	if l.JSON {
+		l.Info("%s", l.json("info", fmt.Sprintf(format, args...)))
+		return
+	}
+
+	l.Info("%s%s %s%s", l.prefix(), indent, fmt.Sprintf(format, args...), l.suffix())
 }
 
 // PrettyVersion formats a standard pretty version of a dependency.
@@ -75,7 +118,78 @@ func (l Logger) PrettyVersion(v interface{}) string {
 	return fmt.Sprintf("%s %s", color.New(color.FgBlue, color.Bold).Sprint(name), color.BlueString(version))
 }
 
+// WithFields returns a copy of the logger that appends the fields, in addition to any it already has, to each line as
+// key=value pairs sorted by key.  Values that are empty or contain spaces, quotes, or = are quoted.
+func (l Logger) WithFields(fields map[string]interface{}) Logger {
+	merged := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	l.fields = merged
+	return l
+}
+
 // String makes Logger satisfy the Stringer interface.
 func (l Logger) String() string {
-	return fmt.Sprintf("Logger{ Logger: %s}", l.Logger)
+	return fmt.Sprintf("Logger{ Logger: %s, JSON: %t, Prefix: %s, fields: %v }", l.Logger, l.JSON, l.Prefix, l.fields)
+}
+
+// json returns a line as a JSON object.  Fields that cannot be represented in JSON are written as strings.
+func (l Logger) json(level string, message string) string {
+	line := map[string]interface{}{"level": level, "message": colors.ReplaceAllString(message, "")}
+	if l.Prefix != "" {
+		line["prefix"] = l.Prefix
+	}
+	if len(l.fields) > 0 {
+		line["fields"] = l.fields
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		fields := make(map[string]string, len(l.fields))
+		for k, v := range l.fields {
+			fields[k] = fmt.Sprint(v)
+		}
+
+		line["fields"] = fields
+		b, _ = json.Marshal(line)
+	}
+
+	return string(b)
+}
+
+func (l Logger) prefix() string {
+	if l.Prefix == "" {
+		return ""
+	}
+
+	return l.Prefix + " "
+}
+
+func (l Logger) suffix() string {
+	if len(l.fields) == 0 {
+		return ""
+	}
+
+	var keys []string
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		v := fmt.Sprint(l.fields[k])
+		if v == "" || strings.ContainsAny(v, " \t\"=") {
+			v = strconv.Quote(v)
+		}
+
+		fmt.Fprintf(&b, " %s=%s", k, v)
+	}
+
+	return b.String()
 }
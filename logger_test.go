@@ -59,6 +59,74 @@ func testLogger(t *testing.T, when spec.G, it spec.S) {
 		}
 	})
 
+	it("writes prefix on lines", func() {
+		var info bytes.Buffer
+
+		logger := libjavabuildpack.Logger{Logger: libbuildpack.NewLogger(nil, &info), Prefix: "[test-id]"}
+		logger.FirstLine("test %s", "message")
+		logger.SubsequentLine("test %s", "message")
+
+		expected := fmt.Sprintf("[test-id] %s test message\n[test-id]        test message\n",
+			color.New(color.FgRed, color.Bold).Sprint("----->"))
+
+		if info.String() != expected {
+			t.Errorf("lines = %q, expected %q", info.String(), expected)
+		}
+	})
+
+	it("writes fields on lines", func() {
+		var info bytes.Buffer
+
+		logger := libjavabuildpack.Logger{Logger: libbuildpack.NewLogger(nil, &info)}
+		logger = logger.WithFields(map[string]interface{}{"id": "test-id", "size": 1024})
+		logger.WithFields(map[string]interface{}{"name": "test name"}).SubsequentLine("test %s", "message")
+		logger.SubsequentLine("test %s", "message")
+
+		expected := "       test message id=test-id name=\"test name\" size=1024\n" +
+			"       test message id=test-id size=1024\n"
+
+		if info.String() != expected {
+			t.Errorf("lines = %q, expected %q", info.String(), expected)
+		}
+	})
+
+	it("writes prefix and fields on debug lines", func() {
+		var debug bytes.Buffer
+
+		logger := libjavabuildpack.Logger{Logger: libbuildpack.NewLogger(&debug, nil), Prefix: "[test-id]"}
+		logger.WithFields(map[string]interface{}{"id": "test-id"}).Debug("test %s", "message")
+
+		if debug.String() != "[test-id] test message id=test-id\n" {
+			t.Errorf("Debug = %q, expected %q", debug.String(), "[test-id] test message id=test-id\n")
+		}
+	})
+
+	it("writes lines as JSON objects with prefix and fields", func() {
+		var debug bytes.Buffer
+		var info bytes.Buffer
+
+		logger := libjavabuildpack.Logger{
+			Logger: libbuildpack.NewLogger(&debug, &info),
+			JSON:   true,
+			Prefix: "[test-id]",
+		}
+		logger = logger.WithFields(map[string]interface{}{"id": "test-id", "size": 1024})
+		logger.FirstLine("test %s", color.BlueString("message"))
+		logger.SubsequentLine("test %s", "message")
+		logger.Debug("test %s", "message")
+
+		line := `{"fields":{"id":"test-id","size":1024},"level":"%s","message":"test message",` +
+			`"prefix":"[test-id]"}` + "\n"
+
+		if expected := fmt.Sprintf(line, "info") + fmt.Sprintf(line, "info"); info.String() != expected {
+			t.Errorf("lines = %q, expected %q", info.String(), expected)
+		}
+
+		if expected := fmt.Sprintf(line, "debug"); debug.String() != expected {
+			t.Errorf("Debug = %q, expected %q", debug.String(), expected)
+		}
+	})
+
 	it("formats pretty version for buildpack", func() {
 		logger := libjavabuildpack.Logger{Logger: libbuildpack.NewLogger(nil, nil)}
 
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var buildpackID = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// Order represents the order.toml of a composite buildpack.
+type Order struct {
+	// Groups are the groups of buildpacks that are detected together.
+	Groups []OrderGroup `toml:"order"`
+}
+
+// Validate returns an error if the order does not reference any buildpacks or references a malformed buildpack id.
+func (o Order) Validate() error {
+	if len(o.Groups) == 0 {
+		return fmt.Errorf("order must contain at least one group")
+	}
+
+	for _, g := range o.Groups {
+		if len(g.Buildpacks) == 0 {
+			return fmt.Errorf("order group must contain at least one buildpack")
+		}
+
+		for _, b := range g.Buildpacks {
+			if !buildpackID.MatchString(b.ID) {
+				return fmt.Errorf("order buildpack id %q is malformed", b.ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// OrderGroup represents a group of buildpacks within an Order.
+type OrderGroup struct {
+	// Buildpacks are the buildpacks in the group.
+	Buildpacks []OrderBuildpack `toml:"group"`
+}
+
+// OrderBuildpack represents a reference to a buildpack within an OrderGroup.
+type OrderBuildpack struct {
+	// ID is the id of the referenced buildpack.
+	ID string `toml:"id"`
+
+	// Version is the version of the referenced buildpack.
+	Version string `toml:"version"`
+
+	// Optional indicates whether the referenced buildpack is optional within the group.
+	Optional bool `toml:"optional"`
+}
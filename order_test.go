@@ -0,0 +1,64 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/libjavabuildpack"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestOrder(t *testing.T) {
+	spec.Run(t, "Order", testOrder, spec.Report(report.Terminal{}))
+}
+
+func testOrder(t *testing.T, when spec.G, it spec.S) {
+
+	it("validates a well-formed order", func() {
+		o := libjavabuildpack.Order{
+			Groups: []libjavabuildpack.OrderGroup{
+				{Buildpacks: []libjavabuildpack.OrderBuildpack{{ID: "test.id-1", Version: "1.0"}, {ID: "test_id_2"}}},
+			},
+		}
+
+		if err := o.Validate(); err != nil {
+			t.Errorf("Order.Validate() = %s, expected nil", err)
+		}
+	})
+
+	it("returns error with no groups", func() {
+		if err := (libjavabuildpack.Order{}).Validate(); err == nil {
+			t.Errorf("Order.Validate() = nil, expected error")
+		}
+	})
+
+	it("returns error with a malformed buildpack id", func() {
+		o := libjavabuildpack.Order{
+			Groups: []libjavabuildpack.OrderGroup{
+				{Buildpacks: []libjavabuildpack.OrderBuildpack{{ID: "test id"}}},
+			},
+		}
+
+		err := o.Validate()
+		if err == nil || !strings.Contains(err.Error(), "malformed") {
+			t.Errorf("Order.Validate() = %v, expected malformed buildpack id", err)
+		}
+	})
+}
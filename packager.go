@@ -18,195 +18,3570 @@ package libjavabuildpack
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/Masterminds/semver"
 	"github.com/buildpack/libbuildpack"
+	"github.com/cloudfoundry/libjavabuildpack/internal"
+	"github.com/fatih/color"
 )
 
-// Packager is a root element for packaging up a buildpack
+// DefaultUsageTemplate is the template used to render USAGE.md when Packager.UsageTemplate is not set.  It is
+// executed with a Usage.
+const DefaultUsageTemplate = `# {{ .Info.Name }} {{ .Info.Version }}
+
+ID: ` + "`{{ .Info.ID }}`" + `
+
+## Stacks
+{{ range .Stacks }}
+* ` + "`{{ .ID }}`" + `{{ end }}
+
+## Dependencies
+{{ range .Dependencies }}
+* {{ .Name }} ` + "`{{ .ID }}`" + ` {{ .Version }}{{ range .Stacks }} ` + "`{{ . }}`" + `{{ end }}{{ end }}
+`
+
+// DefaultCopyBufferSize is the size of the buffer used to copy files into the archive when Packager.CopyBufferSize is
+// not set.
+const DefaultCopyBufferSize = 1024 * 1024
+
+// partIndexWidth is the number of digits that the index of each part of a split archive is zero padded to, so that
+// the parts of any archive sort in order.
+const partIndexWidth = 4
+
+// requiredFiles are the include files that a working buildpack cannot have empty.
+var requiredFiles = []string{filepath.Join("bin", "build"), filepath.Join("bin", "detect")}
+
+// tarBlockSize is the size of the blocks that tar headers and content are padded to.
+const tarBlockSize = 512
+
+// shellScript matches the interpreter line of a shell script.
+var shellScript = regexp.MustCompile(`^#!\S*(/|\s)(ba|da|k|z)?sh(\s|$)`)
+
+// sourceCommand matches a shell command that sources a file, capturing its argument.
+var sourceCommand = regexp.MustCompile(`^\s*(?:source|\.)\s+(.+)$`)
+
+var snapshot = regexp.MustCompile(`(?i)snapshot`)
+
+// emptySHA256 is the sha256 of no content, which is the checksum of a directory entry.
+var emptySHA256 = sha256.Sum256(nil)
+
+// paxAnnotation is the form of a user-defined PAX record key, VENDOR.keyword.
+var paxAnnotation = regexp.MustCompile(`^[A-Za-z0-9]+\.[^=\s\x00]+$`)
+
+// Packager is a root element for packaging up a buildpack.  None of the methods of Packager modify it, so a single
+// configured Packager can be copied and used from multiple goroutines as long as each copy is given its own Buildpack.
 type Packager struct {
 	Buildpack Buildpack
-	Cache     Cache
+	Cache     DependencyCache
 	Logger    Logger
+
+	// Annotations maps archive entry names to custom PAX records written on those entries of tar based archives, for
+	// downstream systems that read per-file metadata.  Keys must be of the form VENDOR.keyword.
+	Annotations map[string]map[string]string
+
+	// ArchiveWriter, if set, is where the archive is streamed to instead of a file in the output directory.  Streaming
+	// only supports FormatTarGz and cannot be combined with Index or Signer.
+	ArchiveWriter io.Writer
+
+	// Arch, if set, is the architecture being packaged for.  Only dependencies compatible with it are cached.
+	Arch string
+
+	// AllowedDependencies are glob patterns of the dependency ids that may be packaged.  If empty, all ids are allowed.
+	AllowedDependencies []string
+
+	// Builder, if set, is the stack of a builder.toml referencing the archive, written next to it as
+	// <archive>.builder.toml for creating a builder from the buildpack.  Fields that are not set default to the id and
+	// first build and run images of the buildpack's stack, if it declares exactly one.  It requires FormatTarGz output
+	// and cannot be combined with ArchiveWriter.
+	Builder *BuilderStack
+
+	// CheckFreshness indicates whether a warning should be logged for each dependency that is behind the latest version
+	// available on the same major line, according to LatestVersions and the buildpack's catalog.  The check is advisory
+	// and never changes resolution.
+	CheckFreshness bool
+
+	// CheckScriptReferences indicates whether included shell scripts should be scanned for files that they source with
+	// source or ., and a warning logged for each referenced file that is not included.  A reference is resolved
+	// relative to the script's directory and to the buildpack root, with a leading variable or substitution, such as
+	// $(dirname "$0"), taken to be one of those.  The scan is heuristic, so references that cannot be resolved are
+	// ignored.
+	CheckScriptReferences bool
+
+	// Clock, if set, returns the current time, used in place of time.Now when checking dependency end of life dates and
+	// rendering snapshot versions.
+	Clock func() time.Time
+
+	// CompressThreshold is the size in bytes below which entries of a FormatZip archive are stored rather than
+	// deflated, as small files do not benefit from compression.  It does not affect FormatTarGz, which compresses the
+	// whole stream.
+	CompressThreshold int64
+
+	// CopyBufferSize is the size in bytes of the buffer used to copy files into the archive.  It defaults to
+	// DefaultCopyBufferSize.
+	CopyBufferSize int
+
+	// DeniedDependencies are glob patterns of the dependency ids that may not be packaged.  Denial takes precedence, so
+	// an id matching both an allowed and a denied pattern is denied.
+	DeniedDependencies []string
+
+	// DeltaFrom, if set, is the path of a previously published gzipped tar archive that is packaged against.  Only the
+	// entries that are added or changed relative to it are packaged, and a DeltaManifest listing the entries it has
+	// that are no longer packaged is written next to the archive as <archive>.delta.toml.  It cannot be combined with
+	// ArchiveWriter.
+	DeltaFrom string
+
+	// DependencyOverrides maps dependency ids to replacement values applied to every dependency with that id during
+	// resolution, so that a dependency can be swapped for an environment-specific build without editing buildpack.toml.
+	DependencyOverrides map[string]DependencyOverride
+
+	// FlatOutput indicates whether the archive should be written directly into the output directory rather than nested
+	// below directories for the elements of the buildpack's id, the id, and the version.
+	FlatOutput bool
+
+	// Formats are the formats that the buildpack is output in.  All formats are produced from a single resolution of
+	// the packaged files.  It defaults to FormatTarGz.
+	Formats []Format
+
+	// EntryAlignment, if positive, is the boundary in bytes, a multiple of the 512 byte tar block size, that the
+	// content of each regular file at least that large starts on within the uncompressed stream of tar based archives,
+	// for deduplicating storage.  The space before such a file is filled with PAX global headers, which do not affect
+	// extraction.  Smaller files are unaffected.
+	EntryAlignment int64
+
+	// EntryOrder is the order that entries are written to the archive in.  It defaults to EntryOrderDeclaration.
+	EntryOrder EntryOrder
+
+	// Excludes are glob patterns of included files that are not packaged, such as *.class or __pycache__, applied after
+	// directory include entries are expanded and the variant is selected.  A pattern matches a file if it matches the
+	// file's slash separated path relative to the buildpack root or any element of that path, and a trailing slash
+	// is ignored.  Excludes take precedence over include_files, including files named explicitly, and do not apply to
+	// dependency artifacts.
+	Excludes []string
+
+	// FilenameTemplate is the template used to render the filename of the archive.  It supports the {id}, {version},
+	// {stack}, and {date} placeholders and defaults to {id}-{version}.tgz.
+	FilenameTemplate string
+
+	// GenerateUsage indicates whether a USAGE.md describing the buildpack's stacks and the dependencies being packaged
+	// should be rendered into the root of the archive.
+	GenerateUsage bool
+
+	// Groups, if set, are the dependency groups that are packaged.  Dependencies in other groups are neither cached nor
+	// packaged, and dependencies without a group are always packaged.  If empty, all groups are packaged.
+	Groups []string
+
+	// IncludeEmptyDirectories indicates whether empty directories found in directory include entries should be added to
+	// the archive as directory entries.
+	IncludeEmptyDirectories bool
+
+	// IncludeFilesList, if set, is the path, relative to the buildpack root, of a file listing further files to
+	// include, one path relative to the buildpack root per line, such as the list of files written by the pre-package
+	// script.  Blank lines are ignored and each listed file must exist.  The listed files are merged with include_files
+	// unless ReplaceIncludeFiles is set.
+	IncludeFilesList string
+
+	// IncludeHidden indicates whether files and directories whose names begin with a dot, found in directory include
+	// entries, should be included in the archive.  Hidden entries named explicitly in include_files are always
+	// included.
+	IncludeHidden bool
+
+	// Index indicates whether a sidecar index listing the name, size, mode, and sha256 of each archive entry should be
+	// written next to the archive.
+	Index bool
+
+	// LatestVersions maps dependency ids to hints of the latest available version, used by CheckFreshness.
+	LatestVersions map[string]string
+
+	// MaxDownloadBytesPerSecond, if positive, is a best-effort limit on the rate at which each dependency download is
+	// read.  It applies when Cache is a Cache, overriding its Cache.MaxDownloadBytesPerSecond.
+	MaxDownloadBytesPerSecond int64
+
+	// MetadataFields, if set, are the keys that are kept in the dependency metadata packaged with each dependency's
+	// artifact.  Other keys are removed and keys the metadata does not have are ignored.  A packaged download is reused
+	// at build time based on the sha256 recorded in its metadata, and is found by the filename of its uri, so sha256
+	// and uri should be kept.
+	MetadataFields []string
+
+	// MetadataTransform, if set, is called with each dependency and the metadata packaged with its artifact, after
+	// MetadataFields is applied, and may modify the metadata before it is written into the archive.  The metadata in
+	// the cache is not changed.  It is not called for dependencies that set select, which package no metadata.
+	MetadataTransform func(dep Dependency, meta map[string]interface{}) error
+
+	// ModTimeSource is where the modification times of archive entries are taken from.  It defaults to
+	// ModTimeSourceFile.
+	ModTimeSource ModTimeSource
+
+	// Offline indicates that the network should not be used for advisory checks such as CheckFreshness.  It also allows
+	// packaging from a Cache whose root is not writable, which is otherwise an error, using only the downloads it
+	// already has.
+	Offline bool
+
+	// OnFile, if set, is called for each file as it is written to a tar based archive.
+	OnFile func(EntryInfo)
+
+	// OutputDir, if set, is the directory that the archive is written to, or - to stream it to stdout.  It defaults to
+	// the first command line argument, so that a tool with its own flag parsing can embed a Packager.
+	OutputDir string
+
+	// PinToDigest indicates whether dependencies are identified only by their sha256, so that entries sharing a sha256
+	// are packaged once regardless of their versions.  If Cache is a Cache, its PinToDigest is set to match, and at
+	// build time the packaged download is reused for each of the versions.
+	PinToDigest bool
+
+	// PlanFormat, if set, makes Create write the ResolutionPlan returned by Plan to stdout in that format instead of
+	// packaging the buildpack.
+	PlanFormat PlanFormat
+
+	// PrePackageInputs, if set, are glob patterns, relative to the buildpack root, of the source files that the output
+	// of the pre-package script depends on.  Directories that match are hashed recursively.  The files are hashed with
+	// the pre_package command rather than the script, so the script itself should be included.  The script is skipped
+	// if the command and the matching files are unchanged since it last succeeded for the variant, as recorded in the
+	// buildpack's cache root, and the PrePackageOutputs cached then are restored.
+	PrePackageInputs []string
+
+	// PrePackageOutputs are glob patterns, relative to the buildpack root, of the files and directories that the
+	// pre-package script writes.  If PrePackageInputs is set, they are cached in the buildpack's cache root under the
+	// hash of the inputs when the script succeeds, and restored when it is skipped.  Output that is not matched must
+	// persist in the buildpack root between runs.
+	PrePackageOutputs []string
+
+	// Provenance, if set, is a short description of where the archive was built, such as the builder and pipeline run
+	// URL.  It is written as the comment of a PAX global header at the start of tar based archives, where it does not
+	// affect extraction.
+	Provenance string
+
+	// SplitSize, if positive, is the maximum size in bytes of the parts that a FormatTarGz archive is split into, for
+	// artifact stores that cap object size.  The parts are written next to the archive as <archive>.part0000,
+	// <archive>.part0001, and so on, with the index zero padded to a fixed width so that the parts sort in order,
+	// together with a PartsManifest.  Parts left by a previous split are removed first.  The archive itself is kept.
+	SplitSize int64
+
+	// StacksFile indicates whether a stacks.toml listing the stacks declared by buildpack.toml should be written into
+	// the root of the archive, so that tooling can select the buildpack by stack without reading buildpack.toml.
+	StacksFile bool
+
+	// Strict indicates whether packaging problems that would otherwise be warned about should fail packaging.
+	Strict bool
+
+	// ReplaceIncludeFiles indicates whether the files listed in IncludeFilesList replace include_files rather than
+	// being merged with them.
+	ReplaceIncludeFiles bool
+
+	// RetryBudget, if positive, is the total number of download retries allowed across all dependencies in a run, in
+	// addition to the per-download Cache.Retries, so that a systemic outage fails fast.  It applies when Cache is a
+	// Cache, and VerifyAndCreate spends a single budget across verification and creation.
+	RetryBudget int
+
+	// RequireHTTPS indicates whether resolution should fail if the catalog URI is not an https:// URI, or a dependency
+	// URI, with environment variables expanded, is not an https:// or file:// URI or an oci:// URI of a registry that
+	// is not one of the Cache.InsecureRegistries, so that plaintext downloads are forbidden.
+	RequireHTTPS bool
+
+	// Reproducible indicates whether the archive should be byte-for-byte reproducible from the same inputs.  Entry
+	// modification times are fixed to the Unix epoch and the gzip header carries no name, comment, or modification
+	// time.
+	Reproducible bool
+
+	// Signer, if set, is used to write a detached signature next to the archive once it has been created.
+	Signer Signer
+
+	// TempDir is the directory that the archive is staged in before being moved into the output directory.  It defaults
+	// to the output directory.
+	TempDir string
+
+	// UsageTemplate is the text/template used to render USAGE.md.  It defaults to DefaultUsageTemplate.
+	UsageTemplate string
+
+	// Variant is the subset of the buildpack that is packaged.  It defaults to VariantFull.
+	Variant Variant
+
+	// VerifyReproducible indicates whether the archive should be built twice before it is written, failing packaging if
+	// the two builds differ.  It implies Reproducible.  OnFile is called for the entries of each build.
+	VerifyReproducible bool
+
+	// VerifyExtractable indicates whether a FormatTarGz archive should be decompressed and each of its entries read
+	// back before it is moved into the output directory, failing packaging if it cannot be.  It is cheaper than
+	// VerifyReproducible and catches truncated or unflushed archives.
+	VerifyExtractable bool
+
+	// VersionMarker indicates whether a .bpversion marker describing the buildpack API version declared by the api key
+	// of buildpack.toml and the version of the buildpack should be written into the root of the archive.
+	VersionMarker bool
+
+	// commitTime is the time of the buildpack's HEAD commit, if ModTimeSource is ModTimeSourceGitCommit and it could be
+	// determined.
+	commitTime time.Time
+
+	// dependencyFiles are the archive entries of the cached dependency artifacts and their metadata, for OnFile.
+	dependencyFiles map[string]bool
+
+	// prePackaged indicates whether the pre-package script has already been run, by VerifyAndCreate.
+	prePackaged bool
+
+	// retryBudget, if set, is the retry budget shared by the caches of a run, so that VerifyAndCreate spends a single
+	// budget across verification and creation.
+	retryBudget *RetryBudget
+
+	// warnings, if set, collects the warnings raised by resolution, for Plan.
+	warnings *[]string
+}
+
+// Format is a format that a buildpack package can be output in.
+type Format string
+
+const (
+	// FormatDirectory outputs the buildpack as an exploded directory, named for the archive without its extension.
+	FormatDirectory Format = "directory"
+
+	// FormatTar outputs the buildpack as an uncompressed tar archive, named for the archive with a .tar extension.
+	FormatTar Format = "tar"
+
+	// FormatTarGz outputs the buildpack as a gzipped tar archive.
+	FormatTarGz Format = "tgz"
+
+	// FormatOCILayer outputs the buildpack as a gzipped OCI image layer, named for the archive with a .layer.tgz
+	// extension.  The layer lays the buildpack out under /cnb/buildpacks/<id>/<version>.
+	FormatOCILayer Format = "oci-layer"
+
+	// FormatZip outputs the buildpack as a zip archive, named for the archive with a .zip extension.
+	FormatZip Format = "zip"
+)
+
+// EntryOrder is the order that entries are written to an archive in.
+type EntryOrder string
+
+const (
+	// EntryOrderDeclaration writes the included files in the order they are declared, followed by the dependencies.
+	EntryOrderDeclaration EntryOrder = "declaration"
+
+	// EntryOrderByNameASCII writes all entries, including directory entries, sorted byte-wise by entry name, for
+	// consumers that require it.  The order does not depend on locale.
+	EntryOrderByNameASCII EntryOrder = "name-ascii"
+)
+
+// ModTimeSource is where the modification times of archive entries are taken from.
+type ModTimeSource string
+
+const (
+	// ModTimeSourceFile uses the modification time of each file, or the Unix epoch if the archive is reproducible.
+	ModTimeSourceFile ModTimeSource = "file"
+
+	// ModTimeSourceGitCommit uses the commit time of HEAD when the buildpack root is a git checkout, so that archives
+	// are both reproducible and meaningfully dated.  If it is not, ModTimeSourceFile is used instead.
+	ModTimeSourceGitCommit ModTimeSource = "git-commit"
+)
+
+// Usage is the data that the usage template is executed with.
+type Usage struct {
+	// Info is the identifying information of the buildpack.
+	Info libbuildpack.BuildpackInfo
+
+	// Stacks are the stacks the buildpack supports.
+	Stacks []libbuildpack.BuildpackStack
+
+	// Dependencies are the dependencies packaged with the buildpack.
+	Dependencies Dependencies
+}
+
+// DependencyOverride is a set of replacement values for a dependency.  Empty values are not replaced.
+type DependencyOverride struct {
+	// URI is the replacement uri of the dependency.
+	URI string `toml:"uri"`
+
+	// Version is the replacement version of the dependency.
+	Version string `toml:"version"`
+
+	// SHA256 is the replacement sha256 of the dependency.
+	SHA256 string `toml:"sha256"`
+}
+
+// EntryInfo describes a file written to an archive.
+type EntryInfo struct {
+	// Name is the name of the entry.
+	Name string
+
+	// Size is the size of the entry in bytes.
+	Size int64
+
+	// Dependency indicates whether the entry is a cached dependency artifact or its metadata.
+	Dependency bool
+}
+
+// Index is the content index of an archive, written next to it so that its contents can be listed without extraction.
+type Index struct {
+	// Entries are the entries of the archive in the order they were written.
+	Entries []IndexEntry `toml:"entries"`
+}
+
+// IndexEntry describes a single entry in an archive.
+type IndexEntry struct {
+	// Name is the name of the entry.
+	Name string `toml:"name"`
+
+	// Size is the size of the entry in bytes.
+	Size int64 `toml:"size"`
+
+	// Mode is the permission and mode bits of the entry.
+	Mode int64 `toml:"mode"`
+
+	// SHA256 is the sha256 of the entry's content.
+	SHA256 string `toml:"sha256"`
+}
+
+// BuilderDescriptor is a builder.toml that creates a builder from a packaged buildpack.
+type BuilderDescriptor struct {
+	// Buildpacks are the buildpacks of the builder.
+	Buildpacks []BuilderBuildpack `toml:"buildpacks"`
+
+	// Order is the order that the buildpacks of the builder are detected in.
+	Order []BuilderGroup `toml:"order"`
+
+	// Stack is the stack of the builder.
+	Stack BuilderStack `toml:"stack"`
+}
+
+// BuilderBuildpack is a buildpack of a builder.
+type BuilderBuildpack struct {
+	// ID is the id of the buildpack.
+	ID string `toml:"id"`
+
+	// URI is the location of the buildpack's archive, relative to the builder.toml.
+	URI string `toml:"uri"`
+}
+
+// BuilderGroup is a group of buildpacks in the order of a builder.
+type BuilderGroup struct {
+	// Group are the buildpacks of the group.
+	Group []BuilderReference `toml:"group"`
+}
+
+// BuilderReference is a reference to a buildpack in the order of a builder.
+type BuilderReference struct {
+	// ID is the id of the buildpack.
+	ID string `toml:"id"`
+
+	// Version is the version of the buildpack.
+	Version string `toml:"version"`
+}
+
+// BuilderStack is the stack of a builder.
+type BuilderStack struct {
+	// ID is the id of the stack.
+	ID string `toml:"id"`
+
+	// BuildImage is the build image of the stack.
+	BuildImage string `toml:"build-image"`
+
+	// RunImage is the run image of the stack.
+	RunImage string `toml:"run-image"`
+}
+
+// DeltaManifest describes an archive packaged against a base archive with DeltaFrom.
+type DeltaManifest struct {
+	// Base is the filename of the base archive.
+	Base string `toml:"base"`
+
+	// Removed are the names of the entries of the base archive that are no longer packaged, sorted.
+	Removed []string `toml:"removed"`
+}
+
+// PartsManifest describes the parts that an archive was split into, written next to the archive as
+// <archive>.parts.toml.  The archive is reassembled by concatenating the parts in order, for example with
+// cat <archive>.part* > <archive>.
+type PartsManifest struct {
+	// Archive is the filename of the archive.
+	Archive string `toml:"archive"`
+
+	// Size is the size of the archive in bytes.
+	Size int64 `toml:"size"`
+
+	// SHA256 is the sha256 of the archive.
+	SHA256 string `toml:"sha256"`
+
+	// Parts are the parts in the order that they are concatenated.
+	Parts []Part `toml:"parts"`
+}
+
+// Part is a part of a split archive.
+type Part struct {
+	// Name is the filename of the part.
+	Name string `toml:"name"`
+
+	// Size is the size of the part in bytes.
+	Size int64 `toml:"size"`
+
+	// SHA256 is the sha256 of the part.
+	SHA256 string `toml:"sha256"`
+}
+
+// DependencyTiming is how long the artifact of a dependency took to acquire while packaging.
+type DependencyTiming struct {
+	// ID is the id of the dependency.
+	ID string `toml:"id"`
+
+	// Version is the version of the dependency.
+	Version string `toml:"version"`
+
+	// Downloaded is the number of bytes downloaded, which is zero if a cached download was reused.
+	Downloaded int64 `toml:"downloaded"`
+
+	// Seconds is how long the artifact took to acquire.
+	Seconds float64 `toml:"seconds"`
+
+	// BytesPerSecond is the effective throughput of the download, which is zero if a cached download was reused.
+	BytesPerSecond float64 `toml:"bytes_per_second"`
+}
+
+// Report describes a buildpack package that has been created.
+type Report struct {
+	// Archive is the path of the archive written, if FormatTarGz was output.
+	Archive string `toml:"archive,omitempty"`
+
+	// Builder is the path of the BuilderDescriptor written, if Builder is set.
+	Builder string `toml:"builder,omitempty"`
+
+	// Delta is the path of the DeltaManifest written, if DeltaFrom is set.
+	Delta string `toml:"delta,omitempty"`
+
+	// Dependencies are the dependencies packaged, including the source that each was built from, if declared.  The
+	// PURL of each is set to its PackageURL.
+	Dependencies Dependencies `toml:"dependencies,omitempty"`
+
+	// DiffID is the digest of the uncompressed tar of the archive, in the form sha256:<hex>, if FormatTarGz was output.
+	DiffID string `toml:"diff_id,omitempty"`
+
+	// Directory is the path of the exploded directory written, if FormatDirectory was output.
+	Directory string `toml:"directory,omitempty"`
+
+	// Index is the path of the sidecar Index written, if Index is set.
+	Index string `toml:"index,omitempty"`
+
+	// OCILayer describes the OCI image layer written, if FormatOCILayer was output.
+	OCILayer OCILayer `toml:"oci_layer"`
+
+	// Parts are the paths of the parts that the archive was split into, if SplitSize is set.
+	Parts []string `toml:"parts,omitempty"`
+
+	// Signature is the path of the detached signature written, if Signer is set.
+	Signature string `toml:"signature,omitempty"`
+
+	// Tar is the path of the uncompressed tar archive written, if FormatTar was output.
+	Tar string `toml:"tar,omitempty"`
+
+	// Timings are how long the artifact of each dependency took to acquire, in the order the dependencies were cached.
+	Timings []DependencyTiming `toml:"timings,omitempty"`
+
+	// Zip is the path of the zip archive written, if FormatZip was output.
+	Zip string `toml:"zip,omitempty"`
+}
+
+// OCILayerMediaType is the media type of a layer written by FormatOCILayer.
+const OCILayerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+// OCILayer describes an OCI image layer containing a buildpack.
+type OCILayer struct {
+	// Path is the path of the layer.
+	Path string `toml:"path"`
+
+	// MediaType is the media type of the layer.
+	MediaType string `toml:"media_type"`
+
+	// Digest is the digest of the compressed layer, in the form sha256:<hex>.
+	Digest string `toml:"digest"`
+
+	// DiffID is the digest of the uncompressed layer tar, in the form sha256:<hex>.
+	DiffID string `toml:"diff_id"`
+
+	// Size is the size of the compressed layer in bytes.
+	Size int64 `toml:"size"`
+}
+
+// Signer defines the interface for producing a detached signature of a buildpack archive.
+type Signer interface {
+	// Sign returns the detached signature of the archive content.
+	Sign(archive io.Reader) ([]byte, error)
+}
+
+// Create creates a new buildpack package.  If ArchiveWriter is set, or the output directory is -, the archive is
+// streamed rather than written to the output directory.  If PlanFormat is set, the resolution plan is written to stdout
+// instead.
+func (p Packager) Create() error {
+	return p.create(context.Background())
+}
+
+// Package creates a new buildpack package, as Create does, and returns a report of what was written.  The report
+// records the resolved paths, including the concrete timestamp of a snapshot version, so that later steps need not
+// reconstruct them.
+func (p Packager) Package() (Report, error) {
+	return p.pack(context.Background())
+}
+
+// VerifyAndCreate validates the descriptor, caches the artifact of every dependency, and verifies each cached
+// artifact's checksum before creating the buildpack package.  If any step fails, or ctx is done, no archive is written.
+func (p Packager) VerifyAndCreate(ctx context.Context) error {
+	stream := p.ArchiveWriter
+	if stream == nil {
+		dir, err := p.outputDir()
+		if err != nil {
+			return err
+		}
+
+		if dir == "-" {
+			stream = os.Stdout
+		}
+	}
+
+	if stream != nil {
+		if err := p.checkStream(); err != nil {
+			return err
+		}
+	}
+
+	p.Logger.FirstLine("Verifying %s", p.Logger.PrettyVersion(p.Buildpack))
+
+	if err := p.validateDescriptor(); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := p.prePackage(ctx, prePackageOut(stream)); err != nil {
+		return err
+	}
+	p.prePackaged = true
+
+	if p.RetryBudget > 0 {
+		p.retryBudget = NewRetryBudget(p.RetryBudget)
+	}
+
+	composite, err := p.Buildpack.Composite()
+	if err != nil {
+		return err
+	}
+
+	if !composite {
+		if err := p.verifyDependencies(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return p.create(ctx)
+}
+
+// Check packages the buildpack reproducibly in memory and returns whether the archive is identical to an existing
+// archive.  If it is not, the first differing entry is logged.
+func (p Packager) Check(existing string) (bool, error) {
+	var b bytes.Buffer
+
+	p.ArchiveWriter = &b
+	p.Builder = nil
+	p.DeltaFrom = ""
+	p.Formats = nil
+	p.Index = false
+	p.Reproducible = true
+	p.Signer = nil
+	p.SplitSize = 0
+
+	if _, err := p.Package(); err != nil {
+		return false, err
+	}
+
+	in, err := ioutil.ReadFile(existing)
+	if err != nil {
+		return false, err
+	}
+
+	if bytes.Equal(b.Bytes(), in) {
+		p.Logger.FirstLine("Archive matches %s", existing)
+		return true, nil
+	}
+
+	expected, err := archiveIndex(bytes.NewReader(in))
+	if err != nil {
+		return false, err
+	}
+
+	actual, err := archiveIndex(&b)
+	if err != nil {
+		return false, err
+	}
+
+	if d, ok := firstDifference(expected, actual); ok {
+		p.Logger.FirstLine("%s: archive differs from %s at entry %s", color.RedString("Mismatch"), existing, d)
+	} else {
+		p.Logger.FirstLine("%s: archive differs from %s outside of its entries", color.RedString("Mismatch"), existing)
+	}
+
+	return false, nil
+}
+
+// For returns a copy of the Packager configured to package a different buildpack, using that buildpack's cache root.
+// If the Cache reuses the layers of a buildpack cache, that buildpack's cache root is used for them as well, so that
+// the copy never reuses the layers of the original buildpack.  The log lines of the copy, and of its Cache, are
+// prefixed with the id of the buildpack, so that the output of copies run concurrently can be told apart.
+func (p Packager) For(buildpack Buildpack) Packager {
+	p.Buildpack = buildpack
+
+	prefix := fmt.Sprintf("[%s]", buildpack.Info.ID)
+	p.Logger.Prefix = prefix
+
+	if c, ok := p.Cache.(Cache); ok {
+		c.Root = buildpack.CacheRoot
+		if c.BuildpackCacheRoot != "" {
+			c.BuildpackCacheRoot = buildpack.CacheRoot
+		}
+		c.Logger.Prefix = prefix
+		p.Cache = c
+	}
+
+	return p
+}
+
+// String makes Packager satisfy the Stringer interface.  It describes the effective configuration, with the catalog
+// authorization omitted and the function and writer fields described by whether they are set.
+func (p Packager) String() string {
+	return fmt.Sprintf("Packager{ AllowedDependencies: %s, Annotations: %v, Arch: %s, ArchiveWriter: %t, Builder: %v, "+
+		"Buildpack: %s, Cache: %v, Catalog: %s, CheckFreshness: %t, CheckScriptReferences: %t, Clock: %t, "+
+		"CompressThreshold: %d, CopyBufferSize: %d, DeltaFrom: %s, DeniedDependencies: %s, DependencyOverrides: %v, "+
+		"EntryAlignment: %d, EntryOrder: %s, Excludes: %s, FilenameTemplate: %s, FlatOutput: %t, Formats: %s, "+
+		"GenerateUsage: %t, Groups: %s, IncludeEmptyDirectories: %t, IncludeFilesList: %s, IncludeHidden: %t, "+
+		"Index: %t, LatestVersions: %v, Logger: %s, MaxDownloadBytesPerSecond: %d, MetadataFields: %s, "+
+		"MetadataTransform: %t, ModTimeSource: %s, Offline: %t, OnFile: %t, OutputDir: %s, PinToDigest: %t, "+
+		"PlanFormat: %s, PrePackageInputs: %s, PrePackageOutputs: %s, Provenance: %s, ReplaceIncludeFiles: %t, "+
+		"Reproducible: %t, RequireHTTPS: %t, RetryBudget: %d, Signer: %t, SplitSize: %d, StacksFile: %t, Strict: %t, "+
+		"TempDir: %s, UsageTemplate: %s, Variant: %s, VerifyExtractable: %t, VerifyReproducible: %t, "+
+		"VersionMarker: %t }",
+		p.AllowedDependencies, p.Annotations, p.Arch, p.ArchiveWriter != nil, p.Builder, p.Buildpack, p.Cache,
+		p.Buildpack.Catalog, p.CheckFreshness, p.CheckScriptReferences, p.Clock != nil, p.CompressThreshold,
+		p.copyBufferSize(), p.DeltaFrom, p.DeniedDependencies, p.DependencyOverrides, p.EntryAlignment, p.EntryOrder,
+		p.Excludes, p.FilenameTemplate, p.FlatOutput, p.formats(), p.GenerateUsage, p.Groups,
+		p.IncludeEmptyDirectories, p.IncludeFilesList, p.IncludeHidden, p.Index, p.LatestVersions, p.Logger,
+		p.MaxDownloadBytesPerSecond, p.MetadataFields, p.MetadataTransform != nil, p.ModTimeSource, p.Offline,
+		p.OnFile != nil, p.OutputDir, p.PinToDigest, p.PlanFormat, p.PrePackageInputs, p.PrePackageOutputs,
+		p.Provenance, p.ReplaceIncludeFiles, p.Reproducible, p.RequireHTTPS, p.RetryBudget, p.Signer != nil,
+		p.SplitSize, p.StacksFile, p.Strict, p.TempDir, p.UsageTemplate, p.Variant, p.VerifyExtractable,
+		p.VerifyReproducible, p.VersionMarker)
+}
+
+func (p Packager) addFile(out *tar.Writer, path string, source string, buf []byte,
+	aligner *tarAligner) (IndexEntry, error) {
+	path, err := entryName(path)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+
+	p.Logger.SubsequentLine("Adding %s", path)
+
+	file, err := os.Open(source)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return IndexEntry{}, err
+	}
+
+	header := new(tar.Header)
+	header.Name = path
+	header.Size = stat.Size()
+	header.Mode = int64(stat.Mode())
+	header.ModTime = p.modTime(stat.ModTime())
+	header.PAXRecords = p.Annotations[path]
+
+	if stat.IsDir() {
+		header.Name = path + "/"
+		header.Typeflag = tar.TypeDir
+		header.Size = 0
+		header.Mode = int64(stat.Mode().Perm())
+
+		return IndexEntry{Name: header.Name, Mode: header.Mode}, out.WriteHeader(header)
+	}
+
+	if aligner != nil && header.Size >= aligner.alignment {
+		if err := aligner.align(out, header); err != nil {
+			return IndexEntry{}, err
+		}
+	}
+
+	if err := out.WriteHeader(header); err != nil {
+		return IndexEntry{}, err
+	}
+
+	s := sha256.New()
+	// The reader is wrapped so that the copy uses buf rather than an io.WriterTo implementation with its own buffer.
+	n, err := io.CopyBuffer(io.MultiWriter(out, s), struct{ io.Reader }{io.LimitReader(file, header.Size)}, buf)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+
+	// A file that changes size after it is stat'd would no longer match its header and corrupt the archive.
+	if n != header.Size {
+		return IndexEntry{}, fmt.Errorf("%s shrank from %d to %d bytes while being packaged", path, header.Size, n)
+	}
+
+	if extra, _ := file.Read(buf[:1]); extra > 0 {
+		return IndexEntry{}, fmt.Errorf("%s grew beyond %d bytes while being packaged", path, header.Size)
+	}
+
+	return IndexEntry{Name: path, Size: header.Size, Mode: header.Mode, SHA256: hex.EncodeToString(s.Sum(nil))}, nil
+}
+
+func (p Packager) addZipFile(out *zip.Writer, path string, source string, buf []byte) error {
+	path, err := entryName(path)
+	if err != nil {
+		return err
+	}
+
+	p.Logger.SubsequentLine("Adding %s", path)
+
+	file, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(stat)
+	if err != nil {
+		return err
+	}
+	header.Name = path
+	header.Method = zip.Deflate
+
+	if !p.commitTime.IsZero() {
+		header.Modified = p.commitTime
+	} else if p.Reproducible {
+		// Zip timestamps cannot represent the Unix epoch, so the earliest MS-DOS time is used instead.
+		header.Modified = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	if stat.IsDir() {
+		header.Name = path + "/"
+		header.Method = zip.Store
+
+		_, err := out.CreateHeader(header)
+		return err
+	}
+
+	if stat.Size() < p.CompressThreshold {
+		header.Method = zip.Store
+	}
+
+	w, err := out.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.CopyBuffer(w, struct{ io.Reader }{io.LimitReader(file, stat.Size())}, buf)
+	if err != nil {
+		return err
+	}
+
+	// As for a tar entry, a file that changes size after it is stat'd would no longer match its header.
+	if n != stat.Size() {
+		return fmt.Errorf("%s shrank from %d to %d bytes while being packaged", path, stat.Size(), n)
+	}
+
+	if extra, _ := file.Read(buf[:1]); extra > 0 {
+		return fmt.Errorf("%s grew beyond %d bytes while being packaged", path, stat.Size())
+	}
+
+	return nil
+}
+
+func (p Packager) archivePath(dir string) (string, error) {
+	info := p.Buildpack.Info
+
+	path := []string{dir}
+	if !p.FlatOutput {
+		path = append(path, strings.Split(info.ID, ".")...)
+		path = append(path, info.ID, info.Version)
+	}
+
+	now := p.now()
+
+	f, err := p.filename(now)
+	if err != nil {
+		return "", err
+	}
+
+	path = append(path, f)
+
+	return filepath.Join(path...), nil
+}
+
+// checkAnnotations returns an error if an annotation key is not a user-defined PAX record key or is in a namespace that
+// tar readers interpret.
+func (p Packager) checkAnnotations() error {
+	for name, records := range p.Annotations {
+		for k := range records {
+			if !paxAnnotation.MatchString(k) || strings.HasPrefix(k, "GNU.") || strings.HasPrefix(k, "SCHILY.") {
+				return fmt.Errorf("annotation %s of %s is not a PAX record key of the form VENDOR.keyword", k, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkDependencies warns about, or if Strict is set returns an error for, problems with the resolved dependencies.
+func (p Packager) checkDependencies(deps Dependencies) error {
+	if err := p.checkStackCoverage(deps); err != nil {
+		return err
+	}
+
+	if err := p.checkProvides(deps); err != nil {
+		return err
+	}
+
+	if err := p.checkEOL(deps); err != nil {
+		return err
+	}
+
+	if err := p.checkURIVariables(deps); err != nil {
+		return err
+	}
+
+	p.checkFreshness(deps)
+	return nil
+}
+
+// checkEOL warns about, or if Strict is set returns an error for, each dependency that is past its end of life date.
+func (p Packager) checkEOL(deps Dependencies) error {
+	now := p.now()
+
+	for _, dep := range deps {
+		if dep.EOLDate == "" {
+			continue
+		}
+
+		eol, err := time.Parse("2006-01-02", dep.EOLDate)
+		if err != nil {
+			return fmt.Errorf("dependency %s %s eol_date %s is malformed: %s", dep.ID, dep.Version.Original(),
+				dep.EOLDate, err)
+		}
+
+		if !now.After(eol) {
+			continue
+		}
+
+		if p.Strict {
+			return fmt.Errorf("dependency %s %s reached end of life on %s", dep.ID, dep.Version.Original(), dep.EOLDate)
+		}
+
+		p.warn("dependency %s %s reached end of life on %s", dep.ID, dep.Version.Original(), dep.EOLDate)
+	}
+
+	return nil
+}
+
+func (p Packager) checkFreshness(deps Dependencies) {
+	if !p.CheckFreshness {
+		return
+	}
+
+	var available Dependencies
+
+	for id, v := range p.LatestVersions {
+		version, err := semver.NewVersion(v)
+		if err != nil {
+			p.Logger.Debug("Latest version %s of %s is malformed: %s", v, id, err)
+			continue
+		}
+
+		available = append(available, Dependency{ID: id, Version: Version{version}})
+	}
+
+	if p.Offline {
+		p.Logger.Debug("Skipping catalog freshness check while offline")
+	} else if p.Buildpack.Catalog.URI != "" {
+		catalog, err := p.Buildpack.Catalog.fetch()
+		if err != nil {
+			p.Logger.Debug("Unable to fetch catalog for freshness check: %s", err)
+		}
+		available = append(available, catalog...)
+	}
+
+	for _, dep := range deps {
+		latest := dep.Version
+
+		for _, a := range available {
+			if a.ID == dep.ID && a.Version.Version != nil && a.Version.Major() == dep.Version.Major() &&
+				a.Version.GreaterThan(latest.Version) {
+				latest = a.Version
+			}
+		}
+
+		if latest.Version != dep.Version.Version {
+			p.warn("Dependency %s is pinned to %s but %s is available", dep.ID, dep.Version.Original(),
+				latest.Original())
+		}
+	}
+}
+
+// checkCatalogHTTPS returns an error if the catalog URI is not secure, if RequireHTTPS is set.
+func (p Packager) checkCatalogHTTPS() error {
+	if !p.RequireHTTPS || p.Buildpack.Catalog.URI == "" {
+		return nil
+	}
+
+	if u, err := url.Parse(p.Buildpack.Catalog.URI); err != nil || u.Scheme != "https" {
+		return fmt.Errorf("catalog must use an https uri: %s", p.Buildpack.Catalog.URI)
+	}
+
+	return nil
+}
+
+// checkHTTPS returns an error naming the dependencies whose URIs are not secure, if RequireHTTPS is set.  A URI is
+// checked as it is downloaded from, so with environment variables expanded and an oci:// URI resolved to the registry
+// it is pulled from, over plain HTTP if the registry is one of the InsecureRegistries of a Cache.
+func (p Packager) checkHTTPS(deps Dependencies) error {
+	if !p.RequireHTTPS {
+		return nil
+	}
+
+	var registries []string
+	if c, ok := p.Cache.(Cache); ok {
+		registries = c.InsecureRegistries
+	}
+
+	var insecure []string
+	for _, dep := range deps {
+		req, err := dependencyRequest(dep, registries, "")
+		if err != nil {
+			return err
+		}
+
+		if req.URL.Scheme == "https" || req.URL.Scheme == "file" {
+			continue
+		}
+
+		insecure = append(insecure, fmt.Sprintf("%s %s (%s)", dep.ID, dep.Version.Original(), dep.URI))
+	}
+
+	if len(insecure) > 0 {
+		return fmt.Errorf("dependencies must use https uris: %s", strings.Join(insecure, ", "))
+	}
+
+	return nil
+}
+
+func (p Packager) checkPolicy(deps Dependencies) error {
+	for _, dep := range deps {
+		denied, err := matchesAny(p.DeniedDependencies, dep.ID)
+		if err != nil {
+			return err
+		}
+
+		if denied {
+			return fmt.Errorf("dependency %s is denied", dep.ID)
+		}
+
+		if len(p.AllowedDependencies) == 0 {
+			continue
+		}
+
+		allowed, err := matchesAny(p.AllowedDependencies, dep.ID)
+		if err != nil {
+			return err
+		}
+
+		if !allowed {
+			return fmt.Errorf("dependency %s is not allowed", dep.ID)
+		}
+	}
+
+	return nil
+}
+
+func (p Packager) checkProvides(deps Dependencies) error {
+	provides, err := p.Buildpack.Provides()
+	if err != nil {
+		return err
+	}
+
+	if _, err := p.Buildpack.Requires(); err != nil {
+		return err
+	}
+
+	for _, name := range provides {
+		bundled := false
+		for _, dep := range deps {
+			if dep.ID == name {
+				bundled = true
+				break
+			}
+		}
+
+		if bundled {
+			continue
+		}
+
+		if p.Strict {
+			return fmt.Errorf("provides %s but no %s dependency is bundled", name, name)
+		}
+
+		p.warn("provides %s but no %s dependency is bundled", name, name)
+	}
+
+	return nil
+}
+
+func (p Packager) checkRequiredFiles(files []string) error {
+	for _, file := range files {
+		f := filepath.Clean(file)
+
+		required := false
+		for _, r := range requiredFiles {
+			if f == r {
+				required = true
+			}
+		}
+
+		if !required {
+			continue
+		}
+
+		stat, err := os.Stat(filepath.Join(p.Buildpack.Root, f))
+		if err != nil {
+			return err
+		}
+
+		if stat.Size() != 0 {
+			continue
+		}
+
+		if p.Strict {
+			return fmt.Errorf("required file %s is empty", f)
+		}
+
+		p.warn("required file %s is empty", f)
+	}
+
+	return nil
+}
+
+// checkScriptReferences warns about, or if Strict is set returns an error for, each file sourced by an included shell
+// script that is not included.
+func (p Packager) checkScriptReferences(files []string) error {
+	if !p.CheckScriptReferences {
+		return nil
+	}
+
+	included := make(map[string]bool, len(files))
+	for _, file := range files {
+		included[filepath.Clean(file)] = true
+	}
+
+	for _, file := range files {
+		f := filepath.Join(p.Buildpack.Root, file)
+
+		stat, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+
+		if stat.IsDir() {
+			continue
+		}
+
+		b, ok, err := shellScriptContent(f)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		for _, line := range strings.Split(string(b), "\n") {
+			ref, substituted, ok := sourcedFile(line)
+			if !ok || included[filepath.Join(filepath.Dir(file), ref)] || included[ref] {
+				continue
+			}
+
+			if substituted {
+				ref = filepath.Join(filepath.Dir(file), ref)
+			}
+
+			if p.Strict {
+				return fmt.Errorf("%s sources %s, which is not included", file, ref)
+			}
+
+			p.warn("%s sources %s, which is not included", file, ref)
+		}
+	}
+
+	return nil
+}
+
+func (p Packager) checkStackCoverage(deps Dependencies) error {
+	if len(deps) == 0 {
+		return nil
+	}
+
+	for _, stack := range p.Buildpack.Stacks {
+		covered := false
+		for _, dep := range deps {
+			if dep.Stacks.contains(stack.ID) {
+				covered = true
+				break
+			}
+		}
+
+		if covered {
+			continue
+		}
+
+		if p.Strict {
+			return fmt.Errorf("stack %s has no dependency coverage", stack.ID)
+		}
+
+		p.warn("stack %s has no dependency coverage", stack.ID)
+	}
+
+	return nil
+}
+
+// checkStream returns an error if the options are incompatible with streaming the archive, so that packaging fails
+// before the pre-package script is run and dependencies are resolved.
+func (p Packager) checkStream() error {
+	for _, format := range p.formats() {
+		if format != FormatTarGz {
+			return fmt.Errorf("format %s cannot be streamed", format)
+		}
+	}
+
+	if p.Index || p.Signer != nil {
+		return fmt.Errorf("index and signature require an archive file and cannot be streamed")
+	}
+
+	if p.DeltaFrom != "" {
+		return fmt.Errorf("delta packaging cannot be combined with streaming")
+	}
+
+	if p.SplitSize > 0 {
+		return fmt.Errorf("split packaging cannot be combined with streaming")
+	}
+
+	return nil
+}
+
+// checkURIVariables warns about, or if Strict is set returns an error for, each dependency uri that references an
+// undefined environment variable.  Variables are expanded only when the artifact is downloaded, so an undefined
+// variable expands to empty.
+func (p Packager) checkURIVariables(deps Dependencies) error {
+	for _, dep := range deps {
+		var undefined []string
+
+		os.Expand(dep.URI, func(name string) string {
+			if _, ok := os.LookupEnv(name); !ok {
+				undefined = append(undefined, name)
+			}
+			return ""
+		})
+
+		if len(undefined) == 0 {
+			continue
+		}
+
+		if p.Strict {
+			return fmt.Errorf("dependency uri %s references undefined environment variables %s", dep.URI, undefined)
+		}
+
+		p.warn("dependency uri %s references undefined environment variables %s", dep.URI, undefined)
+	}
+
+	return nil
+}
+
+func (p Packager) copyBufferSize() int {
+	if p.CopyBufferSize <= 0 {
+		return DefaultCopyBufferSize
+	}
+
+	return p.CopyBufferSize
+}
+
+// create creates a new buildpack package, as Create does, stopping if ctx is done.
+func (p Packager) create(ctx context.Context) error {
+	if p.PlanFormat != "" {
+		plan, err := p.Plan()
+		if err != nil {
+			return err
+		}
+
+		return plan.Write(os.Stdout, p.PlanFormat)
+	}
+
+	_, err := p.pack(ctx)
+	return err
+}
+
+func (p Packager) createArchive(archive string, files []string, sources map[string]string) (string, error) {
+	p.Logger.FirstLine("Creating archive %s", archive)
+
+	staging, err := stagingFile(p.TempDir, filepath.Dir(archive), "archive-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(staging.Name())
+
+	p.Logger.Debug("Staging archive in %s", staging.Name())
+
+	index, diffID, err := p.writeArchive(staging, files, sources)
+	staging.Close()
+	if err != nil {
+		return "", err
+	}
+
+	if p.VerifyExtractable {
+		p.Logger.Debug("Verifying archive %s is extractable", staging.Name())
+
+		if err := Extractable(staging.Name()); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.Chmod(staging.Name(), 0644); err != nil {
+		return "", err
+	}
+
+	if err := moveFile(staging.Name(), archive); err != nil {
+		return "", err
+	}
+
+	p.Logger.SubsequentLine("DiffID %s", diffID)
+
+	if !p.Index {
+		return diffID, nil
+	}
+
+	f := archive + ".idx"
+	p.Logger.FirstLine("Writing index %s", f)
+
+	toml, err := internal.ToTomlString(index)
+	if err != nil {
+		return "", err
+	}
+
+	return diffID, WriteToFile(strings.NewReader(toml), f, 0644)
+}
+
+func (p Packager) createDirectory(archive string, files []string, sources map[string]string) (string, error) {
+	dir := strings.TrimSuffix(archive, filepath.Ext(archive))
+	if dir == archive {
+		return "", fmt.Errorf("archive %s has no extension to remove for directory output", archive)
+	}
+
+	p.Logger.FirstLine("Creating directory %s", dir)
+
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+
+	for _, file := range files {
+		name, err := entryName(file)
+		if err != nil {
+			return "", err
+		}
+
+		p.Logger.SubsequentLine("Adding %s", name)
+
+		source := p.source(sources, file)
+
+		stat, err := os.Stat(source)
+		if err != nil {
+			return "", err
+		}
+
+		if stat.IsDir() {
+			err = os.MkdirAll(filepath.Join(dir, filepath.FromSlash(name)), stat.Mode().Perm())
+		} else {
+			err = CopyFile(source, filepath.Join(dir, filepath.FromSlash(name)))
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+func (p Packager) createOCILayer(archive string, files []string, sources map[string]string) (OCILayer, error) {
+	f := strings.TrimSuffix(archive, filepath.Ext(archive))
+	if f == archive {
+		return OCILayer{}, fmt.Errorf("archive %s has no extension to replace for oci layer output", archive)
+	}
+	f += ".layer.tgz"
+
+	p.Logger.FirstLine("Creating OCI layer %s", f)
+
+	staging, err := stagingFile(p.TempDir, filepath.Dir(f), "layer-")
+	if err != nil {
+		return OCILayer{}, err
+	}
+	defer os.Remove(staging.Name())
+
+	p.Logger.Debug("Staging layer in %s", staging.Name())
+
+	digest := sha256.New()
+	diffID := sha256.New()
+
+	gw := gzip.NewWriter(io.MultiWriter(staging, digest))
+	if p.Reproducible {
+		gw.Header = gzip.Header{OS: gw.Header.OS}
+	}
+
+	info := p.Buildpack.Info
+	prefix := []string{"cnb", "buildpacks", strings.Replace(info.ID, "/", "_", -1), info.Version}
+
+	_, err = p.writeTar(io.MultiWriter(gw, diffID), files, sources, prefix...)
+	if err == nil {
+		err = gw.Close()
+	}
+	staging.Close()
+	if err != nil {
+		return OCILayer{}, err
+	}
+
+	stat, err := os.Stat(staging.Name())
+	if err != nil {
+		return OCILayer{}, err
+	}
+
+	if err := os.Chmod(staging.Name(), 0644); err != nil {
+		return OCILayer{}, err
+	}
+
+	if err := moveFile(staging.Name(), f); err != nil {
+		return OCILayer{}, err
+	}
+
+	layer := OCILayer{
+		Path:      f,
+		MediaType: OCILayerMediaType,
+		Digest:    "sha256:" + hex.EncodeToString(digest.Sum(nil)),
+		DiffID:    "sha256:" + hex.EncodeToString(diffID.Sum(nil)),
+		Size:      stat.Size(),
+	}
+
+	p.Logger.SubsequentLine("Digest %s, diffID %s", layer.Digest, layer.DiffID)
+	return layer, nil
+}
+
+func (p Packager) createTar(archive string, files []string, sources map[string]string) (string, error) {
+	f := strings.TrimSuffix(archive, filepath.Ext(archive))
+	if f == archive {
+		return "", fmt.Errorf("archive %s has no extension to replace for tar output", archive)
+	}
+	f += ".tar"
+
+	p.Logger.FirstLine("Creating archive %s", f)
+
+	staging, err := stagingFile(p.TempDir, filepath.Dir(f), "archive-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(staging.Name())
+
+	p.Logger.Debug("Staging archive in %s", staging.Name())
+
+	_, err = p.writeTar(staging, files, sources)
+	staging.Close()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Chmod(staging.Name(), 0644); err != nil {
+		return "", err
+	}
+
+	return f, moveFile(staging.Name(), f)
+}
+
+func (p Packager) createZip(archive string, files []string, sources map[string]string) (string, error) {
+	f := strings.TrimSuffix(archive, filepath.Ext(archive))
+	if f == archive {
+		return "", fmt.Errorf("archive %s has no extension to replace for zip output", archive)
+	}
+	f += ".zip"
+
+	p.Logger.FirstLine("Creating archive %s", f)
+
+	staging, err := stagingFile(p.TempDir, filepath.Dir(f), "archive-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(staging.Name())
+
+	p.Logger.Debug("Staging archive in %s", staging.Name())
+
+	zw := zip.NewWriter(staging)
+
+	buf := make([]byte, p.copyBufferSize())
+	for _, file := range files {
+		if err := p.addZipFile(zw, file, p.source(sources, file), buf); err != nil {
+			staging.Close()
+			return "", err
+		}
+	}
+
+	err = zw.Close()
+	staging.Close()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Chmod(staging.Name(), 0644); err != nil {
+		return "", err
+	}
+
+	return f, moveFile(staging.Name(), f)
+}
+
+func (p Packager) deduplicate(files []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+
+	for _, file := range files {
+		f := filepath.Clean(file)
+
+		if seen[f] {
+			p.Logger.SubsequentLine("%s duplicate entry %s", color.YellowString("Ignoring"), file)
+			continue
+		}
+
+		seen[f] = true
+		unique = append(unique, f)
+	}
+
+	return unique
+}
+
+// builder returns the builder.toml for the archive, without its buildpack URI, with the unset fields of Builder
+// defaulted from the buildpack's stack.
+func (p Packager) builder(stream io.Writer) (BuilderDescriptor, error) {
+	if stream != nil {
+		return BuilderDescriptor{}, fmt.Errorf("builder packaging cannot be combined with streaming")
+	}
+
+	tgz := false
+	for _, f := range p.formats() {
+		tgz = tgz || f == FormatTarGz
+	}
+	if !tgz {
+		return BuilderDescriptor{}, fmt.Errorf("builder packaging requires %s output", FormatTarGz)
+	}
+
+	stack := *p.Builder
+	if len(p.Buildpack.Stacks) == 1 {
+		s := p.Buildpack.Stacks[0]
+
+		if stack.ID == "" {
+			stack.ID = s.ID
+		}
+		if stack.BuildImage == "" && len(s.BuildImages) > 0 {
+			stack.BuildImage = s.BuildImages[0]
+		}
+		if stack.RunImage == "" && len(s.RunImages) > 0 {
+			stack.RunImage = s.RunImages[0]
+		}
+	}
+
+	if stack.ID == "" || stack.BuildImage == "" || stack.RunImage == "" {
+		return BuilderDescriptor{}, fmt.Errorf("builder requires a stack id, build image, and run image: %+v", stack)
+	}
+
+	info := p.Buildpack.Info
+	return BuilderDescriptor{
+		Buildpacks: []BuilderBuildpack{{ID: info.ID}},
+		Order:      []BuilderGroup{{Group: []BuilderReference{{ID: info.ID, Version: info.Version}}}},
+		Stack:      stack,
+	}, nil
+}
+
+// cache returns the dependency cache, with a retry budget shared by all of its downloads if RetryBudget is set.  If it
+// is a Cache, its downloads are limited to MaxDownloadBytesPerSecond, it is pinned to digest if PinToDigest is set, the
+// layers it accesses from now on are not evicted by this run, and if its root is not writable, it is used read-only
+// when Offline is set, and is otherwise an error.
+func (p Packager) cache() (DependencyCache, error) {
+	c, ok := p.Cache.(Cache)
+	if !ok {
+		return p.Cache, nil
+	}
+
+	if p.retryBudget != nil {
+		c.RetryBudget = p.retryBudget
+	} else if p.RetryBudget > 0 {
+		c.RetryBudget = NewRetryBudget(p.RetryBudget)
+	}
+
+	if p.MaxDownloadBytesPerSecond > 0 {
+		c.MaxDownloadBytesPerSecond = p.MaxDownloadBytesPerSecond
+	}
+
+	if p.PinToDigest {
+		c.PinToDigest = true
+	}
+
+	if c.RunStart.IsZero() {
+		c.RunStart = time.Now()
+	}
+
+	writable, err := writableDir(c.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !writable && !p.Offline {
+		return nil, fmt.Errorf("cache root %s is not writable, which downloading dependencies requires; set Offline "+
+			"to package using only the dependencies already cached", c.Root)
+	}
+
+	if !writable {
+		p.Logger.FirstLine("Using read-only cache %s", c.Root)
+		c.ReadOnly = true
+	}
+
+	return c, nil
+}
+
+// cacheDependencies caches the artifact of each dependency, appending how long each took to timings, and returns the
+// dependencies and the archive entries for the artifacts and their metadata.  Dependencies that select files from their
+// artifact are extracted into work.  Entries for dependencies with a destination are not below the buildpack root, so
+// the returned sources map those entries to the cached files they are read from.  Caching stops if ctx is done.
+func (p Packager) cacheDependencies(ctx context.Context, work string,
+	timings *[]DependencyTiming) (Dependencies, []string, map[string]string, error) {
+	var files []string
+	sources := make(map[string]string)
+
+	deps, err := p.dependencies()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := p.checkDependencies(deps); err != nil {
+		return nil, nil, nil, err
+	}
+
+	cache, err := p.cache()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, dep := range deps {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+
+		p.Logger.FirstLine("Caching %s", p.Logger.PrettyVersion(dep))
+
+		layer := cache.ArtifactLayer(dep)
+
+		start := time.Now()
+		a, err := layer.Artifact()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		*timings = append(*timings, p.timing(dep, layer, time.Since(start)))
+
+		if err := p.verifyArtifact(dep, a); err != nil {
+			return nil, nil, nil, err
+		}
+
+		if len(dep.Select) > 0 {
+			selected, err := p.selectFiles(dep, a, filepath.Join(work, dep.SHA256))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			var names []string
+			for file, source := range selected {
+				sources[file] = source
+				names = append(names, file)
+			}
+
+			sort.Strings(names)
+			files = append(files, names...)
+
+			continue
+		}
+
+		metadataSource := layer.MetadataPath()
+		if len(p.MetadataFields) > 0 || p.MetadataTransform != nil {
+			dir := filepath.Join(work, "metadata", dep.SHA256)
+			if metadataSource, err = p.rewriteMetadata(dep, metadataSource, dir); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+
+		if dep.Destination != "" {
+			artifact := filepath.Join(dep.Destination, filepath.Base(a))
+			metadata := filepath.Join(dep.Destination, filepath.Base(layer.MetadataPath()))
+
+			sources[artifact] = a
+			sources[metadata] = metadataSource
+
+			files = append(files, artifact, metadata)
+			continue
+		}
+
+		artifact, err := filepath.Rel(p.Buildpack.Root, a)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		metadata, err := filepath.Rel(p.Buildpack.Root, layer.MetadataPath())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		sources[artifact] = a
+		sources[metadata] = metadataSource
+
+		files = append(files, artifact, metadata)
+	}
+
+	return deps, files, sources, nil
+}
+
+// descriptorFiles generates the buildpack.toml of the buildpack, if it is included and DependencyFiles is set, with the
+// dependencies of the dependency files merged into its inline dependencies, so that build and detect see them without
+// reading the dependency files.  Keys of the dependency files that Dependency does not represent are not kept.
+func (p Packager) descriptorFiles(work string, sources map[string]string, included []string) error {
+	if len(p.Buildpack.DependencyFiles) == 0 || !containsPath(included, "buildpack.toml") {
+		return nil
+	}
+
+	d, err := p.Buildpack.Descriptor()
+	if err != nil {
+		return err
+	}
+
+	var inline Dependencies
+	for _, dep := range d.Metadata.Dependencies {
+		inline = append(inline, dep.Dependency)
+	}
+
+	merged, err := p.Buildpack.fileDependencies(inline)
+	if err != nil {
+		return err
+	}
+
+	for _, dep := range merged[len(inline):] {
+		d.Metadata.Dependencies = append(d.Metadata.Dependencies, DescriptorDependency{Dependency: dep})
+	}
+
+	f := filepath.Join(work, "generated", "buildpack.toml")
+	p.Logger.FirstLine("Generating buildpack.toml")
+
+	if err := d.Write(f); err != nil {
+		return err
+	}
+
+	sources["buildpack.toml"] = f
+	return nil
+}
+
+// dependencies returns the buildpack's dependencies that are packaged for the selected arch, checked against the
+// dependency policy and sorted by id and version.
+func (p Packager) dependencies() (Dependencies, error) {
+	if err := p.checkCatalogHTTPS(); err != nil {
+		return nil, err
+	}
+
+	deps, err := p.Buildpack.Dependencies()
+	if err != nil {
+		return nil, err
+	}
+
+	if deps, err = p.overrideDependencies(deps); err != nil {
+		return nil, err
+	}
+
+	if p.Arch != "" {
+		deps = deps.ForArch(p.Arch)
+	}
+
+	if len(p.Groups) > 0 {
+		deps = deps.ForGroups(p.Groups)
+	}
+
+	variant, err := p.Buildpack.variantSelection(p.Variant)
+	if err != nil {
+		return nil, err
+	}
+	deps = variant.filterDependencies(deps)
+
+	if err := p.checkPolicy(deps); err != nil {
+		return nil, err
+	}
+
+	if err := p.checkHTTPS(deps); err != nil {
+		return nil, err
+	}
+
+	deps.sortByID()
+
+	if p.PinToDigest {
+		deps = deps.uniqueByDigest()
+	}
+
+	return deps, nil
+}
+
+// excludeFiles returns the files that do not match any of the Excludes.
+func (p Packager) excludeFiles(files []string) ([]string, error) {
+	if len(p.Excludes) == 0 {
+		return files, nil
+	}
+
+	var kept []string
+	for _, file := range files {
+		excluded, err := p.excluded(filepath.ToSlash(file))
+		if err != nil {
+			return nil, err
+		}
+
+		if excluded {
+			p.Logger.Debug("Excluding %s", file)
+			continue
+		}
+
+		kept = append(kept, file)
+	}
+
+	return kept, nil
+}
+
+func (p Packager) excluded(file string) (bool, error) {
+	for _, e := range p.Excludes {
+		pattern := strings.TrimSuffix(filepath.ToSlash(e), "/")
+
+		for _, candidate := range append([]string{file}, strings.Split(file, "/")...) {
+			matched, err := path.Match(pattern, candidate)
+			if err != nil {
+				return false, fmt.Errorf("exclude %s is malformed: %s", e, err)
+			}
+
+			if matched {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// delta returns the files whose entries are added or changed relative to the DeltaFrom archive, and a manifest of the
+// entries of that archive that are no longer packaged.
+func (p Packager) delta(files []string, sources map[string]string) ([]string, DeltaManifest, error) {
+	base, _, _, err := readArchive(p.DeltaFrom)
+	if err != nil {
+		return nil, DeltaManifest{}, err
+	}
+
+	packaged := make(map[string]bool, len(files))
+
+	var changed []string
+	for _, file := range files {
+		name, err := entryName(file)
+		if err != nil {
+			return nil, DeltaManifest{}, err
+		}
+
+		source := p.source(sources, file)
+
+		stat, err := os.Stat(source)
+		if err != nil {
+			return nil, DeltaManifest{}, err
+		}
+
+		// The entry is compared as addFile writes it, with symbolic links followed.
+		entry := archiveEntry{mode: int64(stat.Mode())}
+		if stat.IsDir() {
+			name += "/"
+			entry.mode = int64(stat.Mode().Perm())
+			entry.sha256 = hex.EncodeToString(emptySHA256[:])
+		} else if entry.sha256, err = sha256File(source); err != nil {
+			return nil, DeltaManifest{}, err
+		}
+
+		packaged[name] = true
+
+		if e, ok := base[name]; ok && e == entry {
+			p.Logger.Debug("Omitting %s unchanged from %s", name, p.DeltaFrom)
+			continue
+		}
+
+		changed = append(changed, file)
+	}
+
+	manifest := DeltaManifest{Base: filepath.Base(p.DeltaFrom), Removed: []string{}}
+	for name := range base {
+		if !packaged[name] {
+			manifest.Removed = append(manifest.Removed, name)
+		}
+	}
+	sort.Strings(manifest.Removed)
+
+	return changed, manifest, nil
+}
+
+// expandDirectories replaces include entries that are directories with the regular files they contain, recursively.
+// Symbolic links to files are added as the files they point to, and symbolic links to directories are skipped rather
+// than walked.  Empty directories are only kept if IncludeEmptyDirectories is set.  An include entry within one of the
+// written paths is an error, since it would be read while packaging writes it, and written paths found while walking a
+// directory are skipped.
+func (p Packager) expandDirectories(files []string, written []string) ([]string, error) {
+	var expanded []string
+
+	for _, file := range files {
+		root := filepath.Join(p.Buildpack.Root, file)
+
+		if w, ok := within(root, written); ok {
+			return nil, fmt.Errorf("include %s is within %s, which is written by packaging", file, w)
+		}
+
+		stat, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+
+		if !stat.IsDir() {
+			expanded = append(expanded, file)
+			continue
+		}
+
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(p.Buildpack.Root, path)
+			if err != nil {
+				return err
+			}
+
+			if _, ok := within(path, written); ok {
+				p.Logger.SubsequentLine("%s %s, which is written by packaging", color.YellowString("Skipping"), rel)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !p.IncludeHidden && path != root && strings.HasPrefix(info.Name(), ".") {
+				p.Logger.Debug("Skipping hidden %s", rel)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if info.Mode()&os.ModeSymlink != 0 {
+				target, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+
+				if target.IsDir() {
+					p.Logger.Debug("Skipping linked directory %s", rel)
+					return nil
+				}
+			}
+
+			if !info.IsDir() {
+				expanded = append(expanded, rel)
+				return nil
+			}
+
+			if !p.IncludeEmptyDirectories {
+				return nil
+			}
+
+			contents, err := ioutil.ReadDir(path)
+			if err != nil {
+				return err
+			}
+
+			if len(contents) == 0 {
+				expanded = append(expanded, rel)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return expanded, nil
+}
+
+// writtenPaths returns the paths that packaging writes to: the cache root and, unless the archive is streamed, the
+// output directory.
+func (p Packager) writtenPaths(dir string, stream io.Writer) []string {
+	written := []string{p.Buildpack.CacheRoot}
+
+	if stream == nil {
+		written = append(written, dir)
+	}
+
+	return written
+}
+
+// rewriteMetadata writes a copy of the metadata file of a dependency into dir that contains only the keys in
+// MetadataFields, if set, and has been passed through MetadataTransform, if set, and returns its path.
+func (p Packager) rewriteMetadata(dep Dependency, metadata string, dir string) (string, error) {
+	var m map[string]interface{}
+	if err := FromTomlFile(metadata, &m); err != nil {
+		return "", err
+	}
+
+	if len(p.MetadataFields) > 0 {
+		filtered := make(map[string]interface{})
+		for _, k := range p.MetadataFields {
+			if v, ok := m[k]; ok {
+				filtered[k] = v
+			}
+		}
+		m = filtered
+	}
+
+	if p.MetadataTransform != nil {
+		if err := p.MetadataTransform(dep, m); err != nil {
+			return "", fmt.Errorf("dependency %s %s metadata transform failed: %s", dep.ID, dep.Version.Original(), err)
+		}
+	}
+
+	toml, err := internal.ToTomlString(m)
+	if err != nil {
+		return "", err
+	}
+
+	f := filepath.Join(dir, filepath.Base(metadata))
+	return f, WriteToFile(strings.NewReader(toml), f, 0644)
+}
+
+// filename renders FilenameTemplate, with the snapshot of a snapshot version replaced by the current timestamp.  Only
+// the rendered version is substituted, so a snapshot elsewhere in the filename, such as in the id, is kept.
+func (p Packager) filename(now time.Time) (string, error) {
+	template := p.FilenameTemplate
+	if template == "" {
+		template = "{id}-{version}.tgz"
+	}
+
+	if strings.Contains(template, "{stack}") {
+		if len(p.Buildpack.Stacks) != 1 {
+			return "", fmt.Errorf("filename template %s requires exactly one buildpack stack", template)
+		}
+		template = strings.Replace(template, "{stack}", p.Buildpack.Stacks[0].ID, -1)
+	}
+
+	version := p.Buildpack.Info.Version
+	if l := snapshot.FindStringIndex(version); l != nil && strings.Contains(template, "{version}") {
+		version = version[:l[0]] + fmt.Sprintf("%s-1", now.Format("20060102.150405")) + version[l[1]:]
+	} else if l != nil {
+		p.warn("version %s is a snapshot but filename template %s has no {version} to substitute", version, template)
+	}
+
+	f := strings.NewReplacer(
+		"{id}", p.Buildpack.Info.ID,
+		"{version}", version,
+		"{date}", now.Format("20060102"),
+	).Replace(template)
+
+	if f == "" || f == "." || f == ".." || strings.ContainsAny(f, "/\\{}") {
+		return "", fmt.Errorf("filename template %s renders unsafe filename %s", template, f)
+	}
+
+	return f, nil
+}
+
+func (p Packager) formats() []Format {
+	if len(p.Formats) == 0 {
+		return []Format{FormatTarGz}
+	}
+
+	return p.Formats
+}
+
+// generate writes a file generated while packaging into work and maps its archive entry to it in sources, so that the
+// buildpack root is never modified.
+func (p Packager) generate(work string, sources map[string]string, name string, content io.Reader) ([]string, error) {
+	f := filepath.Join(work, "generated", name)
+	p.Logger.FirstLine("Generating %s", name)
+
+	if err := WriteToFile(content, f, 0644); err != nil {
+		return nil, err
+	}
+
+	sources[name] = f
+	return []string{name}, nil
+}
+
+// gitCommitTime returns the commit time of HEAD of the buildpack root, or the zero time if it is not a git checkout.
+func (p Packager) gitCommitTime() time.Time {
+	cmd := exec.Command("git", "log", "-1", "--format=%ct", "HEAD")
+	cmd.Dir = p.Buildpack.Root
+
+	out, err := cmd.Output()
+	if err != nil {
+		p.warn("%s is not a git checkout, using file modification times", p.Buildpack.Root)
+		return time.Time{}
+	}
+
+	seconds, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		p.warn("commit time %q of %s is malformed, using file modification times", out, p.Buildpack.Root)
+		return time.Time{}
+	}
+
+	p.Logger.Debug("Using commit time %d of %s", seconds, p.Buildpack.Root)
+	return time.Unix(seconds, 0)
+}
+
+// includeFiles returns the include_files buildpack metadata, merged with or replaced by the files listed in
+// IncludeFilesList.
+func (p Packager) includeFiles() ([]string, error) {
+	var files []string
+	if !p.ReplaceIncludeFiles || p.IncludeFilesList == "" {
+		var err error
+		if files, err = p.Buildpack.IncludeFiles(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.IncludeFilesList == "" {
+		return files, nil
+	}
+
+	list := p.IncludeFilesList
+	if !filepath.IsAbs(list) {
+		list = filepath.Join(p.Buildpack.Root, list)
+	}
+
+	b, err := ioutil.ReadFile(list)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		file := strings.TrimSpace(line)
+		if file == "" {
+			continue
+		}
+
+		exists, err := FileExists(filepath.Join(p.Buildpack.Root, file))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("%s listed in %s does not exist", file, p.IncludeFilesList)
+		}
+
+		files = append(files, file)
+	}
+
+	p.Logger.Debug("Include files: %s", files)
+	return files, nil
+}
+
+func (p Packager) logDescriptor() error {
+	if !p.Logger.IsDebugEnabled() {
+		return nil
+	}
+
+	f := filepath.Join(p.Buildpack.Root, "buildpack.toml")
+
+	exists, err := FileExists(f)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		p.Logger.Debug("Descriptor %s does not exist", f)
+		return nil
+	}
+
+	sha256, err := sha256File(f)
+	if err != nil {
+		return err
+	}
+
+	p.Logger.Debug("Descriptor %s sha256 %s", f, sha256)
+	return nil
+}
+
+// modTime returns the modification time of an archive entry whose file was modified at a time.
+func (p Packager) modTime(file time.Time) time.Time {
+	if !p.commitTime.IsZero() {
+		return p.commitTime
+	}
+
+	if p.Reproducible {
+		return time.Unix(0, 0)
+	}
+
+	return file
+}
+
+func (p Packager) now() time.Time {
+	if p.Clock != nil {
+		return p.Clock()
+	}
+
+	return time.Now()
+}
+
+func (p Packager) orderFiles() ([]string, error) {
+	p.Logger.FirstLine("Validating composite order")
+
+	order, err := p.Buildpack.Order()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+
+	return []string{"order.toml"}, nil
+}
+
+func (p Packager) outputDir() (string, error) {
+	if p.OutputDir != "" {
+		return p.OutputDir, nil
+	}
+
+	dir, err := osArgs(1)
+	if err != nil || dir == "" {
+		name := "package"
+		if len(os.Args) > 0 {
+			name = filepath.Base(os.Args[0])
+		}
+		return "", fmt.Errorf("usage: %s <output-dir>", name)
+	}
+
+	return dir, nil
+}
+
+func (p Packager) overrideDependencies(deps Dependencies) (Dependencies, error) {
+	for i, dep := range deps {
+		o, ok := p.DependencyOverrides[dep.ID]
+		if !ok {
+			continue
+		}
+
+		if o.URI != "" {
+			dep.URI = o.URI
+		}
+
+		if o.Version != "" {
+			v, err := semver.NewVersion(o.Version)
+			if err != nil {
+				return nil, fmt.Errorf("override version %s of dependency %s is malformed: %s", o.Version, dep.ID, err)
+			}
+			dep.Version = Version{v}
+		}
+
+		if o.SHA256 != "" {
+			dep.SHA256 = o.SHA256
+		}
+
+		p.Logger.FirstLine("%s %s: uri %s, sha256 %s", color.YellowString("Overriding"),
+			p.Logger.PrettyVersion(dep), dep.URI, dep.SHA256)
+
+		deps[i] = dep
+	}
+
+	return deps, nil
+}
+
+// pack creates a new buildpack package, as Package does, stopping if ctx is done.
+func (p Packager) pack(ctx context.Context) (Report, error) {
+	var dir string
+	var err error
+
+	stream := p.ArchiveWriter
+	if stream == nil {
+		if dir, err = p.outputDir(); err != nil {
+			return Report{}, err
+		}
+
+		if dir == "-" {
+			stream = os.Stdout
+		}
+	}
+
+	if stream != nil {
+		if err := p.checkStream(); err != nil {
+			return Report{}, err
+		}
+	}
+
+	if p.VerifyReproducible {
+		p.Reproducible = true
+	}
+
+	p.Logger.FirstLine("Packaging %s", p.Logger.PrettyVersion(p.Buildpack))
+	p.Logger.Debug("Configuration: %s", p)
+
+	if p.ModTimeSource == ModTimeSourceGitCommit {
+		p.commitTime = p.gitCommitTime()
+	}
+
+	if err := p.checkAnnotations(); err != nil {
+		return Report{}, err
+	}
+
+	if p.EntryAlignment%tarBlockSize != 0 {
+		return Report{}, fmt.Errorf("entry alignment %d is not a multiple of %d", p.EntryAlignment, tarBlockSize)
+	}
+
+	var builder BuilderDescriptor
+	if p.Builder != nil {
+		if builder, err = p.builder(stream); err != nil {
+			return Report{}, err
+		}
+	}
+
+	if err := p.logDescriptor(); err != nil {
+		return Report{}, err
+	}
+
+	if !p.prePackaged {
+		if err := p.prePackage(ctx, prePackageOut(stream)); err != nil {
+			return Report{}, err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return Report{}, err
+	}
+
+	includedFiles, err := p.selectIncludeFiles(p.writtenPaths(dir, stream))
+	if err != nil {
+		return Report{}, err
+	}
+
+	composite, err := p.Buildpack.Composite()
+	if err != nil {
+		return Report{}, err
+	}
+
+	work, err := ioutil.TempDir(p.TempDir, "package-")
+	if err != nil {
+		return Report{}, err
+	}
+	defer os.RemoveAll(work)
+
+	var deps Dependencies
+	var files []string
+	sources := make(map[string]string)
+	var timings []DependencyTiming
+	if composite {
+		files, err = p.orderFiles()
+	} else {
+		deps, files, sources, err = p.cacheDependencies(ctx, work, &timings)
+	}
+	if err != nil {
+		return Report{}, err
+	}
+
+	p.dependencyFiles = make(map[string]bool, len(files))
+	if !composite {
+		for _, file := range files {
+			p.dependencyFiles[file] = true
+		}
+	}
+
+	usage, err := p.usageFiles(work, deps, sources)
+	if err != nil {
+		return Report{}, err
+	}
+	files = append(files, usage...)
+
+	marker, err := p.versionMarkerFiles(work, sources)
+	if err != nil {
+		return Report{}, err
+	}
+	files = append(files, marker...)
+
+	stacks, err := p.stacksFiles(work, sources)
+	if err != nil {
+		return Report{}, err
+	}
+	files = append(files, stacks...)
+
+	if err := p.descriptorFiles(work, sources, includedFiles); err != nil {
+		return Report{}, err
+	}
+
+	files = p.deduplicate(append(includedFiles, files...))
+
+	if p.EntryOrder == EntryOrderByNameASCII {
+		if err := p.sortByEntryName(files, sources); err != nil {
+			return Report{}, err
+		}
+	}
+
+	var delta DeltaManifest
+	if p.DeltaFrom != "" {
+		if files, delta, err = p.delta(files, sources); err != nil {
+			return Report{}, err
+		}
+	}
+
+	if p.VerifyReproducible {
+		if err := p.verifyReproducible(files, sources); err != nil {
+			return Report{}, err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return Report{}, err
+	}
+
+	if stream != nil {
+		return Report{}, p.streamArchive(stream, files, sources)
+	}
+
+	archive, err := p.archivePath(dir)
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := Report{Dependencies: deps, Timings: timings}
+	for i := range report.Dependencies {
+		report.Dependencies[i].PURL = report.Dependencies[i].PackageURL()
+	}
+
+	for _, format := range p.formats() {
+		switch format {
+		case FormatDirectory:
+			report.Directory, err = p.createDirectory(archive, files, sources)
+		case FormatTar:
+			report.Tar, err = p.createTar(archive, files, sources)
+		case FormatTarGz:
+			report.DiffID, err = p.createArchive(archive, files, sources)
+			if err == nil {
+				report.Archive = archive
+				if p.Index {
+					report.Index = archive + ".idx"
+				}
+				report.Signature, err = p.sign(archive)
+			}
+			if err == nil && p.SplitSize > 0 {
+				report.Parts, err = p.split(archive)
+			}
+		case FormatOCILayer:
+			report.OCILayer, err = p.createOCILayer(archive, files, sources)
+		case FormatZip:
+			report.Zip, err = p.createZip(archive, files, sources)
+		default:
+			err = fmt.Errorf("unsupported format %s", format)
+		}
+
+		if err != nil {
+			return Report{}, err
+		}
+	}
+
+	if p.Builder != nil {
+		report.Builder = archive + ".builder.toml"
+		p.Logger.FirstLine("Writing builder %s", report.Builder)
+
+		builder.Buildpacks[0].URI = filepath.Base(archive)
+
+		toml, err := internal.ToTomlString(builder)
+		if err != nil {
+			return Report{}, err
+		}
+
+		if err := WriteToFile(strings.NewReader(toml), report.Builder, 0644); err != nil {
+			return Report{}, err
+		}
+	}
+
+	if p.DeltaFrom != "" {
+		report.Delta = archive + ".delta.toml"
+		p.Logger.FirstLine("Writing delta manifest %s", report.Delta)
+
+		toml, err := internal.ToTomlString(delta)
+		if err != nil {
+			return Report{}, err
+		}
+
+		if err := WriteToFile(strings.NewReader(toml), report.Delta, 0644); err != nil {
+			return Report{}, err
+		}
+	}
+
+	return report, nil
+}
+
+func (p Packager) prePackageExists(pp string) (bool, error) {
+	if !strings.ContainsRune(pp, filepath.Separator) {
+		if _, err := exec.LookPath(pp); err == nil {
+			return true, nil
+		}
+	}
+
+	if !filepath.IsAbs(pp) {
+		pp = filepath.Join(p.Buildpack.Root, pp)
+	}
+
+	return FileExists(pp)
+}
+
+func (p Packager) prePackage(ctx context.Context, stdout io.Writer) error {
+	pp, ok := p.Buildpack.PrePackage()
+	if !ok {
+		return nil
+	}
+
+	if p.Buildpack.PrePackageOptional() {
+		exists, err := p.prePackageExists(pp)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			p.warn("optional pre-package %s is not present, skipping", pp)
+			return nil
+		}
+	}
+
+	var cached string
+	if len(p.PrePackageInputs) > 0 && p.Buildpack.CacheRoot != "" {
+		inputs, err := p.prePackageInputs(pp)
+		if err != nil {
+			return err
+		}
+
+		cached = filepath.Join(p.prePackageCache(), inputs)
+
+		exists, err := FileExists(cached)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			p.Logger.FirstLine("%s pre-package output with unchanged inputs", color.GreenString("Restoring"))
+			return CopyDirectory(cached, p.Buildpack.Root)
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, pp)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = p.Buildpack.Root
+
+	p.Logger.FirstLine("Pre-Package with %s", strings.Join(cmd.Args, " "))
+
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	if cached == "" {
+		return nil
+	}
+
+	return p.cachePrePackageOutputs(cached)
+}
+
+// prePackageCache returns the directory that the outputs of the pre-package script are cached in for the variant.
+func (p Packager) prePackageCache() string {
+	variant := p.Variant
+	if variant == "" {
+		variant = VariantFull
+	}
+
+	return filepath.Join(p.Buildpack.CacheRoot, "pre-package", string(variant))
+}
+
+// cachePrePackageOutputs copies the files matching PrePackageOutputs into dir, replacing the outputs cached for other
+// inputs of the variant.  The outputs are staged and then moved into place, so that partial outputs are never restored.
+func (p Packager) cachePrePackageOutputs(dir string) error {
+	parent := filepath.Dir(dir)
+	if err := os.RemoveAll(parent); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	staging, err := ioutil.TempDir(parent, "staging-")
+	if err != nil {
+		return err
+	}
+
+	for _, pattern := range p.PrePackageOutputs {
+		matches, err := filepath.Glob(filepath.Join(p.Buildpack.Root, pattern))
+		if err != nil {
+			return fmt.Errorf("pre-package output %s is malformed: %s", pattern, err)
+		}
+
+		for _, m := range matches {
+			rel, err := filepath.Rel(p.Buildpack.Root, m)
+			if err != nil {
+				return err
+			}
+
+			stat, err := os.Stat(m)
+			if err != nil {
+				return err
+			}
+
+			dest := filepath.Join(staging, rel)
+			if !stat.IsDir() {
+				if err := CopyFile(m, dest); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := os.MkdirAll(dest, stat.Mode()); err != nil {
+				return err
+			}
+
+			if err := CopyDirectory(m, dest); err != nil {
+				return err
+			}
+		}
+	}
+
+	return os.Rename(staging, dir)
+}
+
+// prePackageInputs returns the sha256 of the pre_package command and the names and content of the files matching
+// PrePackageInputs.
+func (p Packager) prePackageInputs(pp string) (string, error) {
+	var files []string
+	for _, pattern := range p.PrePackageInputs {
+		matches, err := filepath.Glob(filepath.Join(p.Buildpack.Root, pattern))
+		if err != nil {
+			return "", fmt.Errorf("pre-package input %s is malformed: %s", pattern, err)
+		}
+
+		for _, m := range matches {
+			err := filepath.Walk(m, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if info.Mode().IsRegular() {
+					files = append(files, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	sort.Strings(files)
+
+	s := sha256.New()
+	fmt.Fprintf(s, "%s\x00", pp)
+
+	for _, f := range files {
+		rel, err := filepath.Rel(p.Buildpack.Root, f)
+		if err != nil {
+			return "", err
+		}
+
+		in, err := os.Open(f)
+		if err != nil {
+			return "", err
+		}
+
+		// Each file is written as its name and size ahead of its content so that distinct inputs cannot collide.
+		stat, err := in.Stat()
+		if err == nil {
+			fmt.Fprintf(s, "%s\x00%d\x00", filepath.ToSlash(rel), stat.Size())
+			_, err = io.Copy(s, io.LimitReader(in, stat.Size()))
+		}
+		in.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(s.Sum(nil)), nil
+}
+
+func (p Packager) source(sources map[string]string, file string) string {
+	if s, ok := sources[file]; ok {
+		return s
+	}
+
+	return filepath.Join(p.Buildpack.Root, file)
+}
+
+func (p Packager) selectFiles(dep Dependency, artifact string, dir string) (map[string]string, error) {
+	p.Logger.SubsequentLine("Selecting %s from %s", strings.Join(dep.Select, ", "), filepath.Base(artifact))
+
+	var err error
+	switch {
+	case strings.HasSuffix(artifact, ".zip") || strings.HasSuffix(artifact, ".jar"):
+		err = ExtractZip(artifact, dir, 0)
+	case strings.HasSuffix(artifact, ".tar.gz") || strings.HasSuffix(artifact, ".tgz"):
+		err = ExtractTarGz(artifact, dir, 0)
+	default:
+		err = fmt.Errorf("dependency %s artifact %s cannot be extracted", dep.ID, filepath.Base(artifact))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]string)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		ok, err := matchesAny(dep.Select, filepath.ToSlash(rel))
+		if ok {
+			selected[filepath.Join(dep.Destination, rel)] = path
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("dependency %s select %s matched no files", dep.ID, strings.Join(dep.Select, ", "))
+	}
+
+	return selected, nil
+}
+
+// selectIncludeFiles returns the include files that are packaged, expanded, filtered by the variant and the excludes,
+// and checked, skipping the written paths.
+func (p Packager) selectIncludeFiles(written []string) ([]string, error) {
+	files, err := p.includeFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	if files, err = p.expandDirectories(files, written); err != nil {
+		return nil, err
+	}
+
+	variant, err := p.Buildpack.variantSelection(p.Variant)
+	if err != nil {
+		return nil, err
+	}
+
+	if files, err = p.excludeFiles(variant.filterIncludeFiles(files)); err != nil {
+		return nil, err
+	}
+
+	if err := p.checkRequiredFiles(files); err != nil {
+		return nil, err
+	}
+
+	if err := p.checkScriptReferences(files); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (p Packager) sign(archive string) (string, error) {
+	if p.Signer == nil {
+		return "", nil
+	}
+
+	f := archive + ".sig"
+	p.Logger.FirstLine("Signing archive %s", f)
+
+	in, err := os.Open(archive)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	signature, err := p.Signer.Sign(in)
+	if err != nil {
+		return "", err
+	}
+
+	return f, WriteToFile(bytes.NewReader(signature), f, 0644)
+}
+
+// sortByEntryName sorts the files byte-wise by their archive entry names, which end with a slash for directories.
+func (p Packager) sortByEntryName(files []string, sources map[string]string) error {
+	names := make(map[string]string, len(files))
+	for _, file := range files {
+		stat, err := os.Stat(p.source(sources, file))
+		if err != nil {
+			return err
+		}
+
+		names[file] = filepath.ToSlash(file)
+		if stat.IsDir() {
+			names[file] += "/"
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return names[files[i]] < names[files[j]]
+	})
+
+	return nil
+}
+
+// split writes the archive as parts of at most SplitSize bytes, and a manifest describing them, returning the paths of
+// the parts.
+func (p Packager) split(archive string) ([]string, error) {
+	stat, err := os.Stat(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	count := (stat.Size() + p.SplitSize - 1) / p.SplitSize
+	if count == 0 {
+		count = 1
+	}
+
+	if max := int64(math.Pow10(partIndexWidth)); count > max {
+		return nil, fmt.Errorf("archive %s would be split into %d parts, more than the maximum of %d", archive, count,
+			max)
+	}
+
+	if err := removeParts(archive); err != nil {
+		return nil, err
+	}
+
+	p.Logger.FirstLine("Splitting archive %s into %d parts", archive, count)
+
+	in, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	manifest := PartsManifest{Archive: filepath.Base(archive), Size: stat.Size()}
+	whole := sha256.New()
+
+	var paths []string
+	for i := int64(0); i < count; i++ {
+		f := fmt.Sprintf("%s.part%0*d", archive, partIndexWidth, i)
+		p.Logger.SubsequentLine("Writing %s", filepath.Base(f))
+
+		s := sha256.New()
+		part := io.TeeReader(io.LimitReader(in, p.SplitSize), io.MultiWriter(s, whole))
+		if err := WriteToFile(part, f, 0644); err != nil {
+			return nil, err
+		}
+
+		stat, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Parts = append(manifest.Parts, Part{
+			Name: filepath.Base(f), Size: stat.Size(), SHA256: hex.EncodeToString(s.Sum(nil)),
+		})
+		paths = append(paths, f)
+	}
+
+	manifest.SHA256 = hex.EncodeToString(whole.Sum(nil))
+
+	toml, err := internal.ToTomlString(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, WriteToFile(strings.NewReader(toml), archive+".parts.toml", 0644)
+}
+
+// stacksFiles generates the stacks.toml of the buildpack, listing the stacks declared by buildpack.toml.
+func (p Packager) stacksFiles(work string, sources map[string]string) ([]string, error) {
+	if !p.StacksFile {
+		return nil, nil
+	}
+
+	toml, err := internal.ToTomlString(struct {
+		Stacks libbuildpack.BuildpackStacks `toml:"stacks"`
+	}{p.Buildpack.Stacks})
+	if err != nil {
+		return nil, err
+	}
+
+	return p.generate(work, sources, "stacks.toml", strings.NewReader(toml))
+}
+
+func (p Packager) streamArchive(out io.Writer, files []string, sources map[string]string) error {
+	p.Logger.FirstLine("Streaming archive")
+
+	_, _, err := p.writeArchive(out, files, sources)
+	return err
+}
+
+// timing returns how long the artifact of a dependency took to acquire from a layer, logging it.  Only a
+// DownloadCacheLayer reports the bytes it downloaded, so the artifacts of other layers are treated as reused.
+func (p Packager) timing(dep Dependency, layer ArtifactLayer, elapsed time.Duration) DependencyTiming {
+	t := DependencyTiming{ID: dep.ID, Version: dep.Version.Original(), Seconds: elapsed.Seconds()}
+
+	if l, ok := layer.(DownloadCacheLayer); ok {
+		t.Downloaded = l.Downloaded()
+	}
+
+	if t.Downloaded == 0 {
+		p.Logger.Debug("Reused %s %s in %s", dep.ID, t.Version, elapsed)
+		return t
+	}
+
+	if t.Seconds > 0 {
+		t.BytesPerSecond = float64(t.Downloaded) / t.Seconds
+	}
+
+	p.Logger.SubsequentLine("Downloaded %.1f MB in %s (%.1f MB/s)", float64(t.Downloaded)/1e6,
+		elapsed.Round(time.Millisecond), t.BytesPerSecond/1e6)
+	return t
 }
 
-// Create creates a new buildpack package.
-func (p Packager) Create() error {
-	p.Logger.FirstLine("Packaging %s", p.Logger.PrettyVersion(p.Buildpack))
+// usageFiles generates the USAGE.md of the buildpack, listing the dependencies being packaged.
+func (p Packager) usageFiles(work string, deps Dependencies, sources map[string]string) ([]string, error) {
+	if !p.GenerateUsage {
+		return nil, nil
+	}
+
+	t := p.UsageTemplate
+	if t == "" {
+		t = DefaultUsageTemplate
+	}
+
+	tmpl, err := template.New("usage").Parse(t)
+	if err != nil {
+		return nil, fmt.Errorf("usage template is malformed: %s", err)
+	}
+
+	usage := Usage{Info: p.Buildpack.Info, Stacks: p.Buildpack.Stacks, Dependencies: deps}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, usage); err != nil {
+		return nil, err
+	}
+
+	return p.generate(work, sources, "USAGE.md", &b)
+}
+
+func (p Packager) verifyReproducible(files []string, sources map[string]string) error {
+	p.Logger.FirstLine("Verifying reproducibility")
+
+	var digests [2]string
+	var indices [2]Index
+
+	for i := range digests {
+		s := sha256.New()
+
+		index, _, err := p.writeArchive(s, files, sources)
+		if err != nil {
+			return err
+		}
+
+		digests[i] = hex.EncodeToString(s.Sum(nil))
+		indices[i] = index
+	}
+
+	if digests[0] == digests[1] {
+		return nil
+	}
 
-	if err := p.prePackage(); err != nil {
+	if d, ok := firstDifference(indices[0], indices[1]); ok {
+		return fmt.Errorf("archive is not reproducible: entry %s differs between builds", d)
+	}
+
+	return fmt.Errorf("archive is not reproducible: sha256 %s differs from %s", digests[1], digests[0])
+}
+
+// versionMarkerFiles generates the .bpversion marker of the buildpack.
+func (p Packager) versionMarkerFiles(work string, sources map[string]string) ([]string, error) {
+	if !p.VersionMarker {
+		return nil, nil
+	}
+
+	d, err := p.Buildpack.Descriptor()
+	if err != nil {
+		return nil, err
+	}
+
+	api, ok := d.Custom["api"].(string)
+	if !ok || api == "" {
+		return nil, fmt.Errorf("version marker requires buildpack.toml to declare an api version")
+	}
+
+	marker, err := internal.ToTomlString(map[string]interface{}{"api": api, "version": p.Buildpack.Info.Version})
+	if err != nil {
+		return nil, err
+	}
+
+	return p.generate(work, sources, ".bpversion", strings.NewReader(marker))
+}
+
+func (p Packager) validateDescriptor() error {
+	exists, err := FileExists(filepath.Join(p.Buildpack.Root, "buildpack.toml"))
+	if err != nil {
 		return err
 	}
 
-	includedFiles, err := p.Buildpack.IncludeFiles()
+	if exists {
+		p.Logger.SubsequentLine("Validating descriptor")
+		if _, err := p.Buildpack.Descriptor(); err != nil {
+			return err
+		}
+	}
+
+	composite, err := p.Buildpack.Composite()
 	if err != nil {
 		return err
 	}
 
-	dependencyFiles, err := p.cacheDependencies()
+	if !composite {
+		return nil
+	}
+
+	order, err := p.Buildpack.Order()
 	if err != nil {
 		return err
 	}
 
-	return p.createArchive(append(includedFiles, dependencyFiles...))
+	return order.Validate()
 }
 
-func (p Packager) addFile(out *tar.Writer, path string) error {
-	p.Logger.SubsequentLine("Adding %s", path)
+// verifyArtifact runs the verify command of a dependency against its cached artifact.
+func (p Packager) verifyArtifact(dep Dependency, artifact string) error {
+	if dep.Verify == "" {
+		return nil
+	}
+
+	command := dep.Verify
+	if !filepath.IsAbs(command) {
+		command = filepath.Join(p.Buildpack.Root, command)
+	}
+
+	cmd := exec.Command(command, artifact)
+	cmd.Dir = p.Buildpack.Root
+
+	p.Logger.SubsequentLine("Verifying with %s", strings.Join(cmd.Args, " "))
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("dependency %s %s failed verification with %s: %s\n%s", dep.ID, dep.Version.Original(),
+			dep.Verify, err, out)
+	}
 
-	file, err := os.Open(filepath.Join(p.Buildpack.Root, path))
+	return nil
+}
+
+func (p Packager) verifyDependencies(ctx context.Context) error {
+	deps, err := p.dependencies()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	stat, err := file.Stat()
+	cache, err := p.cache()
 	if err != nil {
 		return err
 	}
 
-	header := new(tar.Header)
-	header.Name = path
-	header.Size = stat.Size()
-	header.Mode = int64(stat.Mode())
-	header.ModTime = stat.ModTime()
+	for _, dep := range deps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-	if err := out.WriteHeader(header); err != nil {
-		return err
+		p.Logger.SubsequentLine("Verifying %s", p.Logger.PrettyVersion(dep))
+
+		a, err := cache.ArtifactLayer(dep).Artifact()
+		if err != nil {
+			return err
+		}
+
+		if dep.SkipChecksum {
+			p.warn("not verifying sha256 of %s, as skip_checksum is set", dep.ID)
+			continue
+		}
+
+		actual, err := sha256File(a)
+		if err != nil {
+			return err
+		}
+
+		if actual != dep.SHA256 {
+			return fmt.Errorf("dependency sha256 mismatch: expected sha256 %s, actual sha256 %s", dep.SHA256, actual)
+		}
 	}
 
-	_, err = io.Copy(out, file)
-	return err
+	return nil
 }
 
-func (p Packager) archivePath() (string, error) {
-	dir, err := osArgs(1)
+// warn logs a warning, and collects it if warnings is set.
+func (p Packager) warn(format string, args ...interface{}) {
+	p.Logger.FirstLine("%s: %s", color.YellowString("Warning"), fmt.Sprintf(format, args...))
+
+	if p.warnings != nil {
+		*p.warnings = append(*p.warnings, fmt.Sprintf(format, args...))
+	}
+}
+
+// writeArchive writes the files as a gzipped tar to out, returning the index of its entries and the digest of the
+// uncompressed tar, in the form sha256:<hex>.
+func (p Packager) writeArchive(out io.Writer, files []string, sources map[string]string) (Index, string, error) {
+	gw := gzip.NewWriter(out)
+	if p.Reproducible {
+		gw.Header = gzip.Header{OS: gw.Header.OS}
+	}
+
+	diffID := sha256.New()
+	index, err := p.writeTar(io.MultiWriter(gw, diffID), files, sources)
 	if err != nil {
-		return "", err
+		return Index{}, "", err
 	}
 
-	info := p.Buildpack.Info
+	return index, "sha256:" + hex.EncodeToString(diffID.Sum(nil)), gw.Close()
+}
 
-	path := []string{dir}
-	path = append(path, strings.Split(info.ID, ".")...)
-	path = append(path, info.ID, info.Version)
+// writeTar writes the files as a tar to out.  If prefix is set, the files are written under it, preceded by an entry
+// for each of its directories.
+func (p Packager) writeTar(out io.Writer, files []string, sources map[string]string, prefix ...string) (Index, error) {
+	var aligner *tarAligner
+	if p.EntryAlignment > 0 {
+		aligner = &tarAligner{alignment: p.EntryAlignment, out: out}
+		out = aligner
+	}
 
-	f := fmt.Sprintf("%s-%s.tgz", info.ID, info.Version)
-	f = strings.Replace(f, "SNAPSHOT", fmt.Sprintf("%s-1", time.Now().Format("20060102.150405")), 1)
+	tw := tar.NewWriter(out)
 
-	path = append(path, f)
+	modTime := p.modTime(time.Now())
 
-	return filepath.Join(path...), nil
+	if p.Provenance != "" {
+		header := &tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			PAXRecords: map[string]string{"comment": p.Provenance},
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return Index{}, err
+		}
+	}
+
+	var index Index
+	for i := range prefix {
+		header := &tar.Header{
+			Name:     strings.Join(prefix[:i+1], "/") + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  modTime,
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return Index{}, err
+		}
+
+		index.Entries = append(index.Entries, IndexEntry{Name: header.Name, Mode: header.Mode})
+	}
+
+	buf := make([]byte, p.copyBufferSize())
+	for _, file := range files {
+		path := file
+		if len(prefix) > 0 {
+			path = strings.Join(append(prefix, filepath.ToSlash(file)), "/")
+		}
+
+		entry, err := p.addFile(tw, path, p.source(sources, file), buf, aligner)
+		if err != nil {
+			return Index{}, err
+		}
+
+		if p.OnFile != nil {
+			p.OnFile(EntryInfo{Name: entry.Name, Size: entry.Size, Dependency: p.dependencyFiles[file]})
+		}
+
+		index.Entries = append(index.Entries, entry)
+	}
+
+	return index, tw.Close()
 }
 
-func (p Packager) createArchive(files []string) error {
-	archive, err := p.archivePath()
-	if err != nil {
+// tarAligner counts the bytes of a tar stream written through it so that entries can be aligned within the stream.
+type tarAligner struct {
+	alignment int64
+	out       io.Writer
+	written   int64
+}
+
+func (t *tarAligner) Write(p []byte) (int, error) {
+	n, err := t.out.Write(p)
+	t.written += int64(n)
+	return n, err
+}
+
+// align writes PAX global headers to out so that the content of the entry described by header starts on a multiple of
+// alignment.
+func (t *tarAligner) align(out *tar.Writer, header *tar.Header) error {
+	if err := out.Flush(); err != nil {
 		return err
 	}
 
-	p.Logger.FirstLine("Creating archive %s", archive)
+	// The size of the entry's header blocks, including any extended header, is found by writing it to a scratch stream.
+	size := &tarAligner{out: ioutil.Discard}
+	if err := tar.NewWriter(size).WriteHeader(header); err != nil {
+		return err
+	}
+
+	gap := (t.alignment - (t.written+size.written)%t.alignment) % t.alignment
+	for gap > 0 {
+		// Each global header is a header block followed by its records, which are limited to 1 MiB.
+		n := gap
+		if n > 1024*1024 {
+			n = 1024 * 1024
+		}
+
+		if err := out.WriteHeader(paddingHeader(n)); err != nil {
+			return err
+		}
 
-	if err = os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		gap -= n
+	}
+
+	return nil
+}
+
+// paddingHeader returns a PAX global header that occupies n bytes, a positive multiple of tarBlockSize, of a tar
+// stream.
+func paddingHeader(n int64) *tar.Header {
+	header := &tar.Header{Typeflag: tar.TypeXGlobalHeader}
+
+	// A record is "<length> comment=<value>\n", where length counts the whole record including its own digits.
+	if length := int(n - tarBlockSize); length > 0 {
+		value := length - len(" comment=\n") - len(strconv.Itoa(length))
+		header.PAXRecords = map[string]string{"comment": strings.Repeat(" ", value)}
+	}
+
+	return header
+}
+
+// removeParts removes the parts of an archive, and their manifest, left by a previous split, so that they are not
+// reassembled with the parts of a new one.
+func removeParts(archive string) error {
+	files, err := ioutil.ReadDir(filepath.Dir(archive))
+	if err != nil {
 		return err
 	}
 
-	file, err := os.OpenFile(archive, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), filepath.Base(archive)+".part") {
+			if err := os.Remove(filepath.Join(filepath.Dir(archive), f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// shellScriptContent returns the content of a file and true if it is a shell script, one whose name ends in .sh or
+// whose first line is a shell interpreter line.  Other files are read no further than their first line.
+func shellScriptContent(file string) ([]byte, bool, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, false, err
+	}
+	defer in.Close()
+
+	r := bufio.NewReader(in)
+
+	// A first line longer than the buffer is not an interpreter line, so only its start is needed.
+	line, err := r.ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, false, err
+	}
+
+	if !strings.HasSuffix(file, ".sh") && !shellScript.Match(line) {
+		return nil, false, nil
+	}
+
+	b := append([]byte(nil), line...)
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return append(b, rest...), true, nil
+}
+
+// sourcedFile returns the relative path of the file sourced by a shell command, if the line is one and the path can be
+// determined, and whether a leading variable or substitution, such as $(dirname "$0") or ${BASH_SOURCE%/*}, was removed
+// from it.
+func sourcedFile(line string) (string, bool, bool) {
+	m := sourceCommand.FindStringSubmatch(line)
+	if m == nil {
+		return "", false, false
+	}
+
+	arg := strings.NewReplacer(`"`, "", "'", "").Replace(m[1])
+	if i := strings.Index(arg, " #"); i >= 0 {
+		arg = arg[:i]
+	}
+	arg = strings.TrimSpace(arg)
+
+	substituted := false
+	if i := strings.LastIndexAny(arg, ")}"); i >= 0 {
+		arg, substituted = arg[i+1:], true
+	} else if strings.HasPrefix(arg, "$") {
+		i := strings.Index(arg, "/")
+		if i < 0 {
+			return "", false, false
+		}
+		arg, substituted = arg[i:], true
+	}
+
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || (!substituted && strings.HasPrefix(fields[0], "/")) {
+		return "", false, false
+	}
+
+	ref := strings.TrimPrefix(fields[0], "/")
+	if ref == "" || strings.ContainsAny(ref, "$`*?") {
+		return "", false, false
+	}
+
+	return filepath.Clean(filepath.FromSlash(ref)), substituted, true
+}
+
+// defaultBuildpack returns the buildpack rooted at BP_ROOT if it is set, and otherwise the buildpack containing the
+// executable.
+func defaultBuildpack(logger libbuildpack.Logger) (libbuildpack.Buildpack, error) {
+	root, ok := os.LookupEnv("BP_ROOT")
+	if !ok || root == "" {
+		return libbuildpack.DefaultBuildpack(logger)
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return libbuildpack.Buildpack{}, err
+	}
+
+	var buildpack libbuildpack.Buildpack
+	if err := FromTomlFile(filepath.Join(root, "buildpack.toml"), &buildpack); err != nil {
+		return libbuildpack.Buildpack{}, err
+	}
+
+	buildpack.Logger = logger
+	buildpack.Root = root
+
+	logger.Debug("Buildpack root %s from BP_ROOT", root)
+	return buildpack, nil
+}
+
+// Extractable returns an error if the gzip compressed tar archive cannot be decompressed and each of its entries read
+// to the end.
+func Extractable(archive string) error {
+	f, err := os.Open(archive)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer f.Close()
+
+	err = internal.WalkTarGz(f, func(*tar.Header, io.Reader) error { return nil })
+	if err != nil {
+		return fmt.Errorf("archive %s is not extractable: %s", archive, err)
+	}
 
-	gw := gzip.NewWriter(file)
-	defer gw.Close()
+	return nil
+}
 
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+// archiveIndex returns the index of the entries of a gzipped tar archive.
+func archiveIndex(in io.Reader) (Index, error) {
+	var index Index
 
-	for _, file := range files {
-		if err := p.addFile(tw, file); err != nil {
+	err := internal.WalkTarGz(in, func(header *tar.Header, content io.Reader) error {
+		s := sha256.New()
+		if _, err := io.Copy(s, content); err != nil {
 			return err
 		}
+
+		index.Entries = append(index.Entries, IndexEntry{
+			Name: header.Name, Size: header.Size, Mode: header.Mode, SHA256: hex.EncodeToString(s.Sum(nil)),
+		})
+		return nil
+	})
+	if err != nil {
+		return Index{}, err
 	}
 
-	return nil
+	return index, nil
 }
 
-func (p Packager) defaultLogger() libbuildpack.Logger {
-	var debug io.Writer
+// entryName returns the archive entry name for a path, with forward slash separators and no leading slash.  Names
+// containing a null byte or backslash, or that escape the archive root, are unsafe to extract and are an error.
+func entryName(path string) (string, error) {
+	if strings.ContainsRune(path, 0) {
+		return "", fmt.Errorf("entry name %q contains a null byte", path)
+	}
 
-	if _, ok := os.LookupEnv("BP_DEBUG"); ok {
-		debug = os.Stderr
+	if strings.Contains(path, `\`) {
+		return "", fmt.Errorf("entry name %q contains a backslash", path)
+	}
+
+	name := strings.TrimLeft(filepath.ToSlash(path), "/")
+	if name == "" {
+		return "", fmt.Errorf("entry name %q is empty", path)
+	}
+
+	for _, c := range strings.Split(name, "/") {
+		if c == ".." {
+			return "", fmt.Errorf("entry name %q escapes the archive root", path)
+		}
 	}
 
-	return libbuildpack.NewLogger(debug, os.Stdout)
+	return name, nil
 }
 
-func (p Packager) cacheDependencies() ([]string, error) {
-	var files []string
+// firstDifference returns the name of the first entry that differs between two indices.
+func firstDifference(expected Index, actual Index) (string, bool) {
+	for i := 0; i < len(expected.Entries) || i < len(actual.Entries); i++ {
+		switch {
+		case i >= len(actual.Entries):
+			return expected.Entries[i].Name, true
+		case i >= len(expected.Entries):
+			return actual.Entries[i].Name, true
+		case expected.Entries[i] != actual.Entries[i]:
+			return actual.Entries[i].Name, true
+		}
+	}
 
-	deps, err := p.Buildpack.Dependencies()
+	return "", false
+}
+
+// within returns the first of the directories that path is equal to or below.
+func within(path string, dirs []string) (string, bool) {
+	a, err := filepath.Abs(path)
 	if err != nil {
-		return nil, err
+		return "", false
 	}
 
-	for _, dep := range deps {
-		p.Logger.FirstLine("Caching %s", p.Logger.PrettyVersion(dep))
-
-		layer := p.Cache.DownloadLayer(dep)
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
 
-		a, err := layer.Artifact()
+		d, err := filepath.Abs(dir)
 		if err != nil {
-			return nil, err
+			continue
 		}
 
-		artifact, err := filepath.Rel(p.Buildpack.Root, a)
-		if err != nil {
-			return nil, err
+		rel, err := filepath.Rel(d, a)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return dir, true
 		}
+	}
+
+	return "", false
+}
 
-		metadata, err := filepath.Rel(p.Buildpack.Root, layer.Metadata(layer.Root))
+func matchesAny(patterns []string, id string) (bool, error) {
+	for _, pattern := range patterns {
+		ok, err := filepath.Match(pattern, id)
 		if err != nil {
-			return nil, err
+			return false, fmt.Errorf("dependency pattern %s is malformed: %s", pattern, err)
 		}
 
-		files = append(files, artifact, metadata)
+		if ok {
+			return true, nil
+		}
 	}
 
-	return files, nil
+	return false, nil
 }
 
-func (p Packager) prePackage() error {
-	pp, ok := p.Buildpack.PrePackage()
-	if !ok {
-		return nil
+// prePackageOut returns where the output of the pre-package script is written, which is stderr if the archive is
+// streamed to stdout so that the two are not interleaved.
+func prePackageOut(stream io.Writer) io.Writer {
+	if stream == os.Stdout {
+		return os.Stderr
 	}
+	return os.Stdout
+}
 
-	cmd := exec.Command(pp)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Dir = p.Buildpack.Root
+// DefaultPackager creates a new Packager, using $BP_ROOT if it is set, and otherwise the executable, to find the root
+// of the buildpack.  Info is written to stdout, or to stderr if the output directory is -, and, if $BP_DEBUG is set,
+// debug to stderr.
+func DefaultPackager() (Packager, error) {
+	var debug io.Writer
 
-	p.Logger.FirstLine("Pre-Package with %s", strings.Join(cmd.Args, " "))
+	if _, ok := os.LookupEnv("BP_DEBUG"); ok {
+		debug = os.Stderr
+	}
+
+	// When the archive is streamed to stdout, info moves to stderr so that it does not corrupt the archive.
+	var info io.Writer = os.Stdout
+	if dir, err := osArgs(1); err == nil && dir == "-" {
+		info = os.Stderr
+	}
 
-	return cmd.Run()
+	return NewPackager(debug, info)
 }
 
-// DefaultPackager creates a new Packager, using the executable to find the root of the buildpack.
-func DefaultPackager() (Packager, error) {
+// NewPackager creates a new Packager, using $BP_ROOT if it is set, and otherwise the executable, to find the root of
+// the buildpack and writing debug and info to the specified writers.  A nil writer disables that level of logging.
+func NewPackager(debug io.Writer, info io.Writer) (Packager, error) {
 	p := Packager{}
 
-	logger := p.defaultLogger()
+	logger := libbuildpack.NewLogger(debug, info)
 	p.Logger = Logger{Logger: logger}
 
-	buildpack, err := libbuildpack.DefaultBuildpack(logger)
+	buildpack, err := defaultBuildpack(logger)
 	if err != nil {
 		return Packager{}, err
 	}
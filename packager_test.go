@@ -0,0 +1,2923 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/buildpack/libbuildpack"
+	"github.com/cloudfoundry/libjavabuildpack"
+	"github.com/cloudfoundry/libjavabuildpack/internal"
+	"github.com/cloudfoundry/libjavabuildpack/test"
+	"github.com/h2non/gock"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestPackager(t *testing.T) {
+	spec.Run(t, "Packager", testPackager, spec.Report(report.Terminal{}))
+}
+
+func testPackager(t *testing.T, when spec.G, it spec.S) {
+
+	var (
+		debug, info bytes.Buffer
+		p           libjavabuildpack.Packager
+		restore     func()
+		root        string
+	)
+
+	it.Before(func() {
+		root = test.ScratchDir(t, "packager")
+		restore = test.ReplaceArgs(t, filepath.Join(root, "bin", "package"), filepath.Join(root, "output"))
+		p = newPackager(root, &debug, &info)
+	})
+
+	it.After(func() {
+		restore()
+	})
+
+	it("writes logs to injected writers", func() {
+		writeFile(t, filepath.Join(root, "buildpack.toml"), `[buildpack]
+id = "test-id"
+name = "test-name"
+version = "1.0"
+`, 0644)
+
+		p, err := libjavabuildpack.NewPackager(&debug, &info)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(info.String(), "Packaging") {
+			t.Errorf("info = %s, expected to contain Packaging", info.String())
+		}
+
+		if !strings.Contains(debug.String(), "Descriptor") {
+			t.Errorf("debug = %s, expected to contain Descriptor", debug.String())
+		}
+	})
+
+	it("resolves the buildpack root from BP_ROOT", func() {
+		defer test.ReplaceEnv(t, "BP_ROOT", root)()
+
+		writeFile(t, filepath.Join(root, "buildpack.toml"), `[buildpack]
+id = "test-id"
+name = "test-name"
+version = "1.0"
+`, 0644)
+
+		p, err := libjavabuildpack.NewPackager(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Buildpack.Root != root {
+			t.Errorf("Packager.Buildpack.Root = %s, expected %s", p.Buildpack.Root, root)
+		}
+
+		if p.Buildpack.Info.ID != "test-id" {
+			t.Errorf("Packager.Buildpack.Info.ID = %s, expected test-id", p.Buildpack.Info.ID)
+		}
+	})
+
+	it("logs the descriptor sha256", func() {
+		descriptor := `[buildpack]
+id = "test-id"
+name = "test-name"
+version = "1.0"
+`
+		writeFile(t, filepath.Join(root, "buildpack.toml"), descriptor, 0644)
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		s := sha256.Sum256([]byte(descriptor))
+		expected := fmt.Sprintf("sha256 %s", hex.EncodeToString(s[:]))
+		if !strings.Contains(debug.String(), expected) {
+			t.Errorf("Packager.Create() debug = %s, expected to contain %s", debug.String(), expected)
+		}
+	})
+
+	it("logs the effective configuration with the catalog authorization redacted", func() {
+		p.Buildpack.Catalog = libjavabuildpack.Catalog{Authorization: "test-secret"}
+		p.Formats = []libjavabuildpack.Format{libjavabuildpack.FormatTar}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(debug.String(), "Formats: [tar]") {
+			t.Errorf("Packager.Create() debug = %s, expected configured format", debug.String())
+		}
+
+		if strings.Contains(debug.String(), "test-secret") {
+			t.Errorf("Packager.Create() debug = %s, expected authorization to be redacted", debug.String())
+		}
+	})
+
+	it("describes every exported field in the effective configuration", func() {
+		s := libjavabuildpack.Packager{}.String()
+
+		typ := reflect.TypeOf(libjavabuildpack.Packager{})
+		for i := 0; i < typ.NumField(); i++ {
+			if f := typ.Field(i); f.PkgPath == "" && !strings.Contains(s, " "+f.Name+": ") {
+				t.Errorf("Packager.String() = %s, expected to describe %s", s, f.Name)
+			}
+		}
+	})
+
+	it("creates concurrently from a shared packager", func() {
+		p := newPackager(root, nil, nil)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 4)
+
+		for i := 0; i < 4; i++ {
+			b := p.Buildpack
+			b.Info.ID = fmt.Sprintf("test-id-%d", i)
+			b.Root = filepath.Join(root, b.Info.ID)
+			b.CacheRoot = filepath.Join(b.Root, "cache")
+
+			wg.Add(1)
+			go func(q libjavabuildpack.Packager) {
+				defer wg.Done()
+				errs <- q.Create()
+			}(p.For(b))
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 0; i < 4; i++ {
+			id := fmt.Sprintf("test-id-%d", i)
+			internal.FileExists(t, filepath.Join(root, "output", id, id, "1.0", fmt.Sprintf("%s-1.0.tgz", id)))
+		}
+	})
+
+	it("uses the cache root of the buildpack it is for", func() {
+		b := p.Buildpack
+		b.CacheRoot = filepath.Join(root, "other-cache")
+
+		c := p.For(b).Cache.(libjavabuildpack.Cache)
+
+		if c.Root != b.CacheRoot || c.BuildpackCacheRoot != b.CacheRoot {
+			t.Errorf("Packager.For().Cache = %s, expected roots of %s", c, b.CacheRoot)
+		}
+	})
+
+	it("prefixes the log lines of the packager and cache for a buildpack with its id", func() {
+		b := p.Buildpack
+		b.Info.ID = "test-other-id"
+		b.CacheRoot = filepath.Join(root, "other-cache")
+
+		q := p.For(b)
+		if c := q.Cache.(libjavabuildpack.Cache); c.Logger.Prefix != "[test-other-id]" {
+			t.Errorf("Packager.For().Cache.Logger.Prefix = %s, expected [test-other-id]", c.Logger.Prefix)
+		}
+
+		if err := q.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, line := range strings.Split(strings.TrimSpace(info.String()), "\n") {
+			if !strings.HasPrefix(line, "[test-other-id] ") {
+				t.Errorf("Packager.Create() line = %q, expected to be prefixed with [test-other-id]", line)
+			}
+		}
+	})
+
+	it("returns usage error if output directory is missing", func() {
+		defer test.ReplaceArgs(t, filepath.Join(root, "bin", "package"))()
+
+		err := p.Create()
+		if err == nil || err.Error() != "usage: package <output-dir>" {
+			t.Errorf("Packager.Create() = %v, expected usage: package <output-dir>", err)
+		}
+	})
+
+	it("streams the archive to a writer", func() {
+		defer test.ReplaceArgs(t, filepath.Join(root, "bin", "package"))()
+
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		var archive bytes.Buffer
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		p.ArchiveWriter = &archive
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		f := filepath.Join(root, "streamed.tgz")
+		if err := libjavabuildpack.WriteToFile(&archive, f, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual := archiveEntries(t, f); !reflect.DeepEqual(actual, []string{"bin/detect"}) {
+			t.Errorf("archive entries = %s, expected [bin/detect]", actual)
+		}
+	})
+
+	it("returns error for options incompatible with streaming before running pre-package", func() {
+		defer test.ReplaceArgs(t, filepath.Join(root, "bin", "package"))()
+
+		writeFile(t, filepath.Join(root, "scripts", "test-pre-package.sh"), `#!/bin/sh
+touch ran
+`, 0755)
+
+		for _, c := range []struct {
+			name      string
+			configure func(p *libjavabuildpack.Packager)
+			expected  string
+		}{
+			{"format", func(p *libjavabuildpack.Packager) {
+				p.Formats = []libjavabuildpack.Format{libjavabuildpack.FormatZip}
+			}, "format zip cannot be streamed"},
+			{"index", func(p *libjavabuildpack.Packager) { p.Index = true },
+				"index and signature require an archive file and cannot be streamed"},
+			{"signer", func(p *libjavabuildpack.Packager) { p.Signer = testSigner{} },
+				"index and signature require an archive file and cannot be streamed"},
+			{"delta", func(p *libjavabuildpack.Packager) { p.DeltaFrom = filepath.Join(root, "previous.tgz") },
+				"delta packaging cannot be combined with streaming"},
+			{"split", func(p *libjavabuildpack.Packager) { p.SplitSize = 100 },
+				"split packaging cannot be combined with streaming"},
+		} {
+			p := newPackager(root, nil, nil)
+			p.Buildpack.Metadata["pre_package"] = "scripts/test-pre-package.sh"
+			p.ArchiveWriter = ioutil.Discard
+			c.configure(&p)
+
+			if err := p.Create(); err == nil || err.Error() != c.expected {
+				t.Errorf("%s: Packager.Create() = %v, expected %s", c.name, err, c.expected)
+			}
+		}
+
+		if exists, err := libjavabuildpack.FileExists(filepath.Join(root, "ran")); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected pre-package script not to run")
+		}
+	})
+
+	it("writes a detached signature", func() {
+		p.Signer = testSigner{}
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		archive := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+		b, err := ioutil.ReadFile(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		test.BeFileLike(t, archive+".sig", 0644, fmt.Sprintf("test-signature-%d", len(b)))
+
+		if report.Signature != archive+".sig" {
+			t.Errorf("Report.Signature = %s, expected %s", report.Signature, archive+".sig")
+		}
+
+		if report.Index != "" {
+			t.Errorf("Report.Index = %s, expected none without Index", report.Index)
+		}
+	})
+
+	it("writes an index matching the archive entries", func() {
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		p.Index = true
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		archive := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+
+		if report.Index != archive+".idx" {
+			t.Errorf("Report.Index = %s, expected %s", report.Index, archive+".idx")
+		}
+
+		var index libjavabuildpack.Index
+		if err := libjavabuildpack.FromTomlFile(archive+".idx", &index); err != nil {
+			t.Fatal(err)
+		}
+
+		s := sha256.Sum256([]byte("test-detect"))
+		expected := libjavabuildpack.Index{Entries: []libjavabuildpack.IndexEntry{
+			{Name: "bin/detect", Size: 11, Mode: 0755, SHA256: hex.EncodeToString(s[:])},
+		}}
+
+		if !reflect.DeepEqual(index, expected) {
+			t.Errorf("index = %v, expected %v", index, expected)
+		}
+
+		if actual := archiveEntries(t, archive); !reflect.DeepEqual(actual, []string{"bin/detect"}) {
+			t.Errorf("archive entries = %s, expected [bin/detect]", actual)
+		}
+	})
+
+	it("normalizes the gzip header when reproducible", func() {
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		p.Reproducible = true
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gz.Close()
+
+		if gz.Name != "" || gz.Comment != "" || !gz.ModTime.IsZero() {
+			t.Errorf("gzip header = %+v, expected no name, comment, or modification time", gz.Header)
+		}
+
+		header, err := tar.NewReader(gz).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !header.ModTime.Equal(time.Unix(0, 0)) {
+			t.Errorf("tar entry modification time = %s, expected Unix epoch", header.ModTime)
+		}
+	})
+
+	it("writes the archive to a configured output directory", func() {
+		p.OutputDir = filepath.Join(root, "configured")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		internal.FileExists(t, filepath.Join(root, "configured", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+	})
+
+	it("uses the git commit time as the modification time of entries", func() {
+		if _, err := exec.LookPath("git"); err != nil {
+			t.Skip("git is not available")
+		}
+
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		for _, args := range [][]string{
+			{"init", "-q"},
+			{"add", "bin/detect"},
+			{"-c", "user.name=test-name", "-c", "user.email=test@test-host", "commit", "-q", "-m", "test-message"},
+		} {
+			cmd := exec.Command("git", args...)
+			cmd.Dir = root
+			cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE=@1500000000 +0000")
+
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("git %s: %s\n%s", args, err, out)
+			}
+		}
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		p.ModTimeSource = libjavabuildpack.ModTimeSourceGitCommit
+		p.Formats = []libjavabuildpack.Format{libjavabuildpack.FormatTarGz, libjavabuildpack.FormatOCILayer}
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, archive := range []string{report.Archive, report.OCILayer.Path} {
+			f, err := os.Open(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer gz.Close()
+
+			tr := tar.NewReader(gz)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !header.ModTime.Equal(time.Unix(1500000000, 0)) {
+					t.Errorf("%s entry %s modification time = %s, expected commit time", archive, header.Name,
+						header.ModTime)
+				}
+			}
+		}
+	})
+
+	it("writes provenance as a PAX global header", func() {
+		p.Provenance = "test-builder https://test-pipeline/runs/1"
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gz.Close()
+
+		header, err := tar.NewReader(gz).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if header.Typeflag != tar.TypeXGlobalHeader {
+			t.Fatalf("first tar entry type = %q, expected PAX global header", header.Typeflag)
+		}
+
+		if header.PAXRecords["comment"] != p.Provenance {
+			t.Errorf("PAX global header comment = %q, expected %q", header.PAXRecords["comment"], p.Provenance)
+		}
+	})
+
+	it("orders entries byte-wise by name", func() {
+		for _, f := range []string{"lib/b.jar", "lib/B.jar", "lib/_x", "lib/a.b", "lib/a-b", "LICENSE"} {
+			writeFile(t, filepath.Join(root, f), f, 0644)
+		}
+
+		if err := os.MkdirAll(filepath.Join(root, "lib", "a"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"lib", "LICENSE"}
+		p.IncludeEmptyDirectories = true
+		p.EntryOrder = libjavabuildpack.EntryOrderByNameASCII
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"LICENSE", "lib/B.jar", "lib/_x", "lib/a-b", "lib/a.b", "lib/a/", "lib/b.jar"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("drops files matching global excludes from every directory include", func() {
+		for _, dir := range []string{"lib", "tools"} {
+			for _, f := range []string{"test.jar", "test.class", "__pycache__/test.pyc", "target/test.txt"} {
+				f = filepath.Join(root, dir, filepath.FromSlash(f))
+				writeFile(t, f, "test-content", 0644)
+			}
+		}
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"lib", "tools"}
+		p.Excludes = []string{"*.class", "__pycache__", "target/"}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"lib/test.jar", "tools/test.jar"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("writes annotations as PAX records on entries", func() {
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		p.Annotations = map[string]map[string]string{"bin/detect": {"bp.role": "launcher"}}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gz.Close()
+
+		header, err := tar.NewReader(gz).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if header.Name != "bin/detect" || header.PAXRecords["bp.role"] != "launcher" {
+			t.Errorf("tar entry %s PAX records = %v, expected bp.role = launcher", header.Name, header.PAXRecords)
+		}
+
+		p.Annotations = map[string]map[string]string{"bin/detect": {"role": "launcher"}}
+
+		if err := p.Create(); err == nil {
+			t.Errorf("Packager.Create() = nil, expected error for annotation key without a vendor")
+		}
+	})
+
+	it("verifies the archive is extractable", func() {
+		p.VerifyExtractable = true
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		archive := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+		if err := libjavabuildpack.Extractable(archive); err != nil {
+			t.Fatal(err)
+		}
+
+		stat, err := os.Stat(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Truncate(archive, stat.Size()-10); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := libjavabuildpack.Extractable(archive); err == nil {
+			t.Errorf("Extractable() = nil, expected error for truncated archive")
+		}
+	})
+
+	it("reports the digest of the uncompressed tar", func() {
+		writeFile(t, filepath.Join(root, "lib", "test.jar"), "test-content", 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"lib/test.jar"}
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(report.Archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gz.Close()
+
+		s := sha256.New()
+		if _, err := io.Copy(s, gz); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := "sha256:" + hex.EncodeToString(s.Sum(nil)); report.DiffID != expected {
+			t.Errorf("DiffID = %s, expected %s", report.DiffID, expected)
+		}
+	})
+
+	it("includes files from a generated file list", func() {
+		for _, f := range []string{"lib/test-generated.jar", "lib/test-static.jar"} {
+			writeFile(t, filepath.Join(root, f), f, 0644)
+		}
+
+		writeFile(t, filepath.Join(root, "files.list"), "lib/test-generated.jar\n\n", 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"lib/test-static.jar"}
+		p.IncludeFilesList = "files.list"
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"lib/test-static.jar", "lib/test-generated.jar"}
+		if actual := archiveEntries(t, report.Archive); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+
+		p.ReplaceIncludeFiles = true
+
+		if report, err = p.Package(); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual := archiveEntries(t, report.Archive); !reflect.DeepEqual(actual, []string{"lib/test-generated.jar"}) {
+			t.Errorf("archive entries = %s, expected [lib/test-generated.jar]", actual)
+		}
+
+		writeFile(t, filepath.Join(root, "files.list"), "lib/test-missing.jar\n", 0644)
+
+		missing := "lib/test-missing.jar listed in files.list does not exist"
+		if _, err := p.Package(); err == nil || !strings.Contains(err.Error(), missing) {
+			t.Fatalf("error = %v, expected %s", err, missing)
+		}
+	})
+
+	it("aligns the content of large entries", func() {
+		writeFile(t, filepath.Join(root, "lib", "test-small.jar"), "test-small", 0644)
+
+		writeFile(t, filepath.Join(root, "lib", "test-large.jar"), strings.Repeat("x", 8192), 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"lib/test-small.jar", "lib/test-large.jar"}
+		p.EntryAlignment = 4096
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(report.Archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gz.Close()
+
+		r := &countingReader{Reader: gz}
+		tr := tar.NewReader(r)
+
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				t.Fatal("archive has no lib/test-large.jar")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h.Name == "lib/test-large.jar" {
+				break
+			}
+		}
+
+		if r.n%4096 != 0 {
+			t.Errorf("lib/test-large.jar content offset = %d, expected a multiple of 4096", r.n)
+		}
+
+		if err := libjavabuildpack.Extractable(report.Archive); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	it("rejects an entry alignment that is not a multiple of the tar block size", func() {
+		p.EntryAlignment = 1000
+
+		if _, err := p.Package(); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	it("packages only entries changed from a base archive", func() {
+		files := []string{"lib/test-changed.jar", "lib/test-mode.jar", "lib/test-removed.jar", "lib/test-unchanged.jar"}
+		for _, f := range files {
+			writeFile(t, filepath.Join(root, f), f, 0644)
+		}
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"lib"}
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		base := filepath.Join(root, "base.tgz")
+		if err := os.Rename(report.Archive, base); err != nil {
+			t.Fatal(err)
+		}
+
+		writeFile(t, filepath.Join(root, "lib", "test-changed.jar"), "test-content", 0644)
+
+		if err := os.Chmod(filepath.Join(root, "lib", "test-mode.jar"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Remove(filepath.Join(root, "lib", "test-removed.jar")); err != nil {
+			t.Fatal(err)
+		}
+
+		p.DeltaFrom = base
+
+		if report, err = p.Package(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"lib/test-changed.jar", "lib/test-mode.jar"}
+		if actual := archiveEntries(t, report.Archive); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+
+		internal.BeFileLike(t, report.Delta, 0644, `base = "base.tgz"
+removed = ["lib/test-removed.jar"]
+`)
+	})
+
+	it("splits the archive into parts that reassemble it", func() {
+		payload := make([]byte, 10000)
+		rand.New(rand.NewSource(1)).Read(payload)
+		writeFile(t, filepath.Join(root, "lib", "test.jar"), string(payload), 0644)
+
+		stale := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz.part99")
+		writeFile(t, stale, "test-stale", 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"lib/test.jar"}
+		p.SplitSize = 1000
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(report.Parts) < 2 {
+			t.Fatalf("Report.Parts = %s, expected archive to be split", report.Parts)
+		}
+
+		if !strings.HasSuffix(report.Parts[1], ".tgz.part0001") {
+			t.Errorf("Report.Parts = %s, expected indexes padded to 4 digits", report.Parts)
+		}
+
+		if exists, err := libjavabuildpack.FileExists(stale); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected stale part %s to be removed", stale)
+		}
+
+		var reassembled bytes.Buffer
+		for _, part := range report.Parts {
+			b, err := ioutil.ReadFile(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(b) > 1000 {
+				t.Errorf("part %s size = %d, expected at most 1000", part, len(b))
+			}
+
+			reassembled.Write(b)
+		}
+
+		archive, err := ioutil.ReadFile(report.Archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(reassembled.Bytes(), archive) {
+			t.Errorf("reassembled parts do not match archive %s", report.Archive)
+		}
+
+		f := filepath.Join(root, "reassembled.tgz")
+		if err := libjavabuildpack.WriteToFile(&reassembled, f, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := libjavabuildpack.Extractable(f); err != nil {
+			t.Error(err)
+		}
+
+		var manifest libjavabuildpack.PartsManifest
+		if err := libjavabuildpack.FromTomlFile(report.Archive+".parts.toml", &manifest); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(manifest.Parts) != len(report.Parts) || manifest.Size != int64(len(archive)) {
+			t.Errorf("PartsManifest = %+v, expected %d parts totalling %d bytes", manifest, len(report.Parts),
+				len(archive))
+		}
+	})
+
+	it("copies files with a non-default buffer size", func() {
+		content := strings.Repeat("test-content", 1000)
+		writeFile(t, filepath.Join(root, "lib", "test.jar"), content, 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"lib/test.jar"}
+		p.CopyBufferSize = 7
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tr := tar.NewReader(gz)
+		if _, err := tr.Next(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != content {
+			t.Errorf("archive entry content length = %d, expected %d", len(b), len(content))
+		}
+	})
+
+	it("returns error if a file changes size while being packaged", func() {
+		// Files in /proc report a size of zero but have content, as if they grew after being stat'd.
+		if _, err := os.Stat("/proc/self/status"); err != nil {
+			t.Skip("/proc is not available")
+		}
+
+		if err := os.MkdirAll(filepath.Join(root, "lib"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("/proc/self/status", filepath.Join(root, "lib", "test-status")); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, format := range []libjavabuildpack.Format{libjavabuildpack.FormatTarGz, libjavabuildpack.FormatZip} {
+			p := newPackager(root, nil, nil)
+			p.Buildpack.Metadata["include_files"] = []interface{}{"lib/test-status"}
+			p.Formats = []libjavabuildpack.Format{format}
+
+			err := p.Create()
+			if err == nil || !strings.Contains(err.Error(), "grew beyond 0 bytes while being packaged") {
+				t.Errorf("%s: Packager.Create() = %v, expected size change error", format, err)
+			}
+		}
+	})
+
+	it("calls OnFile for each archive entry", func() {
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		descriptor := filepath.Join(root, "buildpack.toml")
+		writeFile(t, descriptor, `api = "0.2"`, 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		p.VersionMarker = true
+
+		var entries []libjavabuildpack.EntryInfo
+		p.OnFile = func(entry libjavabuildpack.EntryInfo) {
+			entries = append(entries, entry)
+		}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		names := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+		if len(entries) != len(names) {
+			t.Fatalf("OnFile entries = %v, expected one per archive entry %s", entries, names)
+		}
+
+		for i, entry := range entries {
+			if entry.Name != names[i] {
+				t.Errorf("OnFile entry %d name = %s, expected %s", i, entry.Name, names[i])
+			}
+
+			if expected := strings.HasPrefix(entry.Name, "cache/"); entry.Dependency != expected {
+				t.Errorf("OnFile entry %s dependency = %t, expected %t", entry.Name, entry.Dependency, expected)
+			}
+		}
+
+		if entries[0].Size != int64(len("test-detect")) {
+			t.Errorf("OnFile entry %s size = %d, expected %d", entries[0].Name, entries[0].Size, len("test-detect"))
+		}
+	})
+
+	it("checks whether the archive matches an existing archive", func() {
+		for _, f := range []string{"bin/build", "bin/detect"} {
+			writeFile(t, filepath.Join(root, f), f, 0755)
+		}
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/build", "bin/detect"}
+		p.Reproducible = true
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		existing := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+
+		matches, err := p.Check(existing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !matches {
+			t.Errorf("Packager.Check() = false, expected true")
+		}
+
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect-changed", 0755)
+
+		matches, err = p.Check(existing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches {
+			t.Errorf("Packager.Check() = true, expected false")
+		}
+
+		if !strings.Contains(info.String(), "at entry bin/detect") {
+			t.Errorf("Packager.Check() info = %s, expected first differing entry bin/detect", info.String())
+		}
+	})
+
+	it("checks an existing archive whatever the builder, delta and split configuration", func() {
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		p.Reproducible = true
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		existing := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+
+		for _, c := range []struct {
+			name      string
+			configure func(p *libjavabuildpack.Packager)
+		}{
+			{"builder", func(p *libjavabuildpack.Packager) { p.Builder = &libjavabuildpack.BuilderStack{} }},
+			{"delta", func(p *libjavabuildpack.Packager) { p.DeltaFrom = existing }},
+			{"split", func(p *libjavabuildpack.Packager) { p.SplitSize = 100 }},
+		} {
+			p := newPackager(root, nil, nil)
+			p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+			c.configure(&p)
+
+			if matches, err := p.Check(existing); err != nil || !matches {
+				t.Errorf("%s: Packager.Check() = %t, %v, expected true", c.name, matches, err)
+			}
+		}
+	})
+
+	it("skips the pre-package script and restores its outputs when its inputs are unchanged", func() {
+		writeFile(t, filepath.Join(root, "scripts", "test-pre-package.sh"), `#!/bin/sh
+echo run >> runs
+mkdir -p generated
+cat src/test.java > generated/test.class
+`, 0755)
+
+		writeFile(t, filepath.Join(root, "src", "test.java"), "test-source", 0644)
+
+		p.Buildpack.Metadata["pre_package"] = "scripts/test-pre-package.sh"
+		p.PrePackageInputs = []string{"scripts/*", "src"}
+		p.PrePackageOutputs = []string{"generated"}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.RemoveAll(filepath.Join(root, "generated")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		internal.BeFileLike(t, filepath.Join(root, "runs"), 0644, "run\n")
+		internal.BeFileLike(t, filepath.Join(root, "generated", "test.class"), 0644, "test-source")
+
+		p.Variant = libjavabuildpack.VariantDetectOnly
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		internal.BeFileLike(t, filepath.Join(root, "runs"), 0644, "run\nrun\n")
+		p.Variant = ""
+
+		writeFile(t, filepath.Join(root, "src", "test.java"), "test-source-changed", 0644)
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		internal.BeFileLike(t, filepath.Join(root, "runs"), 0644, "run\nrun\nrun\n")
+		internal.BeFileLike(t, filepath.Join(root, "generated", "test.class"), 0644, "test-source-changed")
+	})
+
+	it("skips an optional pre-package script that is not present", func() {
+		p.Buildpack.Metadata["pre_package"] = "scripts/test-pre-package.sh"
+
+		if err := p.Create(); err == nil {
+			t.Errorf("Packager.Create() should return error for a missing pre-package script")
+		}
+
+		p.Buildpack.Metadata["pre_package_optional"] = true
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(info.String(), "optional pre-package scripts/test-pre-package.sh is not present") {
+			t.Errorf("Packager.Create() info = %s, expected optional pre-package warning", info.String())
+		}
+	})
+
+	it("reports how long each dependency took to acquire", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "test-payload")
+		}))
+		defer server.Close()
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", server.URL+"/test-path",
+				"6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273"),
+		}
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(report.Timings) != 1 || report.Timings[0].ID != "test-id" || report.Timings[0].Version != "1.0" ||
+			report.Timings[0].Downloaded != int64(len("test-payload")) || report.Timings[0].BytesPerSecond <= 0 {
+			t.Errorf("Timings = %+v, expected a download of test-id 1.0", report.Timings)
+		}
+
+		if report, err = p.Package(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(report.Timings) != 1 || report.Timings[0].ID != "test-id" || report.Timings[0].Downloaded != 0 {
+			t.Errorf("Timings = %+v, expected a reuse of test-id 1.0", report.Timings)
+		}
+	})
+
+	it("returns error if the archive is not reproducible", func() {
+		for _, f := range []string{"bin/build", "bin/detect"} {
+			writeFile(t, filepath.Join(root, f), f, 0755)
+		}
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/build", "bin/detect"}
+		p.VerifyReproducible = true
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		builds := 0
+		p.OnFile = func(entry libjavabuildpack.EntryInfo) {
+			if entry.Name != "bin/build" {
+				return
+			}
+
+			builds++
+			content := fmt.Sprintf("test-detect-%d", builds)
+			writeFile(t, filepath.Join(root, "bin", "detect"), content, 0755)
+		}
+
+		err := p.Create()
+		if err == nil || !strings.Contains(err.Error(), "entry bin/detect differs between builds") {
+			t.Errorf("Packager.Create() = %v, expected bin/detect to differ between builds", err)
+		}
+	})
+
+	it("renders a filename template", func() {
+		p.Buildpack.Stacks = []libbuildpack.BuildpackStack{{ID: "test-stack"}}
+		p.FilenameTemplate = "{id}_{version}_{stack}.tgz"
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		internal.FileExists(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id_1.0_test-stack.tgz"))
+	})
+
+	it("returns error if filename template renders an unsafe filename", func() {
+		p.FilenameTemplate = "../{id}.tgz"
+
+		err := p.Create()
+		if err == nil || !strings.Contains(err.Error(), "unsafe filename") {
+			t.Errorf("Packager.Create() = %v, expected unsafe filename", err)
+		}
+	})
+
+	it("writes a single entry for duplicate files", func() {
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect", "./bin/detect"}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"bin/detect"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("warns about, and under strict returns error for, an empty required file", func() {
+		writeFile(t, filepath.Join(root, "bin", "build"), "", 0755)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/build"}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(info.String(), "required file bin/build is empty") {
+			t.Errorf("Packager.Create() info = %s, expected empty file warning", info.String())
+		}
+
+		p.Strict = true
+
+		err := p.Create()
+		if err == nil || err.Error() != "required file bin/build is empty" {
+			t.Errorf("Packager.Create() = %v, expected required file bin/build is empty", err)
+		}
+	})
+
+	it("adds the contents of directory include entries recursively", func() {
+		for _, f := range []string{"lib/test-a.jar", "lib/nested/test-b.jar", "other/test-c.jar"} {
+			writeFile(t, filepath.Join(root, f), f, 0644)
+		}
+
+		if err := os.MkdirAll(filepath.Join(root, "lib", "empty"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Symlink(filepath.Join("..", "other"), filepath.Join(root, "lib", "linked")); err != nil {
+			t.Fatal(err)
+		}
+
+		err := os.Symlink(filepath.Join("..", "other", "test-c.jar"), filepath.Join(root, "lib", "test-c.jar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"lib"}
+		p.IncludeEmptyDirectories = true
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		archive := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+		actual := archiveEntries(t, archive)
+
+		expected := []string{"lib/empty/", "lib/nested/test-b.jar", "lib/test-a.jar", "lib/test-c.jar"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+
+		if c := archiveFile(t, archive, "lib/test-c.jar"); c != "other/test-c.jar" {
+			t.Errorf("lib/test-c.jar = %s, expected the contents of the linked file", c)
+		}
+	})
+
+	it("excludes hidden files in directory include entries unless IncludeHidden is set", func() {
+		for _, f := range []string{"lib/test-a.jar", "lib/.DS_Store", "lib/.idea/workspace.xml"} {
+			writeFile(t, filepath.Join(root, f), f, 0644)
+		}
+
+		archive := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"lib"}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"lib/test-a.jar"}
+		if actual := archiveEntries(t, archive); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+
+		p.IncludeHidden = true
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected = []string{"lib/.DS_Store", "lib/.idea/workspace.xml", "lib/test-a.jar"}
+		if actual := archiveEntries(t, archive); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("warns when a declared stack has no dependency coverage", func() {
+		p.Buildpack.Stacks = []libbuildpack.BuildpackStack{{ID: "test-stack"}, {ID: "test-stack-uncovered"}}
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(info.String(), "stack test-stack-uncovered has no dependency coverage") {
+			t.Errorf("Packager.Create() info = %s, expected stack coverage warning", info.String())
+		}
+
+		if strings.Contains(info.String(), "stack test-stack has") {
+			t.Errorf("Packager.Create() info = %s, expected test-stack to be covered", info.String())
+		}
+	})
+
+	it("warns when a provided entry has no bundled dependency", func() {
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+		p.Buildpack.Metadata["provides"] = []map[string]interface{}{{"name": "test-id"}, {"name": "jdk"}}
+		p.Buildpack.Metadata["requires"] = []map[string]interface{}{{"name": "jvm-application"}}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(info.String(), "provides jdk but no jdk dependency is bundled") {
+			t.Errorf("Packager.Create() info = %s, expected provides warning", info.String())
+		}
+
+		if strings.Contains(info.String(), "provides test-id") {
+			t.Errorf("Packager.Create() info = %s, expected test-id to be bundled", info.String())
+		}
+	})
+
+	it("returns error if an include is within the output directory", func() {
+		writeFile(t, filepath.Join(root, "output", "test.tgz"), "test-archive", 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"output/test.tgz"}
+
+		err := p.Create()
+		if err == nil || !strings.Contains(err.Error(), "which is written by packaging") {
+			t.Errorf("Packager.Create() = %v, expected include within output directory error", err)
+		}
+	})
+
+	it("skips the output directory when walking an include directory", func() {
+		for _, f := range []string{"bin/detect", "output/test.tgz"} {
+			writeFile(t, filepath.Join(root, f), f, 0755)
+		}
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"."}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"bin/detect"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("packages a detect-only variant without dependencies", func() {
+		for _, f := range []string{"bin/build", "bin/detect"} {
+			writeFile(t, filepath.Join(root, f), f, 0755)
+		}
+		writeFile(t, filepath.Join(root, "buildpack.toml"), `api = "0.2"`, 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin", "buildpack.toml"}
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+		p.Variant = libjavabuildpack.VariantDetectOnly
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"bin/detect", "buildpack.toml"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("selects the files of a variant from directory include entries", func() {
+		for _, f := range []string{"bin/build", "bin/detect", "lib/test.jar"} {
+			writeFile(t, filepath.Join(root, f), f, 0755)
+		}
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin", "lib"}
+		p.Buildpack.Metadata["variants"] = map[string]interface{}{
+			"runtime-only": map[string]interface{}{"include_files": []interface{}{"lib"}},
+		}
+		p.Variant = libjavabuildpack.VariantRuntimeOnly
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"lib/test.jar"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("writes the dependencies of dependency files into the packaged buildpack.toml", func() {
+		dependency := func(table string, id string, sha256 string) string {
+			return fmt.Sprintf(`
+[[%s]]
+id = "%s"
+name = "test-name"
+version = "1.0"
+uri = "http://localhost/test-archive.zip"
+sha256 = "%s"
+stacks = ["test-stack"]
+
+  [[%s.licenses]]
+  type = "test-type"
+`, table, id, sha256, table)
+		}
+
+		descriptor := `[buildpack]
+id = "test-id"
+name = "test-name"
+version = "1.0"
+
+[metadata]
+include_files = ["buildpack.toml"]
+` + dependency("metadata.dependencies", "test-id-inline", "test-sha256-inline")
+
+		writeFile(t, filepath.Join(root, "buildpack.toml"), descriptor, 0644)
+
+		file := dependency("dependencies", "test-id-file", "test-sha256-file")
+		writeFile(t, filepath.Join(root, "dependencies", "a.toml"), file, 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"buildpack.toml"}
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id-inline", "1.0", "http://localhost/test-archive.zip", "test-sha256-inline"),
+		}
+		p.Buildpack.DependencyFiles = []string{"dependencies/a.toml"}
+
+		p.Cache = fixtureCache(t, root, "test-sha256-inline", "test-sha256-file")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		packaged := filepath.Join(root, "packaged")
+		archive := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+		writeFile(t, filepath.Join(packaged, "buildpack.toml"), archiveFile(t, archive, "buildpack.toml"), 0644)
+
+		d, err := libjavabuildpack.Buildpack{Buildpack: libbuildpack.Buildpack{Root: packaged}}.Descriptor()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var actual []string
+		for _, dep := range d.Metadata.Dependencies {
+			actual = append(actual, dep.ID)
+		}
+
+		if expected := []string{"test-id-inline", "test-id-file"}; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("packaged dependencies = %s, expected %s", actual, expected)
+		}
+
+		internal.BeFileLike(t, filepath.Join(root, "buildpack.toml"), 0644, descriptor)
+	})
+
+	it("packages dependencies from an alternate cache", func() {
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"cache/test-sha256/test-archive.zip", "cache/test-sha256/dependency.toml"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("records the source of a dependency in its metadata and the report", func() {
+		dependency := testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256")
+		dependency["source"] = "https://test-host/test-project/releases/tag/v1.0"
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{dependency}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(report.Dependencies) != 1 || report.Dependencies[0].Source != dependency["source"] {
+			t.Errorf("Report.Dependencies = %s, expected source %s", report.Dependencies, dependency["source"])
+		}
+
+		var metadata libjavabuildpack.Dependency
+		err = libjavabuildpack.FromTomlFile(filepath.Join(root, "cache", "test-sha256", "dependency.toml"), &metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if metadata.Source != dependency["source"] {
+			t.Errorf("dependency metadata source = %s, expected %s", metadata.Source, dependency["source"])
+		}
+
+		dependency["source"] = "test-project"
+
+		if _, err := p.Package(); err == nil {
+			t.Errorf("Packager.Package() = nil, expected error for source that is not an absolute URI")
+		}
+	})
+
+	it("regenerates missing metadata of a cached artifact instead of downloading it", func() {
+		sha256 := "65f802f2aa2bfc68deb5c831f08754b0fa26c8f7c40d0859c230fbf4c40fc095"
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", sha256),
+		}
+
+		if err := libjavabuildpack.CopyFile(test.FixturePath(t, "test-archive.zip"),
+			filepath.Join(root, "cache", sha256, "test-archive.zip")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		internal.FileExists(t, filepath.Join(root, "cache", sha256, "dependency.toml"))
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{
+			fmt.Sprintf("cache/%s/test-archive.zip", sha256), fmt.Sprintf("cache/%s/dependency.toml", sha256),
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("returns error if a dependency verify command rejects its artifact", func() {
+		writeFile(t, filepath.Join(root, "bin", "verify-zip"), `#!/bin/sh
+[ "$(head -c 2 "$1")" = "PK" ]
+`, 0755)
+
+		valid := testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256-1")
+		valid["verify"] = "bin/verify-zip"
+
+		malformed := testDependency("test-id", "2.0", "http://localhost/test-archive.zip", "test-sha256-2")
+		malformed["verify"] = "bin/verify-zip"
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{valid}
+
+		cache := test.NewDependencyCache(t, filepath.Join(root, "cache"))
+		cache.AddFixture(t, "test-sha256-1", "test-archive.zip")
+		cache.AddFixture(t, "test-sha256-2", "test-archive.tar.gz")
+		p.Cache = cache
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{malformed}
+
+		err := p.Create()
+		if err == nil || !strings.Contains(err.Error(), "test-id 2.0 failed verification with bin/verify-zip") {
+			t.Errorf("Packager.Create() = %v, expected verification failure", err)
+		}
+	})
+
+	it("warns about, and under strict returns error for, a dependency past its end of life", func() {
+		dependency := testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256")
+		dependency["eol_date"] = "2020-01-01"
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{dependency}
+		p.Clock = func() time.Time { return time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(info.String(), "dependency test-id 1.0 reached end of life on 2020-01-01") {
+			t.Errorf("Packager.Create() info = %s, expected end of life warning", info.String())
+		}
+
+		p.Strict = true
+
+		err := p.Create()
+		if err == nil || err.Error() != "dependency test-id 1.0 reached end of life on 2020-01-01" {
+			t.Errorf("Packager.Create() = %v, expected end of life error", err)
+		}
+	})
+
+	it("warns about, and under strict returns error for, a dependency uri with undefined variables", func() {
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://${TEST_UNDEFINED}/test-archive.zip", "test-sha256"),
+		}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(info.String(),
+			"dependency uri http://${TEST_UNDEFINED}/test-archive.zip references undefined environment variables "+
+				"[TEST_UNDEFINED]") {
+			t.Errorf("Packager.Create() info = %s, expected undefined environment variable warning", info.String())
+		}
+
+		metadata := archiveFile(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"),
+			"cache/test-sha256/dependency.toml")
+		if !strings.Contains(metadata, `uri = "http://${TEST_UNDEFINED}/test-archive.zip"`) {
+			t.Errorf("dependency.toml = %s, expected unexpanded uri", metadata)
+		}
+
+		p.Strict = true
+
+		err := p.Create()
+		if err == nil || !strings.Contains(err.Error(), "undefined environment variables [TEST_UNDEFINED]") {
+			t.Errorf("Packager.Create() = %v, expected undefined environment variable error", err)
+		}
+	})
+
+	it("packages only dependencies in the selected groups", func() {
+		grouped := func(id string, sha256 string, group string) map[string]interface{} {
+			d := testDependency(id, "1.0", "http://localhost/test-archive.zip", sha256)
+			if group != "" {
+				d["group"] = group
+			}
+			return d
+		}
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			grouped("test-id-1", "test-sha256-1", "jdk"),
+			grouped("test-id-2", "test-sha256-2", "agents"),
+			grouped("test-id-3", "test-sha256-3", "profilers"),
+			grouped("test-id-4", "test-sha256-4", ""),
+		}
+		p.Groups = []string{"jdk", "profilers"}
+
+		p.Cache = fixtureCache(t, root, "test-sha256-1", "test-sha256-3", "test-sha256-4")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{
+			"cache/test-sha256-1/test-archive.zip", "cache/test-sha256-1/dependency.toml",
+			"cache/test-sha256-3/test-archive.zip", "cache/test-sha256-3/dependency.toml",
+			"cache/test-sha256-4/test-archive.zip", "cache/test-sha256-4/dependency.toml",
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("packages only the configured dependency metadata fields", func() {
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+		p.MetadataFields = []string{"sha256", "uri", "test-unknown"}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		extracted := filepath.Join(root, "extracted")
+		archive := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+		if err := libjavabuildpack.ExtractTarGz(archive, extracted, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		internal.BeFileLike(t, filepath.Join(extracted, "cache", "test-sha256", "dependency.toml"), 0644,
+			`sha256 = "test-sha256"
+uri = "http://localhost/test-archive.zip"
+`)
+	})
+
+	it("packages dependency metadata rewritten by the metadata transform", func() {
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+		p.MetadataFields = []string{"id", "sha256"}
+		p.MetadataTransform = func(dep libjavabuildpack.Dependency, meta map[string]interface{}) error {
+			meta["ticket"] = "TEST-" + dep.ID
+			return nil
+		}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		extracted := filepath.Join(root, "extracted")
+		if err := libjavabuildpack.ExtractTarGz(report.Archive, extracted, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		internal.BeFileLike(t, filepath.Join(extracted, "cache", "test-sha256", "dependency.toml"), 0644,
+			`id = "test-id"
+sha256 = "test-sha256"
+ticket = "TEST-test-id"
+`)
+	})
+
+	when("dependency policy", func() {
+
+		it("returns error for a dependency not in allowed dependencies or in denied dependencies", func() {
+			p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+				testDependency("openjdk-jdk", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+				testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+			}
+			p.Cache = fixtureCache(t, root, "test-sha256")
+
+			for _, c := range []struct {
+				name     string
+				allowed  []string
+				denied   []string
+				expected string
+			}{
+				{"not allowed", []string{"openjdk-*"}, nil, "dependency test-id is not allowed"},
+				{"denied", []string{"*"}, []string{"test-*"}, "dependency test-id is denied"},
+			} {
+				p.AllowedDependencies = c.allowed
+				p.DeniedDependencies = c.denied
+
+				if err := p.Create(); err == nil || err.Error() != c.expected {
+					t.Errorf("%s: Packager.Create() = %v, expected %s", c.name, err, c.expected)
+				}
+			}
+		})
+
+		it("returns error for an http dependency uri when https is required", func() {
+			p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+				testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+				testDependency("test-id", "2.0", "https://localhost/test-archive.zip", "test-sha256"),
+			}
+
+			p.Cache = fixtureCache(t, root, "test-sha256")
+
+			if err := p.Create(); err != nil {
+				t.Errorf("Packager.Create() = %s, expected nil when https is not required", err)
+			}
+
+			p.RequireHTTPS = true
+
+			err := p.Create()
+			expected := "dependencies must use https uris: test-id 1.0 (http://localhost/test-archive.zip)"
+			if err == nil || err.Error() != expected {
+				t.Errorf("Packager.Create() = %v, expected %s", err, expected)
+			}
+		})
+
+		it("returns error for insecure downloads when https is required", func() {
+			defer test.ReplaceEnv(t, "TEST_SCHEME", "http")()
+
+			sha256 := "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273"
+			oci := fmt.Sprintf("oci://localhost:5000/test-repository@sha256:%s", sha256)
+			expanded := "${TEST_SCHEME}://localhost/test-archive.zip"
+
+			for _, c := range []struct {
+				name     string
+				uri      string
+				catalog  string
+				expected string
+			}{
+				{
+					name:     "an oci uri of an insecure registry",
+					uri:      oci,
+					expected: fmt.Sprintf("dependencies must use https uris: test-id 1.0 (%s)", oci),
+				},
+				{
+					name:     "a uri that expands to http",
+					uri:      expanded,
+					expected: fmt.Sprintf("dependencies must use https uris: test-id 1.0 (%s)", expanded),
+				},
+				{
+					name:     "an http catalog uri",
+					uri:      "https://localhost/test-archive.zip",
+					catalog:  "http://localhost/test-catalog.json",
+					expected: "catalog must use an https uri: http://localhost/test-catalog.json",
+				},
+			} {
+				p := newPackager(root, nil, nil)
+				p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+					testDependency("test-id", "1.0", c.uri, sha256),
+				}
+				p.Buildpack.Catalog.URI = c.catalog
+				p.RequireHTTPS = true
+
+				cache := p.Cache.(libjavabuildpack.Cache)
+				cache.InsecureRegistries = []string{"localhost:5000"}
+				p.Cache = cache
+
+				if err := p.Create(); err == nil || err.Error() != c.expected {
+					t.Errorf("%s: Packager.Create() = %v, expected %s", c.name, err, c.expected)
+				}
+			}
+		})
+	})
+
+	it("packages only dependencies for the selected arch", func() {
+		amd64 := testDependency("openjdk-jdk", "11.0.0", "http://localhost/test-archive.zip", "test-sha256-amd64")
+		amd64["arch"] = "amd64"
+		arm64 := testDependency("openjdk-jdk", "11.0.0", "http://localhost/test-archive.zip", "test-sha256-arm64")
+		arm64["arch"] = "arm64"
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{amd64, arm64}
+		p.Arch = "arm64"
+
+		p.Cache = fixtureCache(t, root, "test-sha256-arm64")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"cache/test-sha256-arm64/test-archive.zip", "cache/test-sha256-arm64/dependency.toml"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("orders dependency entries independent of declaration order", func() {
+		deps := []map[string]interface{}{
+			testDependency("test-id-b", "1.0", "http://localhost/test-archive.zip", "test-sha256-b1"),
+			testDependency("test-id-a", "2.0", "http://localhost/test-archive.zip", "test-sha256-a2"),
+			testDependency("test-id-a", "1.0", "http://localhost/test-archive.zip", "test-sha256-a1"),
+		}
+
+		cache := fixtureCache(t, root, "test-sha256-a1", "test-sha256-a2", "test-sha256-b1")
+
+		var entries [][]string
+		for _, order := range [][]int{{0, 1, 2}, {2, 0, 1}} {
+			p := newPackager(root, nil, nil)
+			p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+				deps[order[0]], deps[order[1]], deps[order[2]],
+			}
+			p.Cache = cache
+
+			if err := p.Create(); err != nil {
+				t.Fatal(err)
+			}
+
+			archive := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+			entries = append(entries, archiveEntries(t, archive))
+		}
+
+		if !reflect.DeepEqual(entries[0], entries[1]) {
+			t.Errorf("archive entries = %s and %s, expected to be identical", entries[0], entries[1])
+		}
+
+		if entries[0][0] != "cache/test-sha256-a1/test-archive.zip" {
+			t.Errorf("archive entries = %s, expected to start with cache/test-sha256-a1/test-archive.zip", entries[0])
+		}
+	})
+
+	it("warns when a dependency is behind the latest version", func() {
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "11.0.1", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+		p.CheckFreshness = true
+		p.LatestVersions = map[string]string{"test-id": "11.0.20"}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(info.String(), "Dependency test-id is pinned to 11.0.1 but 11.0.20 is available") {
+			t.Errorf("Packager.Create() info = %s, expected freshness warning", info.String())
+		}
+	})
+
+	it("includes generated usage listing packaged dependency versions", func() {
+		grouped := testDependency("test-id", "3.0", "http://localhost/test-archive.zip", "test-sha256-3")
+		grouped["group"] = "test-group"
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+			testDependency("test-id", "2.0", "http://localhost/test-archive.zip", "test-sha256-2"),
+			grouped,
+		}
+		p.GenerateUsage = true
+		p.Groups = []string{"other-group"}
+
+		p.Cache = fixtureCache(t, root, "test-sha256", "test-sha256-2")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		archive := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+
+		actual := archiveEntries(t, archive)
+		if actual[len(actual)-1] != "USAGE.md" {
+			t.Errorf("archive entries = %s, expected to contain USAGE.md", actual)
+		}
+
+		usage := archiveFile(t, archive, "USAGE.md")
+
+		for _, v := range []string{"`test-id` 1.0", "`test-id` 2.0"} {
+			if !strings.Contains(usage, v) {
+				t.Errorf("USAGE.md = %s, expected to contain %s", usage, v)
+			}
+		}
+
+		if strings.Contains(usage, "`test-id` 3.0") {
+			t.Errorf("USAGE.md = %s, expected not to contain dependency outside of selected groups", usage)
+		}
+
+		if exists, err := libjavabuildpack.FileExists(filepath.Join(root, "USAGE.md")); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected USAGE.md not to be written into the buildpack root")
+		}
+	})
+
+	it("includes a version marker with the buildpack api version", func() {
+		writeFile(t, filepath.Join(root, "buildpack.toml"), `api = "0.2"
+
+[buildpack]
+id = "test-id"
+name = "test-name"
+version = "1.0"
+`, 0644)
+
+		p.VersionMarker = true
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		archive := filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz")
+
+		actual := archiveEntries(t, archive)
+		if actual[len(actual)-1] != ".bpversion" {
+			t.Errorf("archive entries = %s, expected to contain .bpversion", actual)
+		}
+
+		var marker struct {
+			API     string `toml:"api"`
+			Version string `toml:"version"`
+		}
+		if _, err := toml.Decode(archiveFile(t, archive, ".bpversion"), &marker); err != nil {
+			t.Fatal(err)
+		}
+
+		if marker.API != "0.2" || marker.Version != "1.0" {
+			t.Errorf(".bpversion = %+v, expected api 0.2 and version 1.0", marker)
+		}
+
+		if exists, err := libjavabuildpack.FileExists(filepath.Join(root, ".bpversion")); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected .bpversion not to be written into the buildpack root")
+		}
+	})
+
+	it("warns about files sourced by included scripts that are not included", func() {
+		writeFile(t, filepath.Join(root, "bin", "build"), `#!/usr/bin/env bash
+set -euo pipefail
+
+source "$(dirname "$0")/common.sh"
+. "${BASH_SOURCE%/*}/missing.sh"
+`, 0755)
+
+		writeFile(t, filepath.Join(root, "bin", "common.sh"), "test-common", 0644)
+
+		writeFile(t, filepath.Join(root, "lib", "test.jar"), "test-jar\n. bin/missing.sh\n", 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/build", "bin/common.sh", "lib/test.jar"}
+		p.CheckScriptReferences = true
+
+		if _, err := p.Package(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(info.String(), "bin/build sources bin/missing.sh, which is not included") {
+			t.Errorf("output = %s, expected warning about bin/missing.sh", info.String())
+		}
+
+		if strings.Contains(info.String(), "common.sh, which is not included") {
+			t.Errorf("output = %s, expected no warning about bin/common.sh", info.String())
+		}
+
+		if strings.Contains(info.String(), "lib/test.jar sources") {
+			t.Errorf("output = %s, expected no warning about lib/test.jar, which is not a shell script", info.String())
+		}
+
+		p.Strict = true
+
+		expected := "bin/build sources bin/missing.sh, which is not included"
+		if _, err := p.Package(); err == nil || err.Error() != expected {
+			t.Errorf("error = %v, expected %s", err, expected)
+		}
+	})
+
+	it("packages from a read-only cache only when offline", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "test-payload")
+		}))
+		defer server.Close()
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", server.URL+"/test-path",
+				"6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273"),
+		}
+
+		cache := p.Cache.(libjavabuildpack.Cache)
+		cache.BuildpackCacheRoot = filepath.Join(root, "buildpack-cache")
+		p.Cache = cache
+
+		if _, err := p.Package(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chmod(cache.Root, 0555); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(cache.Root, 0755)
+
+		_, err := p.Package()
+		if err == nil || !strings.HasPrefix(err.Error(), fmt.Sprintf("cache root %s is not writable", cache.Root)) {
+			t.Fatalf("error = %v, expected cache root %s is not writable", err, cache.Root)
+		}
+
+		p.Offline = true
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{
+			"cache/6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273/test-path",
+			"cache/6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273/dependency.toml",
+		}
+		if actual := archiveEntries(t, report.Archive); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("writes a builder referencing the buildpack", func() {
+		p.Buildpack.Stacks = []libbuildpack.BuildpackStack{
+			{ID: "test-stack", BuildImages: []string{"test-build-image"}, RunImages: []string{"test-run-image"}},
+		}
+		p.Builder = &libjavabuildpack.BuilderStack{RunImage: "test-run-image-override"}
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := report.Archive + ".builder.toml"; report.Builder != expected {
+			t.Errorf("Builder = %s, expected %s", report.Builder, expected)
+		}
+
+		internal.BeFileLike(t, report.Builder, 0644, `[[buildpacks]]
+  id = "test-id"
+  uri = "test-id-1.0.tgz"
+
+[[order]]
+
+  [[order.group]]
+    id = "test-id"
+    version = "1.0"
+
+[stack]
+  id = "test-stack"
+  build-image = "test-build-image"
+  run-image = "test-run-image-override"
+`)
+	})
+
+	it("writes the archive directly into the output directory with flat output", func() {
+		p.FlatOutput = true
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := filepath.Join(root, "output", "test-id-1.0.tgz"); report.Archive != expected {
+			t.Errorf("Archive = %s, expected %s", report.Archive, expected)
+		}
+
+		internal.FileExists(t, filepath.Join(root, "output", "test-id-1.0.tgz"))
+	})
+
+	it("includes a stacks file with the declared stacks", func() {
+		p.Buildpack.Stacks = []libbuildpack.BuildpackStack{{ID: "test-stack-1"}, {ID: "test-stack-2"}}
+		p.StacksFile = true
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual := archiveEntries(t, report.Archive); !reflect.DeepEqual(actual, []string{"stacks.toml"}) {
+			t.Errorf("archive entries = %s, expected [stacks.toml]", actual)
+		}
+
+		var stacks struct {
+			Stacks []struct {
+				ID string `toml:"id"`
+			} `toml:"stacks"`
+		}
+		if _, err := toml.Decode(archiveFile(t, report.Archive, "stacks.toml"), &stacks); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(stacks.Stacks) != 2 || stacks.Stacks[0].ID != "test-stack-1" || stacks.Stacks[1].ID != "test-stack-2" {
+			t.Errorf("stacks.toml = %+v, expected test-stack-1 and test-stack-2", stacks)
+		}
+
+		if exists, err := libjavabuildpack.FileExists(filepath.Join(root, "stacks.toml")); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected stacks.toml not to be written into the buildpack root")
+		}
+	})
+
+	it("outputs multiple formats from a single pass", func() {
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+		p.Formats = []libjavabuildpack.Format{libjavabuildpack.FormatTarGz, libjavabuildpack.FormatDirectory}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		output := filepath.Join(root, "output", "test-id", "test-id", "1.0")
+
+		for _, entry := range archiveEntries(t, filepath.Join(output, "test-id-1.0.tgz")) {
+			internal.FileExists(t, filepath.Join(output, "test-id-1.0", entry))
+		}
+		test.BeFileLike(t, filepath.Join(output, "test-id-1.0", "bin", "detect"), 0755, "test-detect")
+	})
+
+	it("outputs an uncompressed tar", func() {
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		p.Formats = []libjavabuildpack.Format{libjavabuildpack.FormatTar}
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if filepath.Ext(report.Tar) != ".tar" {
+			t.Errorf("Report.Tar = %s, expected .tar extension", report.Tar)
+		}
+
+		f, err := os.Open(report.Tar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		tr := tar.NewReader(f)
+		h, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.Name != "bin/detect" || string(b) != "test-detect" {
+			t.Errorf("tar entry = %s %s, expected bin/detect test-detect", h.Name, b)
+		}
+
+		if _, err := tr.Next(); err != io.EOF {
+			t.Errorf("tar has entries after bin/detect, expected a single entry")
+		}
+	})
+
+	it("stores zip entries below the compress threshold", func() {
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+		writeFile(t, filepath.Join(root, "lib", "test-large"), strings.Repeat("test-large", 1024), 0644)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect", "lib/test-large"}
+		p.Formats = []libjavabuildpack.Format{libjavabuildpack.FormatZip}
+		p.CompressThreshold = 1024
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		z, err := zip.OpenReader(report.Zip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer z.Close()
+
+		methods := make(map[string]uint16)
+		for _, f := range z.File {
+			methods[f.Name] = f.Method
+		}
+
+		expected := map[string]uint16{"bin/detect": zip.Store, "lib/test-large": zip.Deflate}
+		if !reflect.DeepEqual(methods, expected) {
+			t.Errorf("zip methods = %v, expected %v", methods, expected)
+		}
+	})
+
+	it("outputs an OCI layer with a diffID of the uncompressed layer", func() {
+		writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/detect"}
+		p.Formats = []libjavabuildpack.Format{libjavabuildpack.FormatOCILayer}
+
+		report, err := p.Package()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(report.OCILayer.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		digest := sha256.New()
+		gz, err := gzip.NewReader(io.TeeReader(f, digest))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		layer, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		tr := tar.NewReader(bytes.NewReader(layer))
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, h.Name)
+		}
+		diffID := sha256.Sum256(layer)
+		if expected := "sha256:" + hex.EncodeToString(diffID[:]); report.OCILayer.DiffID != expected {
+			t.Errorf("OCILayer.DiffID = %s, expected %s", report.OCILayer.DiffID, expected)
+		}
+
+		if expected := "sha256:" + hex.EncodeToString(digest.Sum(nil)); report.OCILayer.Digest != expected {
+			t.Errorf("OCILayer.Digest = %s, expected %s", report.OCILayer.Digest, expected)
+		}
+
+		expected := []string{"cnb/", "cnb/buildpacks/", "cnb/buildpacks/test-id/", "cnb/buildpacks/test-id/1.0/",
+			"cnb/buildpacks/test-id/1.0/bin/detect"}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("layer entries = %s, expected %s", names, expected)
+		}
+	})
+
+	it("packages dependencies at their destination", func() {
+		dep := testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256")
+		dep["destination"] = "lib/test-id"
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{dep}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"lib/test-id/test-archive.zip", "lib/test-id/dependency.toml"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("fetches and verifies an overridden dependency", func() {
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+		p.DependencyOverrides = map[string]libjavabuildpack.DependencyOverride{
+			"test-id": {
+				URI:    "http://test.com/test-override.zip",
+				SHA256: "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273",
+			},
+		}
+
+		defer gock.Off()
+
+		gock.New("http://test.com").
+			Get("/test-override.zip").
+			Reply(200).
+			BodyString("test-payload")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !gock.IsDone() {
+			t.Errorf("Expected overridden dependency to be downloaded")
+		}
+
+		if !strings.Contains(info.String(), "uri http://test.com/test-override.zip") {
+			t.Errorf("Packager.Create() info = %s, expected effective override to be logged", info.String())
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{
+			"cache/6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273/test-override.zip",
+			"cache/6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273/dependency.toml",
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("caps retries across downloads with a retry budget", func() {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", server.URL+"/test-archive-1.zip", "test-sha256-1"),
+			testDependency("test-id", "2.0", server.URL+"/test-archive-2.zip", "test-sha256-2"),
+		}
+		p.RetryBudget = 2
+
+		cache := p.Cache.(libjavabuildpack.Cache)
+		cache.Retries = 3
+		p.Cache = cache
+
+		start := time.Now()
+		err := p.Create()
+		if err == nil || !strings.Contains(err.Error(), "retry budget exhausted") {
+			t.Errorf("Packager.Create() = %v, expected retry budget to be exhausted", err)
+		}
+
+		if n := atomic.LoadInt32(&requests); n != 3 {
+			t.Errorf("requests = %d, expected 1 attempt and 2 retries", n)
+		}
+
+		if elapsed := time.Since(start); elapsed < 750*time.Millisecond {
+			t.Errorf("Packager.Create() took %s, expected to back off for 250ms and 500ms before the retries", elapsed)
+		}
+	})
+
+	it("limits the download rate to the maximum rate", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("test-payload"))
+		}))
+		defer server.Close()
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", server.URL+"/test-archive.zip",
+				"6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273"),
+		}
+		p.MaxDownloadBytesPerSecond = 24
+
+		start := time.Now()
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+			t.Errorf("Packager.Create() took %s, expected at least 500ms at 24 B/s", elapsed)
+		}
+	})
+
+	it("packages dependencies sharing a digest once when pinned to digest", func() {
+		sha256 := "6f06dd0e26608013eff30bb1e951cda7de3fdd9e78e907470e0dd5c0ed25e273"
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", sha256),
+			testDependency("test-id", "1.0.1", "http://localhost/test-archive.zip", sha256),
+		}
+		p.PinToDigest = true
+		p.Cache = libjavabuildpack.Cache{Cache: libbuildpack.Cache{Root: filepath.Join(root, "cache")}}
+
+		// A download cached for another version is only reused if the Cache is pinned to digest as well.
+		layer := filepath.Join(root, "cache", sha256)
+		writeFile(t, filepath.Join(layer, "dependency.toml"), `id = "test-id"
+name = "test-name"
+version = "0.9"
+uri = "http://localhost/test-archive.zip"
+sha256 = "`+sha256+`"
+stacks = ["test-stack"]
+`, 0644)
+
+		writeFile(t, filepath.Join(layer, "test-archive.zip"), "test-payload", 0644)
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := strings.Count(info.String(), "Caching"); n != 1 {
+			t.Errorf("Packager.Create() info = %s, expected a single dependency to be cached", info.String())
+		}
+
+		extracted := filepath.Join(root, "extracted")
+		if err := libjavabuildpack.ExtractTarGz(filepath.Join(root, "output", "test-id", "test-id", "1.0",
+			"test-id-1.0.tgz"), extracted, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		deps, err := p.Buildpack.Dependencies()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		build := libjavabuildpack.Cache{
+			Cache:              libbuildpack.Cache{Root: filepath.Join(root, "build-cache")},
+			BuildpackCacheRoot: filepath.Join(extracted, "cache"),
+		}
+
+		for _, dep := range deps {
+			a, err := build.DownloadLayer(dep).Artifact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := filepath.Join(extracted, "cache", sha256, "test-archive.zip"); a != expected {
+				t.Errorf("DownloadCacheLayer.Artifact() for %s = %s, expected %s", dep.Version.Original(), a, expected)
+			}
+		}
+	})
+
+	it("packages files selected from a dependency artifact", func() {
+		dep := testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256")
+		dep["destination"] = "lib/test-id"
+		dep["select"] = []interface{}{"fileA.txt", "dirA/*B.txt"}
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{dep}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"lib/test-id/dirA/fileB.txt", "lib/test-id/fileA.txt"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("returns error if dependency destination is outside of the buildpack", func() {
+		dep := testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256")
+		dep["destination"] = "lib/../../test-id"
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{dep}
+
+		err := p.Create()
+		if err == nil || !strings.Contains(err.Error(), "outside of the buildpack") {
+			t.Errorf("Packager.Create() = %v, expected destination outside of the buildpack", err)
+		}
+	})
+
+	it("writes no archive if verification fails", func() {
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+
+		p.Cache = fixtureCache(t, root, "test-sha256")
+
+		err := p.VerifyAndCreate(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "sha256 mismatch") {
+			t.Errorf("Packager.VerifyAndCreate() = %v, expected sha256 mismatch", err)
+		}
+
+		if exists, err := libjavabuildpack.FileExists(filepath.Join(root, "output")); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected no archive to be written")
+		}
+	})
+
+	it("runs the pre-package script once when verifying and creating", func() {
+		writeFile(t, filepath.Join(root, "scripts", "test-pre-package.sh"), `#!/bin/sh
+echo run >> runs
+`, 0755)
+
+		p.Buildpack.Metadata["pre_package"] = "scripts/test-pre-package.sh"
+
+		if err := p.VerifyAndCreate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		internal.BeFileLike(t, filepath.Join(root, "runs"), 0644, "run\n")
+	})
+
+	it("stops creating the archive when ctx is done after verification", func() {
+		var deps []map[string]interface{}
+		for _, sha256 := range []string{"test-sha256-1", "test-sha256-2"} {
+			dep := testDependency("test-id-"+sha256, "1.0", "http://localhost/test-archive.zip", sha256)
+			dep["skip_checksum"] = true
+			deps = append(deps, dep)
+		}
+
+		p.Buildpack.Metadata["dependencies"] = deps
+
+		cache := fixtureCache(t, root, "test-sha256-1", "test-sha256-2")
+
+		// Verification acquires both artifacts, so the third acquisition is the first of the create step.
+		ctx, cancel := context.WithCancel(context.Background())
+		p.Cache = &cancellingCache{DependencyCache: cache, cancel: cancel, after: 3}
+
+		if err := p.VerifyAndCreate(ctx); err != context.Canceled {
+			t.Errorf("Packager.VerifyAndCreate() = %v, expected %v", err, context.Canceled)
+		}
+
+		if exists, err := libjavabuildpack.FileExists(filepath.Join(root, "output")); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected no archive to be written")
+		}
+	})
+
+	it("packages a composite buildpack", func() {
+		writeFile(t, filepath.Join(root, "order.toml"), `[[order]]
+  [[order.group]]
+    id = "test.buildpack-1"
+    version = "1.0"
+`, 0644)
+
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "http://localhost/test-archive.zip", "test-sha256"),
+		}
+
+		if err := p.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+		expected := []string{"order.toml"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("archive entries = %s, expected %s", actual, expected)
+		}
+	})
+
+	it("returns error for a composite buildpack whose order.toml has no order groups", func() {
+		writeFile(t, filepath.Join(root, "order.toml"), `[[groups]]
+  [[groups.buildpacks]]
+    id = "test.buildpack-1"
+`, 0644)
+
+		err := p.Create()
+		if err == nil || !strings.Contains(err.Error(), "at least one group") {
+			t.Errorf("Packager.Create() = %v, expected order without groups", err)
+		}
+	})
+
+	it("returns error for a composite buildpack with a malformed buildpack id", func() {
+		writeFile(t, filepath.Join(root, "order.toml"), `[[order]]
+  [[order.group]]
+    id = "test buildpack"
+`, 0644)
+
+		err := p.Create()
+		if err == nil || !strings.Contains(err.Error(), "malformed") {
+			t.Errorf("Packager.Create() = %v, expected malformed buildpack id", err)
+		}
+	})
+
+	when("entry names", func() {
+
+		it("strips leading slashes", func() {
+			writeFile(t, filepath.Join(root, "bin", "detect"), "test-detect", 0755)
+
+			p.Buildpack.Metadata["include_files"] = []interface{}{"/bin/detect"}
+
+			if err := p.Create(); err != nil {
+				t.Fatal(err)
+			}
+
+			actual := archiveEntries(t, filepath.Join(root, "output", "test-id", "test-id", "1.0", "test-id-1.0.tgz"))
+
+			expected := []string{"bin/detect"}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("archive entries = %s, expected %s", actual, expected)
+			}
+		})
+
+		it("returns error if an entry name contains a backslash", func() {
+			writeFile(t, filepath.Join(root, `lib\test.jar`), "test-jar", 0644)
+
+			p.Buildpack.Metadata["include_files"] = []interface{}{`lib\test.jar`}
+
+			err := p.Create()
+			if err == nil || !strings.Contains(err.Error(), "contains a backslash") {
+				t.Errorf("Packager.Create() = %v, expected backslash error", err)
+			}
+		})
+
+		it("returns error if an entry name escapes the archive root", func() {
+			outside := filepath.Base(root) + "-outside"
+			writeFile(t, filepath.Join(root, "..", outside), "test-outside", 0644)
+			defer os.Remove(filepath.Join(root, "..", outside))
+
+			p.Buildpack.Metadata["include_files"] = []interface{}{"../" + outside}
+
+			err := p.Create()
+			if err == nil || !strings.Contains(err.Error(), "escapes the archive root") {
+				t.Errorf("Packager.Create() = %v, expected escape error", err)
+			}
+		})
+
+		it("returns error if a directory entry name escapes the directory", func() {
+			outside := filepath.Base(root) + "-outside"
+			writeFile(t, filepath.Join(root, "..", outside), "test-outside", 0644)
+			defer os.Remove(filepath.Join(root, "..", outside))
+
+			p.Buildpack.Metadata["include_files"] = []interface{}{"../" + outside}
+			p.Formats = []libjavabuildpack.Format{libjavabuildpack.FormatDirectory}
+
+			err := p.Create()
+			if err == nil || !strings.Contains(err.Error(), "escapes the archive root") {
+				t.Errorf("Packager.Create() = %v, expected escape error", err)
+			}
+
+			written := filepath.Join(root, "output", "test-id", "test-id", "1.0", outside)
+			if exists, err := libjavabuildpack.FileExists(written); err != nil {
+				t.Fatal(err)
+			} else if exists {
+				t.Errorf("Expected %s not to be written", written)
+			}
+		})
+	})
+
+	when("snapshot", func() {
+
+		it("reports the resolved path of a snapshot archive", func() {
+			p.Buildpack.Info.Version = "1.0.0-SNAPSHOT"
+
+			report, err := p.Package()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := filepath.Join(root, "output", "test-id", "test-id", "1.0.0-SNAPSHOT")
+			archiveMatches(t, dir, `^test-id-1\.0\.0-[0-9]{8}\.[0-9]{6}-1\.tgz$`)
+
+			matches, err := filepath.Glob(filepath.Join(dir, "*.tgz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(matches) != 1 || report.Archive != matches[0] {
+				t.Errorf("Report.Archive = %s, expected %s", report.Archive, matches)
+			}
+		})
+
+		it("substitutes only the snapshot of the version", func() {
+			for _, c := range []struct {
+				name    string
+				id      string
+				version string
+				pattern string
+			}{
+				{"mixed-case", "test-id", "1.0.0-Snapshot", `^test-id-1\.0\.0-[0-9]{8}\.[0-9]{6}-1\.tgz$`},
+				{"suffixed", "test-id", "1.0.0-RC1-snapshot.2", `^test-id-1\.0\.0-RC1-[0-9]{8}\.[0-9]{6}-1\.2\.tgz$`},
+				{"snapshot id", "test-snapshot-id", "1.0.0-SNAPSHOT",
+					`^test-snapshot-id-1\.0\.0-[0-9]{8}\.[0-9]{6}-1\.tgz$`},
+				{"snapshot id only", "test-snapshot-id", "1.0", `^test-snapshot-id-1\.0\.tgz$`},
+			} {
+				p.Buildpack.Info.ID = c.id
+				p.Buildpack.Info.Version = c.version
+
+				if err := p.Create(); err != nil {
+					t.Fatalf("%s: %s", c.name, err)
+				}
+
+				archiveMatches(t, filepath.Join(root, "output", c.id, c.id, c.version), c.pattern)
+			}
+		})
+
+		it("warns when a snapshot version is not substituted", func() {
+			p.Buildpack.Info.Version = "1.0.0-SNAPSHOT"
+			p.FilenameTemplate = "{id}.tgz"
+
+			if err := p.Create(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(info.String(), "version 1.0.0-SNAPSHOT is a snapshot") {
+				t.Errorf("Packager.Create() info = %s, expected snapshot warning", info.String())
+			}
+		})
+	})
+}
+
+func BenchmarkCopyBufferSize(b *testing.B) {
+	root, err := ioutil.TempDir("", "packager")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	payload := bytes.NewReader(make([]byte, 64*1024*1024))
+	if err := libjavabuildpack.WriteToFile(payload, filepath.Join(root, "lib", "test.jar"), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	previous := os.Args
+	os.Args = []string{filepath.Join(root, "bin", "package"), filepath.Join(root, "output")}
+	defer func() { os.Args = previous }()
+
+	for _, size := range []int{32 * 1024, libjavabuildpack.DefaultCopyBufferSize} {
+		b.Run(fmt.Sprintf("%dKB", size/1024), func(b *testing.B) {
+			p := newPackager(root, nil, nil)
+			p.Buildpack.Metadata["include_files"] = []interface{}{"lib/test.jar"}
+			p.CopyBufferSize = size
+
+			for i := 0; i < b.N; i++ {
+				if err := p.Create(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func archiveMatches(t *testing.T, dir string, pattern string) {
+	t.Helper()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || !regexp.MustCompile(pattern).MatchString(files[0].Name()) {
+		t.Errorf("archives in %s = %v, expected a single archive matching %s", dir, files, pattern)
+	}
+}
+
+func testDependency(id string, version string, uri string, sha256 string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       id,
+		"name":     "test-name",
+		"version":  version,
+		"uri":      uri,
+		"sha256":   sha256,
+		"stacks":   []interface{}{"test-stack"},
+		"licenses": []map[string]interface{}{{"type": "test-type"}},
+	}
+}
+
+func archiveEntries(t *testing.T, archive string) []string {
+	t.Helper()
+
+	entries, _ := archiveContents(t, archive)
+	return entries
+}
+
+func archiveFile(t *testing.T, archive string, name string) string {
+	t.Helper()
+
+	_, contents := archiveContents(t, archive)
+
+	content, ok := contents[name]
+	if !ok {
+		t.Fatalf("archive %s has no entry %s", archive, name)
+	}
+
+	return content
+}
+
+// archiveContents returns the names of the entries of a gzipped tar archive, in order, and the content of each entry.
+func archiveContents(t *testing.T, archive string) ([]string, map[string]string) {
+	t.Helper()
+
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []string
+	contents := make(map[string]string)
+
+	if err := internal.WalkTarGz(f, func(header *tar.Header, content io.Reader) error {
+		b, err := ioutil.ReadAll(content)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, header.Name)
+		contents[header.Name] = string(b)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return entries, contents
+}
+
+// writeFile writes content to a file, failing the test if it cannot be written.
+func writeFile(t *testing.T, file string, content string, mode os.FileMode) {
+	t.Helper()
+
+	if err := libjavabuildpack.WriteToFile(strings.NewReader(content), file, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fixtureCache returns a dependency cache that serves the test-archive.zip fixture for each of the sha256s.
+func fixtureCache(t *testing.T, root string, sha256s ...string) *test.DependencyCache {
+	t.Helper()
+
+	cache := test.NewDependencyCache(t, filepath.Join(root, "cache"))
+	for _, sha256 := range sha256s {
+		cache.AddFixture(t, sha256, "test-archive.zip")
+	}
+	return cache
+}
+
+type testSigner struct{}
+
+func (testSigner) Sign(archive io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("test-signature-%d", len(b))), nil
+}
+
+func newPackager(root string, debug io.Writer, info io.Writer) libjavabuildpack.Packager {
+	logger := libjavabuildpack.Logger{Logger: libbuildpack.NewLogger(debug, info)}
+
+	return libjavabuildpack.Packager{
+		Buildpack: libjavabuildpack.Buildpack{
+			Buildpack: libbuildpack.Buildpack{
+				Info:     libbuildpack.BuildpackInfo{ID: "test-id", Name: "test-name", Version: "1.0"},
+				Metadata: make(libbuildpack.BuildpackMetadata),
+				Logger:   logger.Logger,
+				Root:     root,
+			},
+			CacheRoot: filepath.Join(root, "cache"),
+		},
+		Cache: libjavabuildpack.Cache{
+			Cache:              libbuildpack.Cache{Root: filepath.Join(root, "cache"), Logger: logger.Logger},
+			BuildpackCacheRoot: filepath.Join(root, "cache"),
+			Logger:             logger,
+		},
+		Logger: logger,
+	}
+}
+
+// cancellingCache cancels a context once after artifact layers have been requested from it.
+type cancellingCache struct {
+	libjavabuildpack.DependencyCache
+	cancel func()
+	after  int
+	calls  int
+}
+
+func (c *cancellingCache) ArtifactLayer(dependency libjavabuildpack.Dependency) libjavabuildpack.ArtifactLayer {
+	if c.calls++; c.calls == c.after {
+		c.cancel()
+	}
+	return c.DependencyCache.ArtifactLayer(dependency)
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/cloudfoundry/libjavabuildpack/internal"
+)
+
+// PlanFormat is a format that a ResolutionPlan can be written in.
+type PlanFormat string
+
+const (
+	// PlanFormatJSON writes the plan as indented JSON.
+	PlanFormatJSON PlanFormat = "json"
+
+	// PlanFormatTOML writes the plan as TOML.
+	PlanFormatTOML PlanFormat = "toml"
+)
+
+// ResolutionPlan describes how the dependencies of a buildpack resolve for packaging, without any artifact being
+// downloaded.
+type ResolutionPlan struct {
+	// Arch is the architecture resolved for, if Packager.Arch is set.
+	Arch string `json:"arch,omitempty" toml:"arch,omitempty"`
+
+	// Stacks are the ids of the stacks that the buildpack supports.
+	Stacks []string `json:"stacks" toml:"stacks"`
+
+	// Constraints are the catalog version constraints, sorted by id, and the versions that each resolved to.
+	Constraints []PlanConstraint `json:"constraints" toml:"constraints"`
+
+	// Dependencies are the dependencies that would be packaged, sorted by id.
+	Dependencies []PlanDependency `json:"dependencies" toml:"dependencies"`
+
+	// Warnings are the warnings raised by resolution, which fail packaging if Packager.Strict is set.
+	Warnings []string `json:"warnings" toml:"warnings"`
+}
+
+// PlanConstraint is a catalog version constraint and the versions that it resolved to.
+type PlanConstraint struct {
+	// ID is the id of the dependency constrained.
+	ID string `json:"id" toml:"id"`
+
+	// Constraint is the version constraint.
+	Constraint string `json:"constraint" toml:"constraint"`
+
+	// Versions are the versions that would be packaged for the id.
+	Versions []string `json:"versions" toml:"versions"`
+}
+
+// PlanDependency is a dependency that would be packaged.
+type PlanDependency struct {
+	// ID is the id of the dependency.
+	ID string `json:"id" toml:"id"`
+
+	// Version is the version of the dependency.
+	Version string `json:"version" toml:"version"`
+
+	// URI is the location that the dependency would be downloaded from.
+	URI string `json:"uri" toml:"uri"`
+
+	// SHA256 is the sha256 of the dependency.
+	SHA256 string `json:"sha256" toml:"sha256"`
+
+	// Stacks are the ids of the stacks that the dependency is compatible with.
+	Stacks []string `json:"stacks" toml:"stacks"`
+
+	// Arch is the architecture of the dependency, if declared.
+	Arch string `json:"arch,omitempty" toml:"arch,omitempty"`
+
+	// Group is the group of the dependency, if declared.
+	Group string `json:"group,omitempty" toml:"group,omitempty"`
+}
+
+// Write writes the plan to out in the specified format.
+func (r ResolutionPlan) Write(out io.Writer, format PlanFormat) error {
+	switch format {
+	case PlanFormatJSON:
+		e := json.NewEncoder(out)
+		e.SetIndent("", "  ")
+		return e.Encode(r)
+	case PlanFormatTOML:
+		toml, err := internal.ToTomlString(r)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(out, toml)
+		return err
+	default:
+		return fmt.Errorf("unsupported plan format %s", format)
+	}
+}
+
+// Plan resolves the dependencies of the buildpack as Package would, including fetching the catalog, and returns the
+// resolution without downloading any artifact or writing an archive.  The include files and the archive name are
+// checked as well, so that the plan has the warnings that packaging would raise, but the pre-package script is not
+// run and so the files it would write are not checked.
+func (p Packager) Plan() (ResolutionPlan, error) {
+	plan := ResolutionPlan{Arch: p.Arch, Stacks: []string{}, Constraints: []PlanConstraint{},
+		Dependencies: []PlanDependency{}, Warnings: []string{}}
+	p.warnings = &plan.Warnings
+
+	for _, stack := range p.Buildpack.Stacks {
+		plan.Stacks = append(plan.Stacks, stack.ID)
+	}
+
+	deps, err := p.dependencies()
+	if err != nil {
+		return ResolutionPlan{}, err
+	}
+
+	if err := p.checkDependencies(deps); err != nil {
+		return ResolutionPlan{}, err
+	}
+
+	if p.ModTimeSource == ModTimeSourceGitCommit {
+		p.gitCommitTime()
+	}
+
+	if _, err := p.filename(p.now()); err != nil {
+		return ResolutionPlan{}, err
+	}
+
+	if _, err := p.selectIncludeFiles(p.writtenPaths(p.OutputDir, nil)); err != nil {
+		return ResolutionPlan{}, err
+	}
+
+	for _, dep := range deps {
+		plan.Dependencies = append(plan.Dependencies, PlanDependency{
+			ID:      dep.ID,
+			Version: dep.Version.Original(),
+			URI:     dep.URI,
+			SHA256:  dep.SHA256,
+			Stacks:  append([]string{}, dep.Stacks...),
+			Arch:    dep.Arch,
+			Group:   dep.Group,
+		})
+	}
+
+	for id, constraint := range p.Buildpack.Catalog.Constraints {
+		c := PlanConstraint{ID: id, Constraint: constraint, Versions: []string{}}
+
+		for _, dep := range deps {
+			if dep.ID == id {
+				c.Versions = append(c.Versions, dep.Version.Original())
+			}
+		}
+
+		plan.Constraints = append(plan.Constraints, c)
+	}
+
+	sort.Slice(plan.Constraints, func(i, j int) bool {
+		return plan.Constraints[i].ID < plan.Constraints[j].ID
+	})
+
+	return plan, nil
+}
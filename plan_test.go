@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/buildpack/libbuildpack"
+	"github.com/cloudfoundry/libjavabuildpack"
+	"github.com/cloudfoundry/libjavabuildpack/test"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestPlan(t *testing.T) {
+	spec.Run(t, "Plan", testPlan, spec.Report(report.Terminal{}))
+}
+
+func testPlan(t *testing.T, when spec.G, it spec.S) {
+
+	it("plans the resolution of a multi-constraint descriptor", func() {
+		root := test.ScratchDir(t, "plan")
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `[
+  { "id": "test-a", "name": "test-name", "version": "1.0", "uri": "https://localhost/test-a-1.0",
+    "sha256": "test-sha256-a-1.0", "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] },
+  { "id": "test-a", "name": "test-name", "version": "1.5", "uri": "https://localhost/test-a-1.5",
+    "sha256": "test-sha256-a-1.5", "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] },
+  { "id": "test-a", "name": "test-name", "version": "2.0", "uri": "https://localhost/test-a-2.0",
+    "sha256": "test-sha256-a-2.0", "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] },
+  { "id": "test-b", "name": "test-name", "version": "2.1", "uri": "https://localhost/test-b-2.1",
+    "sha256": "test-sha256-b-2.1", "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] },
+  { "id": "test-b", "name": "test-name", "version": "3.0", "uri": "https://localhost/test-b-3.0",
+    "sha256": "test-sha256-b-3.0", "stacks": [ "test-stack" ], "licenses": [ { "type": "test-type" } ] }
+]`)
+		}))
+		defer server.Close()
+
+		p := newPackager(root, nil, nil)
+		p.Buildpack.Stacks = []libbuildpack.BuildpackStack{{ID: "test-stack"}, {ID: "test-stack-uncovered"}}
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "https://localhost/test-id-1.0", "test-sha256"),
+		}
+		p.Buildpack.Catalog = libjavabuildpack.Catalog{
+			URI:         server.URL,
+			Constraints: map[string]string{"test-b": "2.*", "test-a": "1.*"},
+		}
+
+		plan, err := p.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := libjavabuildpack.ResolutionPlan{
+			Stacks: []string{"test-stack", "test-stack-uncovered"},
+			Constraints: []libjavabuildpack.PlanConstraint{
+				{ID: "test-a", Constraint: "1.*", Versions: []string{"1.0", "1.5"}},
+				{ID: "test-b", Constraint: "2.*", Versions: []string{"2.1"}},
+			},
+			Dependencies: []libjavabuildpack.PlanDependency{
+				{ID: "test-a", Version: "1.0", URI: "https://localhost/test-a-1.0", SHA256: "test-sha256-a-1.0",
+					Stacks: []string{"test-stack"}},
+				{ID: "test-a", Version: "1.5", URI: "https://localhost/test-a-1.5", SHA256: "test-sha256-a-1.5",
+					Stacks: []string{"test-stack"}},
+				{ID: "test-b", Version: "2.1", URI: "https://localhost/test-b-2.1", SHA256: "test-sha256-b-2.1",
+					Stacks: []string{"test-stack"}},
+				{ID: "test-id", Version: "1.0", URI: "https://localhost/test-id-1.0", SHA256: "test-sha256",
+					Stacks: []string{"test-stack"}},
+			},
+			Warnings: []string{"stack test-stack-uncovered has no dependency coverage"},
+		}
+
+		if !reflect.DeepEqual(plan, expected) {
+			t.Errorf("Plan = %+v, expected %+v", plan, expected)
+		}
+
+		var out bytes.Buffer
+		if err := plan.Write(&out, libjavabuildpack.PlanFormatJSON); err != nil {
+			t.Fatal(err)
+		}
+
+		var actual libjavabuildpack.ResolutionPlan
+		if err := json.Unmarshal(out.Bytes(), &actual); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("JSON plan = %s, expected %+v", out.String(), expected)
+		}
+	})
+
+	it("plans the warnings raised by the include files, archive name and modification times", func() {
+		root := test.ScratchDir(t, "plan")
+
+		writeFile(t, filepath.Join(root, "bin", "build"), "", 0755)
+		writeFile(t, filepath.Join(root, "bin", "detect"), "#!/bin/sh\n. bin/missing.sh\n", 0755)
+
+		p := newPackager(root, nil, nil)
+		p.Buildpack.Info.Version = "1.0.0-SNAPSHOT"
+		p.Buildpack.Metadata["include_files"] = []interface{}{"bin/build", "bin/detect"}
+		p.CheckScriptReferences = true
+		p.FilenameTemplate = "{id}.tgz"
+		p.ModTimeSource = libjavabuildpack.ModTimeSourceGitCommit
+
+		plan, err := p.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{
+			fmt.Sprintf("%s is not a git checkout, using file modification times", root),
+			"version 1.0.0-SNAPSHOT is a snapshot but filename template {id}.tgz has no {version} to substitute",
+			"required file bin/build is empty",
+			"bin/detect sources bin/missing.sh, which is not included",
+		}
+		if !reflect.DeepEqual(plan.Warnings, expected) {
+			t.Errorf("Plan.Warnings = %s, expected %s", plan.Warnings, expected)
+		}
+	})
+
+	it("plans the dependencies of a resolved buildpack", func() {
+		root := test.ScratchDir(t, "plan")
+
+		p := newPackager(root, nil, nil)
+		p.Buildpack.Metadata["dependencies"] = []map[string]interface{}{
+			testDependency("test-id", "1.0", "https://localhost/test-id-1.0", "test-sha256"),
+		}
+
+		resolved, err := libjavabuildpack.NewResolvedBuildpack(p.Buildpack)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		delete(p.Buildpack.Metadata, "dependencies")
+		p.Buildpack = resolved.Buildpack
+
+		plan, err := p.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(plan.Dependencies) != 1 || plan.Dependencies[0].ID != "test-id" {
+			t.Errorf("Plan.Dependencies = %+v, expected the resolved test-id", plan.Dependencies)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package test
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/libjavabuildpack"
+	"github.com/cloudfoundry/libjavabuildpack/internal"
+)
+
+// DependencyCache is a libjavabuildpack.DependencyCache that serves dependency artifacts from fixtures rather than
+// downloading them.
+type DependencyCache struct {
+	// Root is the directory that artifacts are staged in.  When packaging, it must be within the buildpack root.
+	Root string
+
+	fixtures map[string]string
+}
+
+// AddFixture registers a fixture to be served as the artifact for any dependency with a given SHA256.
+func (c *DependencyCache) AddFixture(t *testing.T, sha256 string, fixture string) {
+	t.Helper()
+	c.fixtures[sha256] = FixturePath(t, fixture)
+}
+
+// ArtifactLayer returns an ArtifactLayer that serves the fixture registered for the dependency.
+func (c *DependencyCache) ArtifactLayer(dependency libjavabuildpack.Dependency) libjavabuildpack.ArtifactLayer {
+	return artifactLayer{filepath.Join(c.Root, dependency.SHA256), c.fixtures[dependency.SHA256], dependency}
+}
+
+type artifactLayer struct {
+	root       string
+	fixture    string
+	dependency libjavabuildpack.Dependency
+}
+
+func (a artifactLayer) Artifact() (string, error) {
+	if a.fixture == "" {
+		return "", fmt.Errorf("no fixture registered for %s", a.dependency)
+	}
+
+	artifact := filepath.Join(a.root, filepath.Base(a.dependency.URI))
+	if err := libjavabuildpack.CopyFile(a.fixture, artifact); err != nil {
+		return "", err
+	}
+
+	d, err := internal.ToTomlString(a.dependency)
+	if err != nil {
+		return "", err
+	}
+
+	if err := libjavabuildpack.WriteToFile(strings.NewReader(d), a.MetadataPath(), 0644); err != nil {
+		return "", err
+	}
+
+	return artifact, nil
+}
+
+func (a artifactLayer) MetadataPath() string {
+	return filepath.Join(a.root, "dependency.toml")
+}
+
+// NewDependencyCache creates a new instance of DependencyCache that stages artifacts in a root directory.
+func NewDependencyCache(t *testing.T, root string) *DependencyCache {
+	t.Helper()
+	return &DependencyCache{root, make(map[string]string)}
+}
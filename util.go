@@ -20,6 +20,8 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -27,6 +29,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/BurntSushi/toml"
 )
@@ -228,6 +231,104 @@ func extractTar(src io.Reader, destDir string, stripComponents int) error {
 	return nil
 }
 
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	s := sha256.New()
+	if _, err := io.Copy(s, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(s.Sum(nil)), nil
+}
+
+func directorySize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// moveFile moves source to destFile, falling back to copying when the two are on different volumes.
+func moveFile(source, destFile string) error {
+	if err := os.MkdirAll(filepath.Dir(destFile), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(source, destFile); err == nil {
+		return nil
+	}
+
+	if err := CopyFile(source, destFile); err != nil {
+		return err
+	}
+
+	return os.Remove(source)
+}
+
+// stagingFile creates a new, empty file in dir to stage content before it is moved into place.  If dir is empty, the
+// fallback directory is used.
+func stagingFile(dir string, fallback string, prefix string) (*os.File, error) {
+	if dir == "" {
+		dir = fallback
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return ioutil.TempFile(dir, prefix)
+}
+
+// writableDir returns whether files can be created in dir.  A directory without any write permission, or on a read-only
+// file system, is not writable, even for a user that could write to it regardless, and a directory that does not exist
+// is assumed to be creatable.
+func writableDir(dir string) (bool, error) {
+	stat, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if stat.Mode().Perm()&0222 == 0 {
+		return false, nil
+	}
+
+	f, err := ioutil.TempFile(dir, ".writable-")
+	if os.IsPermission(err) || readOnlyFileSystem(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+
+	return true, os.Remove(f.Name())
+}
+
+// readOnlyFileSystem returns whether an error is due to a read-only file system.
+func readOnlyFileSystem(err error) bool {
+	e, ok := err.(*os.PathError)
+	return ok && e.Err == syscall.EROFS
+}
+
 func osArgs(index int) (string, error) {
 	if len(os.Args) < index+1 {
 		return "", fmt.Errorf("incorrect number of command line arguments")
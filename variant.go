@@ -0,0 +1,178 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libjavabuildpack
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Variant is a subset of a buildpack that can be packaged on its own.
+type Variant string
+
+const (
+	// VariantFull packages all include files and dependencies.  It is the default.
+	VariantFull Variant = "full"
+
+	// VariantDetectOnly packages only what is needed for detection.  Unless overridden in buildpack.toml, that is
+	// buildpack.toml, bin/detect and no dependencies.
+	VariantDetectOnly Variant = "detect-only"
+
+	// VariantRuntimeOnly packages only what is needed for building.  Unless overridden in buildpack.toml, that is all
+	// include files except bin/detect and all dependencies.
+	VariantRuntimeOnly Variant = "runtime-only"
+)
+
+// variantSelection is the include files and dependency ids that a variant packages.  A nil list selects everything.
+//
+// A variant's selection can be declared in buildpack.toml:
+//
+//	[metadata.variants.detect-only]
+//	include_files = ["bin/detect"]
+//	dependencies  = []
+type variantSelection struct {
+	includeFiles []string
+	dependencies []string
+	exclude      []string
+}
+
+func (b Buildpack) variantSelection(variant Variant) (variantSelection, error) {
+	var selection variantSelection
+
+	switch variant {
+	case "", VariantFull:
+		return variantSelection{}, nil
+	case VariantDetectOnly:
+		selection = variantSelection{includeFiles: []string{filepath.Join("bin", "detect")}, dependencies: []string{}}
+	case VariantRuntimeOnly:
+		selection = variantSelection{exclude: []string{filepath.Join("bin", "detect")}}
+	default:
+		return variantSelection{}, fmt.Errorf("unsupported variant %s", variant)
+	}
+
+	variants, ok := b.Metadata["variants"].(map[string]interface{})
+	if !ok {
+		return selection, nil
+	}
+
+	v, ok := variants[string(variant)].(map[string]interface{})
+	if !ok {
+		return selection, nil
+	}
+
+	if i, ok := v["include_files"]; ok {
+		files, err := stringArray(i)
+		if err != nil {
+			return variantSelection{}, fmt.Errorf("variant %s include_files is not an array of strings", variant)
+		}
+		selection.includeFiles, selection.exclude = files, nil
+	}
+
+	if d, ok := v["dependencies"]; ok {
+		ids, err := stringArray(d)
+		if err != nil {
+			return variantSelection{}, fmt.Errorf("variant %s dependencies is not an array of strings", variant)
+		}
+		selection.dependencies = ids
+	}
+
+	return selection, nil
+}
+
+// filterIncludeFiles returns the files that the variant selects from the expanded include files.  A file is selected by
+// an entry of the variant that names it or a directory containing it.  buildpack.toml is always selected, because no
+// variant is a buildpack without its descriptor.
+func (v variantSelection) filterIncludeFiles(files []string) []string {
+	var selected []string
+
+	for _, file := range files {
+		f := filepath.Clean(file)
+
+		if f == "buildpack.toml" {
+			selected = append(selected, file)
+			continue
+		}
+
+		if v.includeFiles != nil && !containsPath(v.includeFiles, f) {
+			continue
+		}
+
+		if containsPath(v.exclude, f) {
+			continue
+		}
+
+		selected = append(selected, file)
+	}
+
+	return selected
+}
+
+func (v variantSelection) filterDependencies(deps Dependencies) Dependencies {
+	if v.dependencies == nil {
+		return deps
+	}
+
+	var selected Dependencies
+
+	for _, dep := range deps {
+		if containsString(v.dependencies, dep.ID) {
+			selected = append(selected, dep)
+		}
+	}
+
+	return selected
+}
+
+func containsPath(s []string, candidate string) bool {
+	for _, c := range s {
+		c = filepath.Clean(c)
+		if c == candidate || c == "." || strings.HasPrefix(candidate, c+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(s []string, candidate string) bool {
+	for _, c := range s {
+		if filepath.Clean(c) == candidate {
+			return true
+		}
+	}
+
+	return false
+}
+
+func stringArray(v interface{}) ([]string, error) {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not an array of strings")
+	}
+
+	s := []string{}
+	for _, candidate := range a {
+		c, ok := candidate.(string)
+		if !ok {
+			return nil, fmt.Errorf("not an array of strings")
+		}
+		s = append(s, c)
+	}
+
+	return s, nil
+}